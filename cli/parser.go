@@ -2,12 +2,15 @@ package cli
 
 import (
 	"fmt"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 	
 	"bakashier/data"
+	"bakashier/utils"
 )
 
 
@@ -41,6 +44,82 @@ func isParentChildDirectory(pathA string, pathB string) (bool, error) {
 	return isSubPath(cleanA, cleanB) || isSubPath(cleanB, cleanA), nil
 }
 
+// --snapshot の値を解析し、スナップショット ID または日時を返す。
+// 日付のみの場合はその日の終わりまでに作成されたスナップショットを対象とする。
+func parseSnapshotArg(value string) (uint64, time.Time, error) {
+	if id, err := strconv.ParseUint(value, 10, 64); err == nil {
+		if id == 0 {
+			return 0, time.Time{}, fmt.Errorf("snapshot id must be a positive integer")
+		}
+		return id, time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return 0, t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return 0, t, nil
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return 0, t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return 0, time.Time{}, fmt.Errorf("snapshot must be an id or a timestamp (e.g. 2026-01-02T15:04:05)")
+}
+
+// --keep-within・--checksum-interval の値を解析する。time.ParseDuration の単位に加えて d（日）・w（週）・y（365日）を受け付ける。
+// name はエラーメッセージに使用するオプション名。
+func parseDurationArg(name string, value string) (time.Duration, error) {
+	units := map[byte]time.Duration{'d': 24 * time.Hour, 'w': 7 * 24 * time.Hour, 'y': 365 * 24 * time.Hour}
+	if len(value) > 1 {
+		if unit, ok := units[value[len(value)-1]]; ok {
+			n, err := strconv.ParseUint(value[:len(value)-1], 10, 32)
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("%s must be a positive duration (e.g. 30d, 12h)", name)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration (e.g. 30d, 12h)", name)
+	}
+	return d, nil
+}
+
+// --path の値を '/' 区切りのバックアップのルートからの相対パスに正規化する。
+// 先頭の "/" や "./" は取り除き、".." を含むパスや不正なグロブはエラーとする。
+func parsePathPattern(value string) (string, error) {
+	pattern := path.Clean(strings.TrimLeft(filepath.ToSlash(value), "/"))
+	if pattern == "." {
+		return "", fmt.Errorf("path must not be empty")
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("path must not contain \"..\": %s", value)
+		}
+	}
+	if err := utils.ValidatePathPattern(pattern); err != nil {
+		return "", fmt.Errorf("invalid path pattern %q: %w", value, err)
+	}
+	return pattern, nil
+}
+
+// --skip-xattrs の値（',' 区切りの拡張属性の名前空間）を解析する。
+func parseXattrNamespaces(value string) ([]string, error) {
+	var namespaces []string
+	for _, namespace := range strings.Split(value, ",") {
+		namespace = strings.ToLower(strings.TrimSpace(namespace))
+		switch namespace {
+		case "user", "trusted", "security", "system":
+			namespaces = append(namespaces, namespace)
+		default:
+			return nil, fmt.Errorf("skip xattrs must be user, trusted, security or system: %s", value)
+		}
+	}
+	return namespaces, nil
+}
+
 // コマンドライン引数を解析し、モード・ソースディレクトリ・出力先・パスワード・チャンクサイズを返す。
 // エラー時は第6戻り値にエラーを返し、help/version の場合は特別なエラー文字列を使用する。
 func ParseArgs(args []string) (ParsedArgs, error) {
@@ -52,6 +131,33 @@ func ParseArgs(args []string) (ParsedArgs, error) {
 	var chunkSizeMiB uint64 = uint64(0) // 0 = 未指定（デフォルト使用）
 	var limitSizeMiB uint64 = uint64(0) // 0 = 未指定（デフォルト使用）
 	var limitWaitSec uint64 = uint64(0) // 0 = 未指定（デフォルト使用）
+	var kdfType utils.KDFType = utils.KDFPBKDF2SHA256
+	var kdfTime uint32 = uint32(0)      // 0 = 未指定（デフォルト使用）
+	var kdfMemoryMiB uint32 = uint32(0) // 0 = 未指定（デフォルト使用）
+	var kdfThreads uint8 = uint8(0)     // 0 = 未指定（デフォルト使用）
+	var restoreUnsafeNames bool = false
+	var diffContent bool = false
+	var dryRun bool = false
+	var filters []string = []string{}
+	var pruneExcluded bool = false
+	var paths []string = []string{}
+	var onConflict string = "" // 空 = 未指定（上書き）
+	var noOwner bool = false
+	var followSymlinks bool = false
+	var xattrs bool = false
+	var checksum bool = false
+	var checksumInterval time.Duration = 0 // 0 = 毎回確認する
+	var dedup bool = false
+	var packThresholdKiB uint64 = uint64(0) // 0 = 未指定（まとめない）
+	var skipXattrNamespaces []string = []string{}
+	var snapshotID uint64 = uint64(0) // 0 = 未指定（最新）
+	var snapshotTime time.Time
+	var snapshotSet bool = false
+	var keepLast uint32 = uint32(0)    // 0 = 未指定
+	var keepDaily uint32 = uint32(0)   // 0 = 未指定
+	var keepWeekly uint32 = uint32(0)  // 0 = 未指定
+	var keepMonthly uint32 = uint32(0) // 0 = 未指定
+	var keepWithin time.Duration = 0   // 0 = 未指定
 	positional := make([]string, 0, 2)
 	
 	// 引数を解析する。
@@ -60,14 +166,183 @@ func ParseArgs(args []string) (ParsedArgs, error) {
 		switch arg {
 		case "--backup", "-b":
 			if mode != "" && mode != ModeBackup {
-				return ParsedArgs{}, fmt.Errorf("cannot use backup and restore at the same time")
+				return ParsedArgs{}, fmt.Errorf("cannot use backup, restore, verify, diff, snapshots and prune at the same time")
 			}
 			mode = ModeBackup
 		case "--restore", "-r":
 			if mode != "" && mode != ModeRestore {
-				return ParsedArgs{}, fmt.Errorf("cannot use backup and restore at the same time")
+				return ParsedArgs{}, fmt.Errorf("cannot use backup, restore, verify, diff, snapshots and prune at the same time")
 			}
 			mode = ModeRestore
+		case "--verify":
+			if mode != "" && mode != ModeVerify {
+				return ParsedArgs{}, fmt.Errorf("cannot use backup, restore, verify, diff, snapshots and prune at the same time")
+			}
+			mode = ModeVerify
+		case "--diff":
+			if mode != "" && mode != ModeDiff {
+				return ParsedArgs{}, fmt.Errorf("cannot use backup, restore, verify, diff, snapshots and prune at the same time")
+			}
+			mode = ModeDiff
+		case "--snapshots":
+			if mode != "" && mode != ModeSnapshots {
+				return ParsedArgs{}, fmt.Errorf("cannot use backup, restore, verify, diff, snapshots and prune at the same time")
+			}
+			mode = ModeSnapshots
+		case "--prune":
+			if mode != "" && mode != ModePrune {
+				return ParsedArgs{}, fmt.Errorf("cannot use backup, restore, verify, diff, snapshots and prune at the same time")
+			}
+			mode = ModePrune
+		case "--keep-last", "--keep-daily", "--keep-weekly", "--keep-monthly":
+			name := strings.ReplaceAll(strings.TrimPrefix(arg, "--"), "-", " ")
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("%s value is required", name)
+			}
+			keepArg := args[i+1]
+			if len(keepArg) == 0 || keepArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("%s value is required", name)
+			}
+			parsed, err := strconv.ParseUint(keepArg, 10, 32)
+			if err != nil || parsed == 0 {
+				return ParsedArgs{}, fmt.Errorf("%s must be a positive integer", name)
+			}
+			switch arg {
+			case "--keep-last":
+				keepLast = uint32(parsed)
+			case "--keep-daily":
+				keepDaily = uint32(parsed)
+			case "--keep-weekly":
+				keepWeekly = uint32(parsed)
+			case "--keep-monthly":
+				keepMonthly = uint32(parsed)
+			}
+			i++
+		case "--keep-within":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("keep within value is required")
+			}
+			keepWithinArg := args[i+1]
+			if len(keepWithinArg) == 0 || keepWithinArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("keep within value is required")
+			}
+			parsed, err := parseDurationArg("keep within", keepWithinArg)
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			keepWithin = parsed
+			i++
+		case "--snapshot", "-s":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("snapshot value is required")
+			}
+			snapshotArg := args[i+1]
+			if len(snapshotArg) == 0 || snapshotArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("snapshot value is required")
+			}
+			parsedID, parsedTime, err := parseSnapshotArg(snapshotArg)
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			snapshotID = parsedID
+			snapshotTime = parsedTime
+			snapshotSet = true
+			i++
+		case "--diff-content":
+			diffContent = true
+		case "--dry-run", "-n":
+			dryRun = true
+		case "--exclude", "-x", "--include", "-i":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("%s pattern is required", strings.TrimLeft(arg, "-"))
+			}
+			pattern := args[i+1]
+			if len(pattern) == 0 || pattern[0] == '-' || pattern[0] == '!' {
+				return ParsedArgs{}, fmt.Errorf("%s pattern is required", strings.TrimLeft(arg, "-"))
+			}
+			// --include は除外を打ち消すルールとして、指定順に並べる
+			if arg == "--include" || arg == "-i" {
+				pattern = "!" + pattern
+			}
+			filters = append(filters, pattern)
+			i++
+		case "--prune-excluded":
+			pruneExcluded = true
+		case "--follow-symlinks":
+			followSymlinks = true
+		case "--xattrs":
+			xattrs = true
+		case "--checksum":
+			checksum = true
+		case "--checksum-interval":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("checksum interval value is required")
+			}
+			intervalArg := args[i+1]
+			if len(intervalArg) == 0 || intervalArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("checksum interval value is required")
+			}
+			parsed, err := parseDurationArg("checksum interval", intervalArg)
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			checksumInterval = parsed
+			i++
+		case "--dedup":
+			dedup = true
+		case "--pack-threshold":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("pack threshold value is required")
+			}
+			packArg := args[i+1]
+			if len(packArg) == 0 || packArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("pack threshold value is required")
+			}
+			parsed, err := strconv.ParseUint(packArg, 10, 64)
+			if err != nil || parsed == 0 {
+				return ParsedArgs{}, fmt.Errorf("pack threshold must be a positive integer (KiB)")
+			}
+			packThresholdKiB = parsed
+			i++
+		case "--skip-xattrs":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("skip xattrs value is required")
+			}
+			skipArg := args[i+1]
+			if len(skipArg) == 0 || skipArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("skip xattrs value is required")
+			}
+			namespaces, err := parseXattrNamespaces(skipArg)
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			skipXattrNamespaces = append(skipXattrNamespaces, namespaces...)
+			i++
+		case "--on-conflict":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("on conflict value is required")
+			}
+			switch strings.ToLower(args[i+1]) {
+			case "overwrite", "skip", "keep-newer", "rename", "fail":
+				onConflict = strings.ToLower(args[i+1])
+			default:
+				return ParsedArgs{}, fmt.Errorf("on conflict must be overwrite, skip, keep-newer, rename or fail")
+			}
+			i++
+		case "--path":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("path value is required")
+			}
+			pathArg := args[i+1]
+			if len(pathArg) == 0 || pathArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("path value is required")
+			}
+			pattern, err := parsePathPattern(pathArg)
+			if err != nil {
+				return ParsedArgs{}, err
+			}
+			paths = append(paths, pattern)
+			i++
 		case "--password", "-p":
 			if i+1 >= len(args) {
 				return ParsedArgs{}, fmt.Errorf("password value is required")
@@ -134,6 +409,65 @@ func ParseArgs(args []string) (ParsedArgs, error) {
 			}
 			limitWaitSec = parsed
 			i++
+		case "--kdf", "-k":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("kdf value is required")
+			}
+			switch strings.ToLower(args[i+1]) {
+			case "pbkdf2":
+				kdfType = utils.KDFPBKDF2SHA256
+			case "argon2id":
+				kdfType = utils.KDFArgon2id
+			default:
+				return ParsedArgs{}, fmt.Errorf("kdf must be pbkdf2 or argon2id")
+			}
+			i++
+		case "--kdf-time":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("kdf time value is required")
+			}
+			kdfTimeArg := args[i+1]
+			if len(kdfTimeArg) == 0 || kdfTimeArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("kdf time value is required")
+			}
+			parsed, err := strconv.ParseUint(kdfTimeArg, 10, 32)
+			if err != nil || parsed == 0 {
+				return ParsedArgs{}, fmt.Errorf("kdf time must be a positive integer")
+			}
+			kdfTime = uint32(parsed)
+			i++
+		case "--kdf-memory":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("kdf memory value is required")
+			}
+			kdfMemoryArg := args[i+1]
+			if len(kdfMemoryArg) == 0 || kdfMemoryArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("kdf memory value is required")
+			}
+			parsed, err := strconv.ParseUint(kdfMemoryArg, 10, 22)
+			if err != nil || parsed == 0 {
+				return ParsedArgs{}, fmt.Errorf("kdf memory must be a positive integer (MiB)")
+			}
+			kdfMemoryMiB = uint32(parsed)
+			i++
+		case "--kdf-threads":
+			if i+1 >= len(args) {
+				return ParsedArgs{}, fmt.Errorf("kdf threads value is required")
+			}
+			kdfThreadsArg := args[i+1]
+			if len(kdfThreadsArg) == 0 || kdfThreadsArg[0] == '-' {
+				return ParsedArgs{}, fmt.Errorf("kdf threads value is required")
+			}
+			parsed, err := strconv.ParseUint(kdfThreadsArg, 10, 8)
+			if err != nil || parsed == 0 {
+				return ParsedArgs{}, fmt.Errorf("kdf threads must be an integer between 1 and 255")
+			}
+			kdfThreads = uint8(parsed)
+			i++
+		case "--restore-unsafe-names":
+			restoreUnsafeNames = true
+		case "--no-owner":
+			noOwner = true
 		case "--help", "-h":
 			return ParsedArgs{Mode: ModeHelp}, nil
 		case "--version", "-v":
@@ -148,8 +482,112 @@ func ParseArgs(args []string) (ParsedArgs, error) {
 	
 	// 必須項目が不足している場合はエラーを返す。
 	if mode == "" {
-		return ParsedArgs{}, fmt.Errorf("backup or restore mode is required")
+		return ParsedArgs{}, fmt.Errorf("backup, restore, verify, diff, snapshots or prune mode is required")
 	}
+	
+	// 保持ルールは整理でのみ使用でき、整理には1つ以上の保持ルールが必要。
+	hasRetention := keepLast > 0 || keepDaily > 0 || keepWeekly > 0 || keepMonthly > 0 || keepWithin > 0
+	if hasRetention && mode != ModePrune {
+		return ParsedArgs{}, fmt.Errorf("keep options can only be used with prune")
+	}
+	if !hasRetention && mode == ModePrune {
+		return ParsedArgs{}, fmt.Errorf("prune requires at least one keep option")
+	}
+	
+	// 除外ルールはバックアップと差分でのみ使用できる。除外したエントリの削除はバックアップでのみ使用できる。
+	if len(filters) > 0 && mode != ModeBackup && mode != ModeDiff {
+		return ParsedArgs{}, fmt.Errorf("include and exclude can only be used with backup and diff")
+	}
+	if pruneExcluded && mode != ModeBackup {
+		return ParsedArgs{}, fmt.Errorf("prune-excluded can only be used with backup")
+	}
+	
+	// シンボリックリンクを辿る指定はバックアップでのみ使用できる。
+	if followSymlinks && mode != ModeBackup {
+		return ParsedArgs{}, fmt.Errorf("follow-symlinks can only be used with backup")
+	}
+	
+	// 拡張属性の記録はバックアップでのみ、適用しない名前空間の指定は復元でのみ使用できる。
+	if xattrs && mode != ModeBackup {
+		return ParsedArgs{}, fmt.Errorf("xattrs can only be used with backup")
+	}
+	if len(skipXattrNamespaces) > 0 && mode != ModeRestore {
+		return ParsedArgs{}, fmt.Errorf("skip-xattrs can only be used with restore")
+	}
+	
+	// チェックサムによる変更の判定はバックアップでのみ使用でき、確認の間隔は --checksum と併せて指定する。
+	if checksum && mode != ModeBackup {
+		return ParsedArgs{}, fmt.Errorf("checksum can only be used with backup")
+	}
+	if checksumInterval > 0 && !checksum {
+		return ParsedArgs{}, fmt.Errorf("checksum-interval requires checksum")
+	}
+	
+	// チャンクストアはバックアップでのみ作成できる。作成後は他のモードでも自動的に使用する。
+	if dedup && mode != ModeBackup {
+		return ParsedArgs{}, fmt.Errorf("dedup can only be used with backup")
+	}
+	
+	// 小さなファイルのパックアーカイブへのまとめはバックアップでのみ指定できる。ファイルはメモリに読み込むため、パックアーカイブの上限までとする。
+	if packThresholdKiB > 0 && mode != ModeBackup {
+		return ParsedArgs{}, fmt.Errorf("pack-threshold can only be used with backup")
+	}
+	if packThresholdKiB > data.PackSize/1024 {
+		return ParsedArgs{}, fmt.Errorf("pack threshold must be at most %d KiB", data.PackSize/1024)
+	}
+	
+	// 復元するパスの指定は復元でのみ使用できる。
+	if len(paths) > 0 && mode != ModeRestore {
+		return ParsedArgs{}, fmt.Errorf("path can only be used with restore")
+	}
+	
+	// 既存のファイルとの競合の扱いは復元でのみ使用できる。
+	if onConflict != "" && mode != ModeRestore {
+		return ParsedArgs{}, fmt.Errorf("on-conflict can only be used with restore")
+	}
+	
+	// 所有者を復元しない指定は復元でのみ使用できる。
+	if noOwner && mode != ModeRestore {
+		return ParsedArgs{}, fmt.Errorf("no-owner can only be used with restore")
+	}
+	
+	// スナップショットの指定は復元・検証・差分でのみ使用できる。
+	if snapshotSet && mode != ModeRestore && mode != ModeVerify && mode != ModeDiff {
+		return ParsedArgs{}, fmt.Errorf("snapshot can only be used with restore, verify or diff")
+	}
+	
+	// DryRun はバックアップ・復元・整理でのみ使用できる。
+	if dryRun && mode != ModeBackup && mode != ModeRestore && mode != ModePrune {
+		return ParsedArgs{}, fmt.Errorf("dry-run can only be used with backup, restore or prune")
+	}
+	
+	// 検証・スナップショット一覧・整理はバックアップ先ディレクトリのみを受け取る。
+	if mode == ModeVerify || mode == ModeSnapshots || mode == ModePrune {
+		if len(positional) < 1 {
+			return ParsedArgs{}, fmt.Errorf("dist_dir is required")
+		}
+		if len(positional) > 1 {
+			return ParsedArgs{}, fmt.Errorf("too many positional arguments")
+		}
+		if workers == 0 {
+			workers = uint32(runtime.GOMAXPROCS(0))
+		}
+		return ParsedArgs{
+			Mode:     mode,
+			SrcDir:   positional[0],
+			Password: password,
+			Workers:  workers,
+			SnapshotID:   snapshotID,
+			SnapshotTime: snapshotTime,
+			DryRun:       dryRun,
+			KeepLast:     keepLast,
+			KeepDaily:    keepDaily,
+			KeepWeekly:   keepWeekly,
+			KeepMonthly:  keepMonthly,
+			KeepWithin:   keepWithin,
+		}, nil
+	}
+	
 	if len(positional) < 2 {
 		return ParsedArgs{}, fmt.Errorf("src_dir and dist_dir are required")
 	}
@@ -185,6 +623,32 @@ func ParseArgs(args []string) (ParsedArgs, error) {
 		chunkSize = data.ChunkSize
 	}
 	
+	// 鍵導出のパラメータを設定する。
+	kdf := utils.DefaultKDFParams(kdfType)
+	if kdfTime > 0 {
+		kdf.Time = kdfTime
+	}
+	if kdfMemoryMiB > 0 {
+		kdf.Memory = kdfMemoryMiB * 1024
+	}
+	if kdfThreads > 0 {
+		kdf.Threads = kdfThreads
+	}
+	if kdf.Type == utils.KDFPBKDF2SHA256 && kdf.Time > utils.MaxPBKDF2Iterations {
+		return ParsedArgs{}, fmt.Errorf("kdf time must be at most %d for pbkdf2", utils.MaxPBKDF2Iterations)
+	}
+	if kdf.Type == utils.KDFArgon2id {
+		if kdf.Time > utils.MaxArgon2Time {
+			return ParsedArgs{}, fmt.Errorf("kdf time must be at most %d for argon2id", utils.MaxArgon2Time)
+		}
+		if kdf.Memory > utils.MaxArgon2Memory {
+			return ParsedArgs{}, fmt.Errorf("kdf memory must be at most %d MiB", utils.MaxArgon2Memory/1024)
+		}
+		if kdf.Memory < 8*uint32(kdf.Threads) {
+			return ParsedArgs{}, fmt.Errorf("kdf memory is too small for the number of kdf threads")
+		}
+	}
+	
 	// 解析結果を返す。
 	return ParsedArgs{
 		Mode:      mode,
@@ -195,5 +659,23 @@ func ParseArgs(args []string) (ParsedArgs, error) {
 		ChunkSize: chunkSize,
 		LimitSize: limitSizeMiB,
 		LimitWait: limitWaitSec,
+		KDF:       kdf,
+		RestoreUnsafeNames: restoreUnsafeNames,
+		DiffContent:        diffContent,
+		DryRun:             dryRun,
+		Filters:            filters,
+		PruneExcluded:      pruneExcluded,
+		FollowSymlinks:     followSymlinks,
+		Xattrs:             xattrs,
+		Checksum:           checksum,
+		ChecksumInterval:   checksumInterval,
+		Dedup:              dedup,
+		PackThreshold:      packThresholdKiB * 1024,
+		SnapshotID:         snapshotID,
+		SnapshotTime:       snapshotTime,
+		Paths:              paths,
+		OnConflict:         onConflict,
+		NoOwner:            noOwner,
+		SkipXattrNamespaces: skipXattrNamespaces,
 	}, nil
 }
@@ -1,13 +1,23 @@
 package cli
 
+import (
+	"time"
+	
+	"bakashier/utils"
+)
+
 
-// アプリケーションの動作モード（バックアップ/復元/バージョン表示）。
+// アプリケーションの動作モード（バックアップ/復元/検証/差分/スナップショット一覧/整理/バージョン表示）。
 type ModeType string
 const (
-	ModeBackup  ModeType = "backup"
-	ModeRestore ModeType = "restore"
-	ModeVersion ModeType = "version"
-	ModeHelp    ModeType = "help"
+	ModeBackup    ModeType = "backup"
+	ModeRestore   ModeType = "restore"
+	ModeVerify    ModeType = "verify"
+	ModeDiff      ModeType = "diff"
+	ModeSnapshots ModeType = "snapshots"
+	ModePrune     ModeType = "prune"
+	ModeVersion   ModeType = "version"
+	ModeHelp      ModeType = "help"
 )
 
 // コマンドライン引数を解析した結果。
@@ -20,4 +30,27 @@ type ParsedArgs struct {
 	LimitSize uint64
 	LimitWait uint64
 	Workers   uint32
+	KDF       utils.KDFParams
+	RestoreUnsafeNames bool
+	DiffContent        bool
+	DryRun             bool
+	Filters            []string
+	PruneExcluded      bool
+	FollowSymlinks     bool
+	Xattrs             bool
+	Checksum           bool
+	ChecksumInterval   time.Duration
+	Dedup              bool
+	PackThreshold      uint64
+	SnapshotID         uint64
+	SnapshotTime       time.Time
+	KeepLast           uint32
+	KeepDaily          uint32
+	KeepWeekly         uint32
+	KeepMonthly        uint32
+	KeepWithin         time.Duration
+	Paths              []string
+	OnConflict         string
+	NoOwner            bool
+	SkipXattrNamespaces []string
 }
@@ -11,15 +11,49 @@ import (
 func Usage() {
 	fmt.Println("Usage:")
 	fmt.Printf("  %s [--backup|-b|--restore|-r] [src_dir] [dist_dir]\n", constants.APP_NAME)
+	fmt.Printf("  %s --verify [dist_dir]\n", constants.APP_NAME)
+	fmt.Printf("  %s --diff [dist_dir] [live_dir]\n", constants.APP_NAME)
+	fmt.Printf("  %s --snapshots [dist_dir]\n", constants.APP_NAME)
+	fmt.Printf("  %s --prune [dist_dir] --keep-*\n", constants.APP_NAME)
 	fmt.Printf("  %s [--help|-h|--version|-v]\n", constants.APP_NAME)
 	fmt.Println("")
-	fmt.Println("  --backup, -b      Run backup")
+	fmt.Println("  --backup, -b      Run backup (never deletes old versions from dist_dir; use --prune)")
 	fmt.Println("  --restore, -r     Run restore")
+	fmt.Println("  --verify          Verify every archive in dist_dir without restoring")
+	fmt.Println("  --diff            Compare dist_dir (backup) with live_dir and list differences")
+	fmt.Println("  --snapshots       List the snapshots recorded in dist_dir")
+	fmt.Println("  --prune           Delete snapshots and file versions not kept by the keep options")
 	fmt.Println("  --password, -p    Required password")
 	fmt.Println("  --chunk, -c       Chunk size in MiB for backup (default: 16)")
 	fmt.Println("  --workers, -w     Number of workers for backup (default: number of cpu threads)")
 	fmt.Println("  --limit-size, -ls Limit size in MiB for backup (default: 0)")
 	fmt.Println("  --limit-wait, -lw Limit wait in seconds for backup (default: 0)")
+	fmt.Println("  --kdf, -k         Key derivation for backup: pbkdf2 or argon2id (default: pbkdf2)")
+	fmt.Println("  --kdf-time        KDF iterations (default: pbkdf2 4096, argon2id 3)")
+	fmt.Println("  --kdf-memory      Argon2id memory in MiB (default: 64)")
+	fmt.Println("  --kdf-threads     Argon2id parallelism (default: 4)")
+	fmt.Println("  --restore-unsafe-names  Restore entries with unsafe names (e.g. \"../\") under safe replacement names")
+	fmt.Println("  --no-owner        On restore, do not restore file owners (owners are only restored when running as root)")
+	fmt.Println("  --skip-xattrs     On restore, do not apply extended attributes in these namespaces: user, trusted, security, system (comma-separated, repeatable)")
+	fmt.Println("  --diff-content    Compare decrypted file contents instead of size and modification time")
+	fmt.Println("  --dry-run, -n     Show what backup, restore or prune would do without changing anything")
+	fmt.Println("  --exclude, -x     Exclude entries matching a gitignore-style pattern from backup, or from diff's added entries (repeatable)")
+	fmt.Println("  --include, -i     Re-include entries excluded by an earlier pattern (repeatable)")
+	fmt.Println("  --prune-excluded  Delete existing backups of excluded entries instead of keeping them")
+	fmt.Println("  --follow-symlinks Back up the files and directories symlinks point to instead of the links (loops are stored as links)")
+	fmt.Println("  --xattrs          Record extended attributes and POSIX ACLs on backup (Linux only)")
+	fmt.Println("  --checksum        On backup, detect changes by comparing SHA-256 checksums of file contents")
+	fmt.Println("  --checksum-interval  With --checksum, only re-read files with unchanged size and time after this interval (e.g. 7d)")
+	fmt.Println("  --dedup           On backup, store files as deduplicated content-defined chunks (kept for later backups to dist_dir)")
+	fmt.Println("  --pack-threshold  On backup, pack files smaller than this size in KiB into one archive per directory (default: 0 = off)")
+	fmt.Println("  --path            Restore only entries matching a path or glob relative to the backup root (repeatable)")
+	fmt.Println("  --on-conflict     On restore, handle existing files: overwrite, skip, keep-newer, rename or fail (default: overwrite)")
+	fmt.Println("  --snapshot, -s    Snapshot ID or timestamp for restore, verify and diff (default: latest)")
+	fmt.Println("  --keep-last       Keep the N most recent snapshots")
+	fmt.Println("  --keep-daily      Keep the most recent snapshot of each of the last N days")
+	fmt.Println("  --keep-weekly     Keep the most recent snapshot of each of the last N weeks")
+	fmt.Println("  --keep-monthly    Keep the most recent snapshot of each of the last N months")
+	fmt.Println("  --keep-within     Keep snapshots taken within a duration of the latest one (e.g. 30d, 12h)")
 	fmt.Println("  --help, -h        Show help")
 	fmt.Println("  --version, -v     Show version")
 }
\ No newline at end of file
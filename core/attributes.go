@@ -0,0 +1,140 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	
+	"bakashier/data"
+	"bakashier/utils"
+)
+
+
+// エントリに記録する権限のビット。
+const entryModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// バックアップ元の info から、権限と所有者を entry に記録する。xattrs は記録する拡張属性（記録しない場合は nil）。
+func setEntryAttributes(entry *data.DirectoryEntry, info os.FileInfo, xattrs []data.ExtendedAttribute) {
+	entry.Mode = uint32(info.Mode() & entryModeMask)
+	entry.HasMode = true
+	entry.Uid, entry.Gid, entry.HasOwner = utils.FileOwner(info)
+	entry.Xattrs = xattrs
+}
+
+// entry に記録された権限・所有者・拡張属性が info と xattrs に一致するかを判定する。
+func sameEntryAttributes(entry data.DirectoryEntry, info os.FileInfo, xattrs []data.ExtendedAttribute) bool {
+	var current data.DirectoryEntry
+	setEntryAttributes(&current, info, xattrs)
+	return entry.HasMode == current.HasMode && entry.Mode == current.Mode &&
+		entry.HasOwner == current.HasOwner && entry.Uid == current.Uid && entry.Gid == current.Gid &&
+		sameXattrs(entry.Xattrs, current.Xattrs)
+}
+
+// Xattrs が有効な場合に、path の拡張属性を名前順に読み込む。無効な場合は nil を返す。
+func readEntryXattrs(settings Settings, path string) ([]data.ExtendedAttribute, error) {
+	if !settings.Xattrs { return nil, nil }
+	values, err := utils.ReadXattrs(path)
+	if err != nil { return nil, err }
+	var xattrs []data.ExtendedAttribute
+	for name, value := range values {
+		xattrs = append(xattrs, data.ExtendedAttribute{Name: name, Value: value})
+	}
+	sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].Name < xattrs[j].Name })
+	return xattrs, nil
+}
+
+func sameXattrs(a []data.ExtendedAttribute, b []data.ExtendedAttribute) bool {
+	if len(a) != len(b) { return false }
+	for i := range a {
+		if a[i].Name != b[i].Name || !bytes.Equal(a[i].Value, b[i].Value) { return false }
+	}
+	return true
+}
+
+// 復元時に適用する属性の指定。
+type attributeOptions struct {
+	owner               bool     // 所有者を変更するか
+	skipXattrNamespaces []string // 適用しない拡張属性の名前空間
+}
+
+// settings から復元時に適用する属性を決定する。chown は root でのみ成功するため、それ以外では所有者の変更を試みない。
+func restoreAttributeOptions(settings Settings) attributeOptions {
+	return attributeOptions{
+		owner:               !settings.NoOwner && os.Geteuid() == 0,
+		skipXattrNamespaces: settings.SkipXattrNamespaces,
+	}
+}
+
+// 拡張属性 name を適用するかを判定する。名前空間は最初の '.' より前の部分（user, trusted, security, system）。
+func (o attributeOptions) restoreXattr(name string) bool {
+	namespace, _, _ := strings.Cut(name, ".")
+	for _, skip := range o.skipXattrNamespaces {
+		if namespace == skip { return false }
+	}
+	return true
+}
+
+// 復元した path に entry の所有者・権限・拡張属性・更新日時を適用する。
+// chown は setuid/setgid ビットとファイルケーパビリティを落とすため、所有者を先に変更してから権限と拡張属性を設定する。
+// シンボリックリンクの権限は使われず、os.Chmod と os.Chtimes はリンク先に作用するため、リンク自体の拡張属性と更新日時のみを設定する。
+func applyEntryAttributes(path string, entry data.DirectoryEntry, options attributeOptions) error {
+	if options.owner && entry.HasOwner {
+		if err := os.Lchown(path, int(entry.Uid), int(entry.Gid)); err != nil { return err }
+	}
+	if entry.Type != data.Symlink && entry.HasMode {
+		if err := os.Chmod(path, os.FileMode(entry.Mode)&entryModeMask); err != nil { return err }
+	}
+	// 設定できない拡張属性があっても、残りの属性と更新日時は適用してから最初のエラーを返す
+	var xattrErr error
+	for _, xattr := range entry.Xattrs {
+		if !options.restoreXattr(xattr.Name) { continue }
+		if err := utils.WriteXattr(path, xattr.Name, xattr.Value); err != nil && xattrErr == nil {
+			xattrErr = fmt.Errorf("set extended attribute %s: %w", xattr.Name, err)
+		}
+	}
+	if entry.Type == data.Symlink {
+		if err := utils.SetSymlinkModTime(path, entry.ModTime); err != nil { return err }
+		return xattrErr
+	}
+	if err := os.Chtimes(path, time.Now(), entry.ModTime); err != nil { return err }
+	return xattrErr
+}
+
+// 復元したディレクトリと、その属性を適用するためのエントリ。
+type pendingDirectory struct {
+	path  string
+	entry data.DirectoryEntry
+}
+
+// 復元中に作成したディレクトリの一覧。
+// 子の作成でディレクトリの更新日時が変わり、書き込み権限のない権限では子を作成できないため、属性は全ワーカーの完了後に適用する。
+type pendingDirectories struct {
+	mu    sync.Mutex
+	items []pendingDirectory
+}
+
+func (p *pendingDirectories) add(path string, entry data.DirectoryEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items = append(p.items, pendingDirectory{path: path, entry: entry})
+}
+
+// 深いディレクトリから順に属性を適用し、失敗したディレクトリごとに errHandler を呼ぶ。
+// 属性を記録していない旧形式のエントリは、更新日時がバックアップ時刻のため適用しない。
+func (p *pendingDirectories) apply(options attributeOptions, errHandler func(err error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sort.Slice(p.items, func(i, j int) bool {
+		return strings.Count(p.items[i].path, string(os.PathSeparator)) > strings.Count(p.items[j].path, string(os.PathSeparator))
+	})
+	for _, item := range p.items {
+		if !item.entry.HasMode { continue }
+		if err := applyEntryAttributes(item.path, item.entry, options); err != nil {
+			errHandler(err)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package core
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	
 	"bakashier/data"
@@ -16,21 +19,17 @@ import (
 
 // キューからメッセージを受け取り、ワーカーにジョブを配分する。
 // FIND_DIR でジョブを投入し、全ジョブが FINISH_JOB で完了すると各ワーカーに EXIT を送る。
-func backupManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToManager, toWorkerQueue chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager, wg *sync.WaitGroup) {
+// 終了指示を受けた場合は terminated に true を設定する。FINISHED はスナップショットの確定後に Backup が送る。
+func backupManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToManager, toWorkerQueue chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager, terminated *bool, wg *sync.WaitGroup) {
 	defer wg.Done()
-	defer func() {
-		toViewQueue <- view.MessageToView{
-			Source:   view.MANAGER,
-			MsgType:  view.FINISHED,
-			WorkerId: 0,
-			Detail:   "",
-		}
-	}()
 	
 	var untreated int = 0
 	var untreatedMessage = []messageFromManagerToWorker{}
 	var stopWorkers bool = false
 	var termination bool = false
+	defer func() {
+		*terminated = termination
+	}()
 	for {
 		select {
 		case msg := <-fromViewQueue:
@@ -48,10 +47,11 @@ func backupManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToMan
 			switch msg.MsgType {
 			case FIND_DIR:
 				untreatedMessage = append(untreatedMessage, messageFromManagerToWorker{
-					MsgType: NEXT_JOB,
-					SrcDir:  msg.SrcDir,
-					DistDir: msg.DistDir,
-					Detail:  msg.Detail,
+					MsgType:     NEXT_JOB,
+					SrcDir:      msg.SrcDir,
+					DistDir:     msg.DistDir,
+					Detail:      msg.Detail,
+					IgnoreRules: msg.IgnoreRules,
 				})
 				untreated++
 			case FINISH_JOB:
@@ -148,11 +148,63 @@ func backupManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToMan
 	}
 }
 
+// dir 内に残っている書き込み途中の一時ファイルを削除する。
+func removeTempFiles(dir string) {
+	items, err := os.ReadDir(dir)
+	if err != nil { return }
+	for _, item := range items {
+		if !item.IsDir() && utils.IsTempFileName(item.Name()) {
+			os.Remove(filepath.Join(dir, item.Name()))
+		}
+	}
+}
+
+// ジャーナルを結び付ける、バックアップ先のディレクトリ dir の root からの相対パスを返す。
+func journalScope(root string, dir string) string {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return filepath.ToSlash(dir)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// ジャーナルに記録されたエントリで既存のエントリを上書きし、新しいエントリは追加する。
+func mergeJournalEntries(entries []data.DirectoryEntry, journalEntries []data.DirectoryEntry) []data.DirectoryEntry {
+	for _, journaled := range journalEntries {
+		replaced := false
+		for i, entry := range entries {
+			if entry.RealName == journaled.RealName {
+				entries[i] = journaled
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			entries = append(entries, journaled)
+		}
+	}
+	return entries
+}
+
 // ワーカーキューからジョブを受け取り、ディレクトリを走査してファイルをアーカイブする。
 // 既存の _directory_.bks を読み、変更のないファイルはスキップする。ディレクトリは FIND_DIR で再投入する。
-func backupWorker(workerId uint, password string, toManagerQueue chan<- messageFromWorkerToManager, fromManagerQueue <-chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, wg *sync.WaitGroup, chunkSize uint64, limit SettingsLimit) {
+// 書き出しが完了したエントリは _journal_.bks に記録し、中断後の再実行ではそれを再利用する。
+// 除外ルールに一致したエントリはバックアップせず、既存のバックアップは PruneExcluded が有効な場合のみ削除する。
+// DryRun が有効な場合は変更の検出のみを行い、書き出し・スキップ・削除の予定を PLAN で通知する。バックアップ先には何も書き込まない。
+// Xattrs が有効な場合は、拡張属性（POSIX ACL を含む）もエントリに記録する。
+// Checksum が有効な場合は、サイズと更新日時に加えて内容の SHA-256 で変更を判定する。
+// チャンクストアがある場合は、変更されたファイルを内容で区切ったチャンクとしてチャンクストアに格納する。
+// PackThreshold 未満の変更されたファイルは、ディレクトリごとのパックアーカイブにまとめ、確定してからジャーナルに記録する。
+// 複数のハードリンクを持つファイルは hardlinks に記録し、同じ inode のファイルは辞書順で最小の相対パスのファイルを参照するハードリンクとして記録する。
+// 以前のスナップショットのために残す変更前・削除前のファイルの数を retained に加える。バックアップはそれらを削除しない。
+func backupWorker(workerId uint, settings Settings, hardlinks *hardlinkTable, retained *atomic.Uint64, toManagerQueue chan<- messageFromWorkerToManager, fromManagerQueue <-chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, wg *sync.WaitGroup) {
 	defer wg.Done()
 	var processedSize uint64 = 0
+	var password = settings.Password
+	var kdf = settings.KDF
+	var chunkSize = settings.ChunkSize
+	var limit = settings.Limit
+	var dryRun = settings.DryRun
 	
 	toViewQueue <- view.MessageToView{
 		Source:   view.WORKER,
@@ -187,10 +239,12 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 		}
 		
 		func() {
-			err := os.MkdirAll(queue.DistDir, 0755)
-			if err != nil {
-				errHandler("Failed to create directory", err)
-				return
+			if !dryRun {
+				err := os.MkdirAll(queue.DistDir, 0755)
+				if err != nil {
+					errHandler("Failed to create directory", err)
+					return
+				}
 			}
 			
 			files, err := os.ReadDir(queue.SrcDir)
@@ -199,22 +253,21 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 				return
 			}
 			
+			// 除外ルールを読み込む。
+			dirIgnoreRules, ignoreRules, err := loadIgnoreRules(settings, queue.IgnoreRules, queue.SrcDir)
+			if err != nil {
+				errHandler("Failed to load ignore rules", err)
+				return
+			}
+			
 			nameMap := make(map[string]string)                 // [HideName]RealName
 			newEntries := make(map[string]data.DirectoryEntry) // [HideName]DirectoryEntry
 			directoryEntryFile := filepath.Join(queue.DistDir, "_directory_.bks")
+			journalFile := filepath.Join(queue.DistDir, "_journal_.bks")
 			
-			// 既存の _directory_.bks が存在しない場合は、中断されたバックアップを削除する。
-			if _, err := os.Stat(directoryEntryFile); err != nil {
-				items, err := os.ReadDir(queue.DistDir)
-				if err == nil {
-					for _, item := range items {
-						if item.IsDir() {
-							os.RemoveAll(filepath.Join(queue.DistDir, item.Name()))
-						} else {
-							os.Remove(filepath.Join(queue.DistDir, item.Name()))
-						}
-					}
-				}
+			// 前回中断された書き込みの一時ファイルを削除する。
+			if !dryRun {
+				removeTempFiles(queue.DistDir)
 			}
 			
 			// 既存の _directory_.bks からエントリ一覧を読み込む。
@@ -223,13 +276,67 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 				errHandler("Failed to load directory entries", err)
 				return
 			}
-			isExistEntries := len(entries) > 0
+			
+			// 中断されたバックアップのジャーナルがあれば、書き出し済みのエントリを既存のエントリに反映する。
+			journalEntries, journal, err := data.LoadJournal(journalFile, journalScope(settings.DistDir, queue.DistDir), password, kdf)
+			if err != nil {
+				errHandler("Failed to load journal", err)
+				return
+			}
+			defer journal.Close()
+			entries = mergeJournalEntries(entries, journalEntries)
 			for _, entry := range entries {
 				nameMap[entry.HideName] = entry.RealName
 			}
 			
+			// 以前のスナップショットのアーカイブと隠し名が衝突しないよう、バックアップ先の既存の名前も予約する。
+			dstFiles, err := os.ReadDir(queue.DistDir)
+			if dryRun && errors.Is(err, os.ErrNotExist) {
+				dstFiles, err = []os.DirEntry{}, nil
+			}
+			if err != nil {
+				errHandler("Failed to read backup directory", err)
+				return
+			}
+			hasSnapshotEntries := false
+			for _, dstFile := range dstFiles {
+				if _, ok := parseSnapshotEntryFileName(dstFile.Name()); ok {
+					hasSnapshotEntries = true
+				}
+				if _, ok := nameMap[strings.TrimSuffix(dstFile.Name(), ".bks")]; !ok {
+					nameMap[strings.TrimSuffix(dstFile.Name(), ".bks")] = ""
+				}
+			}
+			var appendJournal = func(entry data.DirectoryEntry) {
+				if dryRun { return }
+				if err := journal.Append(entry); err != nil {
+					errHandler("Failed to append journal", err)
+				}
+			}
+			
+			// 小さなファイルはパックアーカイブにまとめ、確定してからエントリをジャーナルに記録する。
+			// 確定できなかった場合は、まとめたファイルの以前のエントリを残す。
+			packs := newPackBuilder(settings, queue.DistDir, nameMap)
+			defer packs.abort()
+			var commitPack = func() {
+				packedFiles, err := packs.commit()
+				for _, packed := range packedFiles {
+					switch {
+					case err == nil:
+						appendJournal(packed.entry)
+					case packed.previous.Type == data.File:
+						newEntries[packed.entry.HideName] = packed.previous
+					default:
+						delete(newEntries, packed.entry.HideName)
+					}
+				}
+				if err != nil {
+					errHandler("Failed to export pack archive", err)
+				}
+			}
+			
 			// バックアップの実行
-			isExistChanges := false
+			isExistChanges := len(journalEntries) > 0
 			for _, file := range files {
 				hideName := utils.GenerateUniqueRandomName(nameMap)
 				entry := data.DirectoryEntry{Type: data.Unknown}
@@ -240,34 +347,156 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 						break
 					}
 				}
+				
+				// エントリの種類を決定する。シンボリックリンクは FollowSymlinks が有効な場合のみリンク先を辿る
+				srcPath := filepath.Join(queue.SrcDir, file.Name())
+				attributePath := srcPath
+				fileInfo, err := file.Info()
+				if err == nil && settings.FollowSymlinks && fileInfo.Mode()&os.ModeSymlink != 0 {
+					if followed, err := followSymlink(settings, queue.SrcDir, file.Name()); err == nil {
+						fileInfo = followed
+						if resolved, err := filepath.EvalSymlinks(srcPath); err == nil {
+							attributePath = resolved
+						}
+					} else {
+						errHandler(fmt.Sprintf("Stored %s as a symlink", srcPath), err)
+					}
+				}
+				if err != nil {
+					// 既存のバックアップは壊れていないため、以前のエントリを残す
+					if entry.Type != data.Unknown {
+						nameMap[hideName] = file.Name()
+						newEntries[hideName] = entry
+					}
+					errHandler("Failed to get file info", err)
+					continue
+				}
+				entryType := backupEntryType(fileInfo)
+				
+				// 除外されたエントリは、既存のバックアップを残すか削除対象とする
+				if isIgnored(settings, ignoreRules, queue.SrcDir, file.Name(), entryType == data.Directory) {
+					if dryRun {
+						sendPlan(toViewQueue, workerId, planExclude, filepath.Join(queue.SrcDir, file.Name()), "")
+					}
+					if entry.Type != data.Unknown && !settings.PruneExcluded {
+						nameMap[hideName] = file.Name()
+						newEntries[hideName] = entry
+					}
+					continue
+				}
+				
+				// 拡張属性を読み込む。読み込めない場合は拡張属性を記録しない
+				xattrs, err := readEntryXattrs(settings, attributePath)
+				if err != nil {
+					errHandler(fmt.Sprintf("Failed to read extended attributes of %s", srcPath), err)
+				}
+				
+				// 同じ inode のファイルのうち、参照先（辞書順で最小の相対パス）以外はそのファイルを参照するハードリンクとして記録する
+				linkTarget := ""
+				if entryType == data.File {
+					relPath := linkRelPath(settings.SrcDir, srcPath)
+					if primary := hardlinks.claim(fileInfo, relPath); primary != relPath {
+						entryType, linkTarget = data.Hardlink, primary
+					}
+				}
+				
+				// ファイル・ディレクトリ・シンボリックリンクが入れ替わった場合は、以前のスナップショットと混ざらないよう新しい隠し名を使う
+				if entry.Type != data.Unknown && entry.Type != entryType {
+					hideName = utils.GenerateUniqueRandomName(nameMap)
+					entry = data.DirectoryEntry{Type: data.Unknown}
+				}
 				nameMap[hideName] = file.Name()
 				
-				if file.IsDir() {
+				switch entryType {
+				case data.Directory:
+					dirInfo := fileInfo
+					
 					// ディレクトリエントリを追加
-					newEntries[hideName] = data.DirectoryEntry{
+					dirEntry := data.DirectoryEntry{
 						Type:     data.Directory,
 						RealName: file.Name(),
 						HideName: hideName,
 						Size:     uint64(0),
-						ModTime:  time.Now(),
+						ModTime:  dirInfo.ModTime(),
 					}
+					setEntryAttributes(&dirEntry, dirInfo, xattrs)
+					newEntries[hideName] = dirEntry
 					
 					// 既存のエントリと異なる場合は変更があると判定 または バックアップ先にディレクトリが存在しない場合は変更があると判定
+					// 更新日時・権限・所有者・拡張属性のみが異なる場合は、ディレクトリエントリのみを更新する
 					if entry.Type != data.Directory || entry.RealName != file.Name() {
 						isExistChanges = true
+						appendJournal(newEntries[hideName])
 					} else if _, err := os.Stat(filepath.Join(queue.DistDir, hideName)); err != nil {
 						isExistChanges = true
+					} else if !entry.ModTime.Equal(dirInfo.ModTime()) || !sameEntryAttributes(entry, dirInfo, xattrs) {
+						isExistChanges = true
 					}
 					
 					// 子ディレクトリの発見をディスパッチャに通知
 					toManagerQueue <- messageFromWorkerToManager{
-						WorkerId: workerId,
-						MsgType:  FIND_DIR,
-						SrcDir:   filepath.Join(queue.SrcDir, file.Name()),
-						DistDir:  filepath.Join(queue.DistDir, hideName),
-						Detail:   "",
+						WorkerId:    workerId,
+						MsgType:     FIND_DIR,
+						SrcDir:      filepath.Join(queue.SrcDir, file.Name()),
+						DistDir:     filepath.Join(queue.DistDir, hideName),
+						Detail:      "",
+						IgnoreRules: dirIgnoreRules,
 					}
-				} else {
+				case data.Symlink:
+					// リンク先はアーカイブを作らず、暗号化されたエントリ一覧に記録する
+					linkTarget, err := os.Readlink(srcPath)
+					if err != nil {
+						if entry.Type == data.Symlink {
+							newEntries[hideName] = entry
+						}
+						errHandler("Failed to read symlink", err)
+						continue
+					}
+					linkEntry := data.DirectoryEntry{
+						Type:       data.Symlink,
+						RealName:   file.Name(),
+						HideName:   hideName,
+						Size:       uint64(0),
+						ModTime:    fileInfo.ModTime(),
+						LinkTarget: linkTarget,
+					}
+					setEntryAttributes(&linkEntry, fileInfo, xattrs)
+					newEntries[hideName] = linkEntry
+					
+					// リンク先・更新日時・所有者・拡張属性のいずれかが異なる場合は変更があると判定
+					if entry.Type != data.Symlink || entry.LinkTarget != linkTarget || !entry.ModTime.Equal(fileInfo.ModTime()) || !sameEntryAttributes(entry, fileInfo, xattrs) {
+						isExistChanges = true
+						appendJournal(linkEntry)
+						if dryRun {
+							sendPlan(toViewQueue, workerId, planWrite, srcPath, "")
+						}
+					} else if dryRun {
+						sendPlan(toViewQueue, workerId, planSkip, srcPath, "")
+					}
+				case data.Hardlink:
+					// 内容は参照先のファイルのアーカイブに含まれるため、アーカイブを作らずにエントリのみを記録する
+					linkEntry := data.DirectoryEntry{
+						Type:       data.Hardlink,
+						RealName:   file.Name(),
+						HideName:   hideName,
+						Size:       uint64(fileInfo.Size()),
+						ModTime:    fileInfo.ModTime(),
+						LinkTarget: linkTarget,
+					}
+					setEntryAttributes(&linkEntry, fileInfo, xattrs)
+					newEntries[hideName] = linkEntry
+					
+					// 参照先・サイズ・更新日時・権限・所有者・拡張属性のいずれかが異なる場合は変更があると判定
+					if entry.Type != data.Hardlink || entry.LinkTarget != linkTarget || entry.Size != uint64(fileInfo.Size()) || !entry.ModTime.Equal(fileInfo.ModTime()) || !sameEntryAttributes(entry, fileInfo, xattrs) {
+						isExistChanges = true
+						appendJournal(linkEntry)
+						if dryRun {
+							sendPlan(toViewQueue, workerId, planWrite, srcPath, "")
+						}
+					} else if dryRun {
+						sendPlan(toViewQueue, workerId, planSkip, srcPath, "")
+					}
+				default:
 					// ファイル処理開始をビューに通知
 					toViewQueue <- view.MessageToView{
 						Source:   view.WORKER,
@@ -280,11 +509,6 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 					
 					func() {
 						isNotChangeFile := false
-						fileInfo, err := file.Info()
-						if err != nil {
-							errHandler("Failed to get file info", err)
-							return
-						}
 						
 						// 変更がないか
 						if entry.Type == data.File {
@@ -293,36 +517,168 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 							}
 						}
 						
-						// バックアップ先にファイルが存在しない場合は変更があると判定
-						if isNotChangeFile {
-							if _, err := os.Stat(filepath.Join(queue.DistDir, fmt.Sprintf("%s.bks", hideName))); err != nil {
-								isNotChangeFile = false
+						// バックアップ先にファイル（チャンクストアに格納したファイルはチャンクストア）が存在しない場合は変更があると判定
+						if isNotChangeFile && !entryContentExists(settings, queue.DistDir, entry) {
+							isNotChangeFile = false
+						}
+						
+						srcFile := filepath.Join(queue.SrcDir, file.Name())
+						archiveFile := filepath.Join(queue.DistDir, fmt.Sprintf("%s.bks", hideName))
+						if entry.Chunked {
+							archiveFile = filepath.Join(settings.DistDir, data.ChunkStoreDirName)
+						} else if entry.Type == data.File && entry.PackName != "" {
+							archiveFile = filepath.Join(queue.DistDir, entryArchiveName(entry))
+						}
+						
+						// Checksum が有効な場合は、記録したチェックサムと内容を比較して変更を判定する
+						// 内容が同じであれば、更新日時のみが変更されたファイルもアーカイブを書き直さない
+						isRefreshed := false
+						if settings.Checksum && entry.Type == data.File && len(entry.Checksum) > 0 && shouldRehash(settings, entry, fileInfo) {
+							if entryContentExists(settings, queue.DistDir, entry) {
+								checksum, err := utils.SHA256File(srcFile)
+								if err != nil {
+									// 既存のバックアップは壊れていないため、以前のエントリを残す
+									newEntries[hideName] = entry
+									errHandler("Failed to compute checksum", err)
+									return
+								}
+								isNotChangeFile = bytes.Equal(checksum, entry.Checksum)
+								if isNotChangeFile && (!entry.ModTime.Equal(fileInfo.ModTime()) || settings.ChecksumInterval > 0) {
+									isRefreshed = true
+									entry.Size = uint64(fileInfo.Size())
+									entry.ModTime = fileInfo.ModTime()
+									entry.ChecksumTime = time.Now()
+								}
 							}
+						} else if settings.Checksum && entry.Type == data.File && len(entry.Checksum) == 0 {
+							// チェックサムを記録していないエントリは内容を確認できないため、書き直して記録する
+							isNotChangeFile = false
 						}
 						
-						// 変更がない場合はスキップ
+						// 変更がない場合はスキップ。権限・所有者・拡張属性・更新日時のみが変更された場合は、アーカイブを書き直さずにエントリのみを更新する
 						if isNotChangeFile {
+							if sameEntryAttributes(entry, fileInfo, xattrs) && !isRefreshed {
+								newEntries[hideName] = entry
+								if dryRun {
+									sendPlan(toViewQueue, workerId, planSkip, srcFile, archiveFile)
+								}
+								return
+							}
+							isExistChanges = true
+							setEntryAttributes(&entry, fileInfo, xattrs)
 							newEntries[hideName] = entry
+							if dryRun {
+								sendPlan(toViewQueue, workerId, planUpdate, srcFile, archiveFile)
+								return
+							}
+							appendJournal(entry)
 							return
 						}
 						isExistChanges = true
 						
-						// ファイルをバックアップ
-						srcFile := filepath.Join(queue.SrcDir, file.Name())
-						archiveFile := filepath.Join(queue.DistDir, fmt.Sprintf("%s.bks", hideName))
-						err = data.ExportStreamArchive(srcFile, archiveFile, file.Name(), password, chunkSize)
+						// チャンクストアがある場合は、内容をチャンクとして格納し、アーカイブは作らない
+						// チャンクストアがなく PackThreshold 未満のファイルは、ディレクトリのパックアーカイブにまとめる
+						chunked := settings.chunkStore != nil || (dryRun && settings.Dedup)
+						packed := !chunked && packs.accepts(fileInfo.Size())
+						
+						// 以前のスナップショットのアーカイブは上書きせず、変更されたファイルは新しい隠し名で書き出す
+						// スナップショット導入前のディレクトリでは、参照するスナップショットがないため上書きする
+						// パックアーカイブは毎回新しい隠し名で書き出すため、まとめるファイルの隠し名は変えない
+						archiveHideName := hideName
+						if !chunked && !packed && entry.Type == data.File && hasSnapshotEntries {
+							archiveHideName = utils.GenerateUniqueRandomName(nameMap)
+							nameMap[archiveHideName] = file.Name()
+						}
+						archiveFile = filepath.Join(queue.DistDir, fmt.Sprintf("%s.bks", archiveHideName))
+						switch {
+						case chunked:
+							archiveFile = filepath.Join(settings.DistDir, data.ChunkStoreDirName)
+						case packed && dryRun:
+							archiveFile = packs.plan(fileInfo.Size())
+						case packed:
+							archiveFile = packs.path()
+						}
+						
+						// 変更前の内容は以前のスナップショットのために残る
+						if entry.Type == data.File && hasSnapshotEntries {
+							retained.Add(1)
+						}
+						
+						// DryRun の場合は書き出さずに予定のみを通知する
+						if dryRun {
+							newEntries[archiveHideName] = data.DirectoryEntry{
+								Type:     data.File,
+								RealName: file.Name(),
+								HideName: archiveHideName,
+								Size:     uint64(fileInfo.Size()),
+								ModTime:  fileInfo.ModTime(),
+								Chunked:  chunked,
+							}
+							sendPlan(toViewQueue, workerId, planWrite, srcFile, archiveFile)
+							return
+						}
+						
+						// ファイルをバックアップ。以前のアーカイブがある場合は、内容が変わっていないチャンクを再利用する
+						var checksum []byte
+						var chunks [][]byte
+						var location packLocation
+						var err error
+						baseArchiveFile := filepath.Join(queue.DistDir, fmt.Sprintf("%s.bks", hideName))
+						if chunked {
+							chunks, checksum, err = settings.chunkStore.ExportFile(srcFile)
+						} else if packed {
+							location, checksum, err = packs.add(srcFile, archiveHideName)
+						} else if _, statErr := os.Stat(baseArchiveFile); entry.Type == data.File && statErr == nil {
+							checksum, err = data.UpdateStreamArchive(baseArchiveFile, hideName, srcFile, archiveFile, file.Name(), archiveHideName, password, kdf, chunkSize)
+							if errors.Is(err, data.ErrStreamArchiveBaseUnusable) {
+								// 以前のアーカイブが壊れている場合は報告し、チャンクを再利用せずにすべて書き出す
+								errHandler(fmt.Sprintf("Failed to reuse the previous archive of %s", srcFile), err)
+								checksum, err = data.ExportStreamArchive(srcFile, archiveFile, file.Name(), archiveHideName, password, kdf, chunkSize)
+							}
+						} else {
+							checksum, err = data.ExportStreamArchive(srcFile, archiveFile, file.Name(), archiveHideName, password, kdf, chunkSize)
+						}
 						if err != nil {
-							errHandler("Failed to export stream archive", err)
+							// 書き出しに失敗しても既存のアーカイブは壊れていないため、以前のエントリを残す
+							// 以前のエントリがない場合は、ハードリンクの参照先を後続のリンクに譲る
+							if entry.Type == data.File {
+								newEntries[hideName] = entry
+							} else {
+								hardlinks.release(fileInfo, linkRelPath(settings.SrcDir, srcFile))
+							}
+							if errors.Is(err, data.ErrSourceFileChanged) {
+								// 読み込み中に変更されたファイルは記録せず、次回のバックアップで再取得する
+								errHandler(fmt.Sprintf("Skipped %s", srcFile), err)
+							} else {
+								errHandler("Failed to export stream archive", err)
+							}
 							return
 						}
 						
 						// ファイルエントリを追加
-						newEntries[hideName] = data.DirectoryEntry{
-							Type:     data.File,
-							RealName: file.Name(),
-							HideName: hideName,
-							Size:     uint64(fileInfo.Size()),
-							ModTime:  fileInfo.ModTime(),
+						fileEntry := data.DirectoryEntry{
+							Type:         data.File,
+							RealName:     file.Name(),
+							HideName:     archiveHideName,
+							Size:         uint64(fileInfo.Size()),
+							ModTime:      fileInfo.ModTime(),
+							Checksum:     checksum,
+							ChecksumTime: time.Now(),
+							Chunked:      chunked,
+							Chunks:       chunks,
+							PackName:     location.name,
+							PackOffset:   location.offset,
+							PackLength:   location.length,
+						}
+						setEntryAttributes(&fileEntry, fileInfo, xattrs)
+						newEntries[archiveHideName] = fileEntry
+						if packed {
+							packs.hold(fileEntry, entry)
+							if packs.full() {
+								commitPack()
+							}
+						} else {
+							appendJournal(fileEntry)
 						}
 						
 						if limit.Size > 0 && limit.Wait > 0 {
@@ -346,61 +702,42 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 				}
 			}
 			
-			// 既存のエントリから削除されたファイルを削除する。
-			if isExistEntries {
-				for _, entry := range entries {
-					if _, ok := newEntries[entry.HideName]; !ok {
-						isExistChanges = true
-						if entry.Type == data.File {
-							os.Remove(filepath.Join(queue.DistDir, fmt.Sprintf("%s.bks", entry.HideName)))
-						} else {
-							os.RemoveAll(filepath.Join(queue.DistDir, entry.HideName))
-						}
-					}
-				}
+			// 書き込み中のパックアーカイブを確定する
+			if !dryRun {
+				commitPack()
 			}
 			
-			// エントリに存在しないバックアップファイルを削除
-			dstFiles, err := os.ReadDir(queue.DistDir)
-			if err != nil {
-				errHandler("Failed to read backup directory", err)
-				return
+			// 削除されたエントリは新しいスナップショットに含めない。アーカイブは以前のスナップショットのために残す。
+			newNames := make(map[string]bool)
+			for _, entry := range newEntries {
+				newNames[entry.RealName] = true
 			}
-			for _, dstFile := range dstFiles {
-				isExist := false
-				// ファイル名の先頭と末尾が_の場合はスキップ
-				if !dstFile.IsDir() {
-					name := strings.ToLower(dstFile.Name())
-					if strings.HasPrefix(name, "_") && strings.HasSuffix(name, "_.bks") {
-						continue
-					}
-				}
-				
-				for _, entry := range newEntries {
-					if entry.Type == data.File {
-						if fmt.Sprintf("%s.bks", entry.HideName) == dstFile.Name() {
-							isExist = true
-							break
-						}
-					} else {
-						if entry.HideName == dstFile.Name() {
-							isExist = true
-							break
+			for _, entry := range entries {
+				if !newNames[entry.RealName] {
+					isExistChanges = true
+					retained.Add(1)
+					if dryRun {
+						// シンボリックリンクとハードリンクはエントリ一覧にのみ記録されているため、対応するファイルはない
+						// チャンクストアに格納したファイルのチャンクは、整理で参照されなくなった場合に削除する
+						// パックアーカイブは他のファイルと共有し、整理でどのファイルからも参照されなくなった場合に削除する
+						target := filepath.Join(queue.DistDir, entry.HideName)
+						switch {
+						case entry.Type == data.File && !entry.Chunked && entry.PackName == "":
+							target = filepath.Join(queue.DistDir, fmt.Sprintf("%s.bks", entry.HideName))
+						case entry.Type == data.File, entry.Type == data.Symlink, entry.Type == data.Hardlink:
+							target = ""
 						}
-					}
-				}
-				
-				if !isExist {
-					if dstFile.IsDir() {
-						os.RemoveAll(filepath.Join(queue.DistDir, dstFile.Name()))
-					} else {
-						os.Remove(filepath.Join(queue.DistDir, dstFile.Name()))
+						sendPlan(toViewQueue, workerId, planRemove, filepath.Join(queue.SrcDir, entry.RealName), target)
 					}
 				}
 			}
 			
-			// ディレクトリエントリを保存
-			if isExistChanges {
+			// DryRun の場合は _directory_.bks とジャーナルを更新しない
+			if dryRun { return }
+			
+			// ディレクトリエントリを、このスナップショットの写しと最新の _directory_.bks に保存する。
+			// 変更がなくても写しが1つもない場合（スナップショット導入前のバックアップ）は保存する。
+			if isExistChanges || (!hasSnapshotEntries && len(newEntries) > 0) {
 				entries = make([]data.DirectoryEntry, 0, len(newEntries))
 				for _, entry := range newEntries {
 					entries = append(entries, entry)
@@ -410,17 +747,27 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 					errHandler("Failed to export directory entries", err)
 					return
 				}
-				archive, err := data.ToArchiveData(queue.SrcDir, content, password)
+				archive, err := data.ToArchiveData(queue.SrcDir, directoryEntryHideName, content, password, kdf)
 				if err != nil {
 					errHandler("Failed to create export directory entries archive data", err)
 					return
 				}
+				err = archive.Export(filepath.Join(queue.DistDir, snapshotEntryFileName(settings.SnapshotID)))
+				if err != nil {
+					errHandler("Failed to export snapshot directory entries archive", err)
+					return
+				}
 				err = archive.Export(directoryEntryFile)
 				if err != nil {
 					errHandler("Failed to export directory entries archive", err)
 					return
 				}
 			}
+			
+			// _directory_.bks に反映済みのためジャーナルを削除する
+			if err := journal.Remove(); err != nil {
+				errHandler("Failed to remove journal", err)
+			}
 		}()
 		
 		toViewQueue <- view.MessageToView{
@@ -443,8 +790,58 @@ func backupWorker(workerId uint, password string, toManagerQueue chan<- messageF
 
 // settings.SrcDir を暗号化・圧縮して settings.DistDir にバックアップする。
 // マネージャ1つと複数のワーカーを起動し、チャネルでジョブを分配する。
+// 実行ごとに新しいスナップショットを作成し、すべてのディレクトリを処理し終えた場合のみ完了として記録する。
 func Backup(settings Settings, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager) {
 	var wg sync.WaitGroup
+	var terminated bool = false
+	defer func() {
+		toViewQueue <- view.MessageToView{
+			Source:   view.MANAGER,
+			MsgType:  view.FINISHED,
+			WorkerId: 0,
+			Detail:   "",
+		}
+	}()
+	var errHandler = func(prefix string, err error) {
+		toViewQueue <- view.MessageToView{
+			Source:   view.MANAGER,
+			MsgType:  view.ERROR,
+			WorkerId: 0,
+			Detail:   fmt.Sprintf("%s: %s", prefix, err.Error()),
+		}
+	}
+	
+	// 新しいスナップショットを未完了として登録する
+	snapshots, _, err := loadSnapshots(settings.DistDir, settings.Password)
+	if err != nil {
+		errHandler("Failed to load snapshots", err)
+		return
+	}
+	snapshot := data.Snapshot{ID: 1, Time: time.Now(), Complete: false}
+	for _, s := range snapshots {
+		if s.ID >= snapshot.ID {
+			snapshot.ID = s.ID + 1
+		}
+	}
+	settings.SnapshotID = snapshot.ID
+	if !settings.DryRun {
+		if err := os.MkdirAll(settings.DistDir, 0755); err != nil {
+			errHandler("Failed to create directory", err)
+			return
+		}
+		snapshots = append(snapshots, snapshot)
+		if err := saveSnapshots(settings.DistDir, settings.Password, settings.KDF, snapshots); err != nil {
+			errHandler("Failed to save snapshots", err)
+			return
+		}
+	}
+	
+	// Dedup が有効な場合はチャンクストアを作成する。一度作成したバックアップ先では、以降のバックアップも常にチャンクストアを使う
+	settings.chunkStore, err = openChunkStore(settings, settings.DistDir, settings.Dedup && !settings.DryRun)
+	if err != nil {
+		errHandler("Failed to open chunk store", err)
+		return
+	}
 	
 	workers := settings.Workers
 	queueSize := workers * 8
@@ -463,13 +860,39 @@ func Backup(settings Settings, toViewQueue chan<- view.MessageToView, fromViewQu
 		Detail:  "",
 	}
 	
+	// ハードリンクはディレクトリをまたぐため、全ワーカーで1つの一覧を共有する
+	hardlinks := newHardlinkTable(settings)
+	var retained atomic.Uint64
+	
 	wg.Add(int(workers) + 1)
-	go backupManager(workers, workerToManagerQueue, managerToWorkerQueue, toViewQueue, fromViewQueue, &wg)
+	go backupManager(workers, workerToManagerQueue, managerToWorkerQueue, toViewQueue, fromViewQueue, &terminated, &wg)
 	for i := uint(0); i < uint(workers); i++ {
-		go backupWorker(i+1, settings.Password, workerToManagerQueue, managerToWorkerQueue, toViewQueue, &wg, settings.ChunkSize, settings.Limit)
+		go backupWorker(i+1, settings, hardlinks, &retained, workerToManagerQueue, managerToWorkerQueue, toViewQueue, &wg)
 	}
 	wg.Wait()
 	
 	close(workerToManagerQueue)
 	close(managerToWorkerQueue)
+	
+	// 中断されなかった場合はスナップショットを完了として記録する
+	if !settings.DryRun && !terminated {
+		snapshots[len(snapshots)-1].Complete = true
+		if err := saveSnapshots(settings.DistDir, settings.Password, settings.KDF, snapshots); err != nil {
+			errHandler("Failed to save snapshots", err)
+		}
+	}
+	
+	// バックアップは以前のバージョンを削除しないため、バックアップ先が増え続けることを通知する
+	if n := retained.Load(); n > 0 {
+		kept := "are kept"
+		if settings.DryRun {
+			kept = "would be kept"
+		}
+		toViewQueue <- view.MessageToView{
+			Source:   view.MANAGER,
+			MsgType:  view.WARNING,
+			WorkerId: 0,
+			Detail:   fmt.Sprintf("Previous versions of %d changed or removed entries %s in %s for older snapshots; backup never deletes them, run --prune to remove expired versions", n, kept, settings.DistDir),
+		}
+	}
 }
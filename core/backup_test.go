@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	
+	"bakashier/data"
+)
+
+
+// 中断されたバックアップのジャーナルがある場合に、記録済みのアーカイブを書き直さずに再利用し、
+// 残りのファイルのみを書き出して完了することを確認する。
+func TestBackupResumesFromJournal(t *testing.T) {
+	src, dist, restored := t.TempDir(), t.TempDir(), t.TempDir()
+	files := map[string]string{"a.txt": "finished before the interruption", "b.txt": "not yet archived", "c.txt": "also pending"}
+	writeTestFiles(t, src, files)
+	settings := testSettings(src, dist)
+	
+	// a.txt のアーカイブを書き出してジャーナルに記録し、b.txt は書き込み途中の一時ファイルを残して中断した状態にする
+	info, err := os.Stat(filepath.Join(src, "a.txt"))
+	if err != nil { t.Fatal(err) }
+	archiveFile := filepath.Join(dist, "finished.bks")
+	checksum, err := data.ExportStreamArchive(filepath.Join(src, "a.txt"), archiveFile, "a.txt", "finished", settings.Password, settings.KDF, settings.ChunkSize)
+	if err != nil { t.Fatal(err) }
+	entry := data.DirectoryEntry{
+		Type:     data.File,
+		RealName: "a.txt",
+		HideName: "finished",
+		Size:     uint64(info.Size()),
+		ModTime:  info.ModTime(),
+		Checksum: checksum,
+	}
+	setEntryAttributes(&entry, info, nil)
+	_, journal, err := data.LoadJournal(filepath.Join(dist, "_journal_.bks"), journalScope(dist, dist), settings.Password, settings.KDF)
+	if err != nil { t.Fatal(err) }
+	if err := journal.Append(entry); err != nil { t.Fatal(err) }
+	if err := journal.Close(); err != nil { t.Fatal(err) }
+	tempFile := filepath.Join(dist, "partial.bks.123.tmp")
+	if err := os.WriteFile(tempFile, []byte("partial"), 0644); err != nil { t.Fatal(err) }
+	archived, err := os.ReadFile(archiveFile)
+	if err != nil { t.Fatal(err) }
+	archivedInfo, err := os.Stat(archiveFile)
+	if err != nil { t.Fatal(err) }
+	
+	// 再実行すると、a.txt のアーカイブはそのまま使い、ジャーナルと一時ファイルは削除される
+	requireNoErrors(t, runTestMode(Backup, settings))
+	afterInfo, err := os.Stat(archiveFile)
+	if err != nil { t.Fatalf("journaled archive was removed: %v", err) }
+	after, err := os.ReadFile(archiveFile)
+	if err != nil { t.Fatal(err) }
+	if !os.SameFile(archivedInfo, afterInfo) || !bytes.Equal(archived, after) {
+		t.Fatal("journaled archive was rewritten")
+	}
+	for _, name := range []string{"_journal_.bks", "partial.bks.123.tmp"} {
+		if _, err := os.Stat(filepath.Join(dist, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s was not removed: %v", name, err)
+		}
+	}
+	
+	entries, err := loadDirectoryEntries(filepath.Join(dist, "_directory_.bks"), settings.Password)
+	if err != nil { t.Fatal(err) }
+	found := false
+	for _, e := range entries {
+		if e.RealName == "a.txt" {
+			found = e.HideName == "finished"
+		}
+	}
+	if !found {
+		t.Fatalf("a.txt does not reference the journaled archive: %+v", entries)
+	}
+	
+	// 復元した内容が元のファイルと一致する
+	requireNoErrors(t, runTestMode(Restore, testSettings(dist, restored)))
+	requireTestFiles(t, restored, files)
+}
+
+// 他のディレクトリからコピーされたジャーナルを拒否し、記録されたエントリを取り込まないことを確認する。
+func TestBackupRejectsCopiedJournal(t *testing.T) {
+	src, dist, restored := t.TempDir(), t.TempDir(), t.TempDir()
+	files := map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo"}
+	writeTestFiles(t, src, files)
+	settings := testSettings(src, dist)
+	requireNoErrors(t, runTestMode(Backup, settings))
+	
+	// sub のジャーナルに a.txt を sub/b.txt のアーカイブとして記録し、ルートにコピーする
+	entries, err := loadDirectoryEntries(filepath.Join(dist, "_directory_.bks"), settings.Password)
+	if err != nil { t.Fatal(err) }
+	subDir := ""
+	for _, e := range entries {
+		if e.RealName == "sub" {
+			subDir = filepath.Join(dist, e.HideName)
+		}
+	}
+	subEntries, err := loadDirectoryEntries(filepath.Join(subDir, "_directory_.bks"), settings.Password)
+	if err != nil { t.Fatal(err) }
+	forged := subEntries[0]
+	forged.RealName = "a.txt"
+	subJournal := filepath.Join(subDir, "_journal_.bks")
+	_, journal, err := data.LoadJournal(subJournal, journalScope(dist, subDir), settings.Password, settings.KDF)
+	if err != nil { t.Fatal(err) }
+	if err := journal.Append(forged); err != nil { t.Fatal(err) }
+	if err := journal.Close(); err != nil { t.Fatal(err) }
+	content, err := os.ReadFile(subJournal)
+	if err != nil { t.Fatal(err) }
+	if err := os.Remove(subJournal); err != nil { t.Fatal(err) }
+	if err := os.WriteFile(filepath.Join(dist, "_journal_.bks"), content, 0644); err != nil { t.Fatal(err) }
+	
+	messages := runTestMode(Backup, settings)
+	if got := countErrors(messages, "Failed to load journal"); got != 1 {
+		t.Fatalf("got %d journal errors, want 1", got)
+	}
+	requireNoErrors(t, runTestMode(Restore, testSettings(dist, restored)))
+	requireTestFiles(t, restored, files)
+}
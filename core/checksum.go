@@ -0,0 +1,25 @@
+package core
+
+import (
+	"os"
+	"time"
+	
+	"bakashier/data"
+)
+
+
+// Checksum が有効な場合に、ファイルの内容を読んで entry のチェックサムと比較するかを判定する。
+// サイズが異なるファイルは内容も異なるため読まず、更新日時のみが異なるファイルは内容が同じかを確認するため常に読む。
+// サイズと更新日時が一致するファイルは、ChecksumInterval が 0 なら毎回、それ以外は前回の計算から間隔が経過した場合のみ読む。
+func shouldRehash(settings Settings, entry data.DirectoryEntry, info os.FileInfo) bool {
+	if entry.Size != uint64(info.Size()) {
+		return false
+	}
+	if !entry.ModTime.Equal(info.ModTime()) {
+		return true
+	}
+	if settings.ChecksumInterval <= 0 {
+		return true
+	}
+	return time.Since(entry.ChecksumTime) >= settings.ChecksumInterval
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	
+	"bakashier/data"
+	"bakashier/view"
+)
+
+
+var errChunkStoreMissing = errors.New("file is stored in the chunk store, but the chunk store was not found")
+
+// バックアップ先 backupDir のチャンクストアを開く。チャンクストアがない場合は nil を返す。
+// create が true の場合は、チャンクストアがなければ作成する。
+func openChunkStore(settings Settings, backupDir string, create bool) (*data.ChunkStore, error) {
+	store, err := data.OpenChunkStore(filepath.Join(backupDir, data.ChunkStoreDirName), settings.Password, settings.KDF, create)
+	if errors.Is(err, data.ErrChunkStoreNotFound) {
+		return nil, nil
+	}
+	return store, err
+}
+
+// 整理で、残すスナップショットから参照されているチャンクの一覧。
+// 参照を集め終えていないディレクトリの数を pending で数え、0 でない場合（読み込みの失敗や中断）はチャンクを削除しない。
+type chunkReferences struct {
+	mu      sync.Mutex
+	ids     map[string]bool
+	pending int
+}
+
+// 参照を集めるディレクトリを1つ追加する。
+func (r *chunkReferences) expect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending++
+}
+
+// ディレクトリの参照を集め終えたことを記録する。
+func (r *chunkReferences) done() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending--
+}
+
+func (r *chunkReferences) add(ids [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ids == nil {
+		r.ids = make(map[string]bool)
+	}
+	for _, id := range ids {
+		r.ids[data.ChunkIDString(id)] = true
+	}
+}
+
+// 参照されていないチャンクと、書き込みが中断された一時ファイルを削除し、失敗したファイルごとに errHandler を呼ぶ。
+// DryRun の場合は削除の予定のみを通知する。参照を集め終えていない場合は何も削除せずにエラーを返す。
+func (r *chunkReferences) prune(settings Settings, toViewQueue chan<- view.MessageToView, errHandler func(err error)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending != 0 {
+		return errors.New("chunk references could not be collected from every directory")
+	}
+	chunks, temps, err := settings.chunkStore.ListChunks()
+	if err != nil { return err }
+	for id, path := range chunks {
+		if !r.ids[id] {
+			temps = append(temps, path)
+		}
+	}
+	sort.Strings(temps)
+	for _, path := range temps {
+		sendPlan(toViewQueue, 0, planDelete, "", path)
+		if settings.DryRun { continue }
+		if err := os.Remove(path); err != nil {
+			errHandler(err)
+		}
+	}
+	return nil
+}
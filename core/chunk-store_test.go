@@ -0,0 +1,76 @@
+package core
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	
+	"bakashier/data"
+)
+
+
+// 指定したサイズの乱数の内容を返す。
+func randomContent(size int, seed int64) string {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return string(content)
+}
+
+// チャンクストアに保存されているチャンクの ID の一覧を返す。
+func listTestChunks(t *testing.T, store *data.ChunkStore) map[string]bool {
+	t.Helper()
+	chunks, temps, err := store.ListChunks()
+	if err != nil { t.Fatal(err) }
+	if len(temps) != 0 {
+		t.Fatalf("temporary chunk files remain: %v", temps)
+	}
+	ids := make(map[string]bool)
+	for id := range chunks {
+		ids[id] = true
+	}
+	return ids
+}
+
+// 重複を排除したバックアップを2回行い、最新のスナップショットのみを残して整理すると、
+// 古いファイルのみが参照していたチャンクが削除され、残したスナップショットを復元できることを確認する。
+func TestPruneRemovesUnreferencedChunks(t *testing.T) {
+	src, dist, restored := t.TempDir(), t.TempDir(), t.TempDir()
+	settings := testSettings(src, dist)
+	settings.Dedup = true
+	writeTestFiles(t, src, map[string]string{"kept.bin": randomContent(3*1024*1024, 1), "changed.bin": randomContent(3*1024*1024, 2)})
+	requireNoErrors(t, runTestMode(Backup, settings))
+	
+	store, err := data.OpenChunkStore(filepath.Join(dist, data.ChunkStoreDirName), settings.Password, settings.KDF, false)
+	if err != nil { t.Fatal(err) }
+	before := listTestChunks(t, store)
+	
+	// changed.bin を書き換えて再度バックアップすると、新しいチャンクが追加される
+	files := map[string]string{"kept.bin": randomContent(3*1024*1024, 1), "changed.bin": randomContent(3*1024*1024, 3)}
+	writeTestFiles(t, src, files)
+	requireNoErrors(t, runTestMode(Backup, settings))
+	if after := listTestChunks(t, store); len(after) <= len(before) {
+		t.Fatalf("got %d chunks after the second backup, had %d", len(after), len(before))
+	}
+	
+	pruneSettings := testSettings(dist, "")
+	pruneSettings.Retention = SettingsRetention{Last: 1}
+	requireNoErrors(t, runTestMode(Prune, pruneSettings))
+	
+	// 残るのは現在のファイルのチャンクのみ
+	pruned := listTestChunks(t, store)
+	referenced := make(map[string]bool)
+	for name := range files {
+		ids, _, err := store.ExportFile(filepath.Join(src, name))
+		if err != nil { t.Fatal(err) }
+		for _, id := range ids {
+			referenced[data.ChunkIDString(id)] = true
+		}
+	}
+	if !reflect.DeepEqual(pruned, referenced) {
+		t.Fatalf("got %d chunks after pruning, want the %d referenced chunks", len(pruned), len(referenced))
+	}
+	
+	requireNoErrors(t, runTestMode(Restore, testSettings(dist, restored)))
+	requireTestFiles(t, restored, files)
+}
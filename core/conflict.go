@@ -0,0 +1,60 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+
+// 復元先に既存のファイルがある場合の扱い。
+type ConflictPolicy string
+const (
+	ConflictOverwrite ConflictPolicy = "overwrite"  // 既存のファイルを上書きする
+	ConflictSkip      ConflictPolicy = "skip"       // 既存のファイルを残し、復元しない
+	ConflictKeepNewer ConflictPolicy = "keep-newer" // 更新日時が新しい方を残す
+	ConflictRename    ConflictPolicy = "rename"     // 既存のファイルを残し、接尾辞を付けた名前で復元する
+	ConflictFail      ConflictPolicy = "fail"       // 復元を中止する
+)
+
+// 復元先 realPath の既存ファイルとの競合を policy に従って解決し、書き出し先と判断（plan* の操作）を返す。
+// 既存のファイルがない場合は realPath と planCreate を返す。
+// ConflictRename では usedNames と既存のファイルに衝突しない "<名前>~N<拡張子>" を書き出し先とし、usedNames に予約する。
+func resolveConflict(policy ConflictPolicy, realPath string, modTime time.Time, usedNames map[string]bool) (string, string, error) {
+	info, err := os.Lstat(realPath)
+	if errors.Is(err, os.ErrNotExist) { return realPath, planCreate, nil }
+	if err != nil { return "", "", err }
+	
+	switch policy {
+	case ConflictSkip:
+		return realPath, planSkip, nil
+	case ConflictKeepNewer:
+		if info.ModTime().Before(modTime) {
+			return realPath, planOverwrite, nil
+		}
+		return realPath, planSkip, nil
+	case ConflictRename:
+		dir, name := filepath.Split(realPath)
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		if base == "" {
+			base, ext = name, ""
+		}
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s~%d%s", base, i, ext)
+			if usedNames[candidate] { continue }
+			_, err := os.Lstat(filepath.Join(dir, candidate))
+			if err == nil { continue }
+			if !errors.Is(err, os.ErrNotExist) { return "", "", err }
+			usedNames[candidate] = true
+			return filepath.Join(dir, candidate), planRename, nil
+		}
+	case ConflictFail:
+		return realPath, planFail, nil
+	default:
+		return realPath, planOverwrite, nil
+	}
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	
+	"bakashier/view"
+)
+
+
+// 既存のファイルがある復元先に、各競合の扱いで復元した結果を確認する。DryRun では同じ判断を予定として通知し、何も変更しない。
+func TestRestoreConflictPolicies(t *testing.T) {
+	src, dist := t.TempDir(), t.TempDir()
+	writeTestFiles(t, src, map[string]string{"a.txt": "backup", "new.txt": "only in backup"})
+	backupTime := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "a.txt"), backupTime, backupTime); err != nil { t.Fatal(err) }
+	requireNoErrors(t, runTestMode(Backup, testSettings(src, dist)))
+	
+	older, newer := backupTime.Add(-time.Hour), backupTime.Add(time.Hour)
+	tests := []struct {
+		name     string
+		policy   ConflictPolicy
+		existing map[string]string
+		modTime  time.Time // 既存の a.txt の更新日時
+		action   string    // a.txt の判断
+		want     map[string]string
+		aborted  bool
+	}{
+		{"default overwrites", "", map[string]string{"a.txt": "existing"}, newer, planOverwrite, map[string]string{"a.txt": "backup", "new.txt": "only in backup"}, false},
+		{"overwrite", ConflictOverwrite, map[string]string{"a.txt": "existing"}, newer, planOverwrite, map[string]string{"a.txt": "backup", "new.txt": "only in backup"}, false},
+		{"skip", ConflictSkip, map[string]string{"a.txt": "existing"}, older, planSkip, map[string]string{"a.txt": "existing", "new.txt": "only in backup"}, false},
+		{"keep-newer replaces an older file", ConflictKeepNewer, map[string]string{"a.txt": "existing"}, older, planOverwrite, map[string]string{"a.txt": "backup", "new.txt": "only in backup"}, false},
+		{"keep-newer keeps a newer file", ConflictKeepNewer, map[string]string{"a.txt": "existing"}, newer, planSkip, map[string]string{"a.txt": "existing", "new.txt": "only in backup"}, false},
+		{"rename", ConflictRename, map[string]string{"a.txt": "existing"}, newer, planRename, map[string]string{"a.txt": "existing", "a~1.txt": "backup", "new.txt": "only in backup"}, false},
+		{"rename skips used suffixes", ConflictRename, map[string]string{"a.txt": "existing", "a~1.txt": "earlier copy"}, newer, planRename, map[string]string{"a.txt": "existing", "a~1.txt": "earlier copy", "a~2.txt": "backup", "new.txt": "only in backup"}, false},
+		{"fail", ConflictFail, map[string]string{"a.txt": "existing"}, newer, planFail, map[string]string{"a.txt": "existing"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := t.TempDir()
+			writeTestFiles(t, restored, tt.existing)
+			if err := os.Chtimes(filepath.Join(restored, "a.txt"), tt.modTime, tt.modTime); err != nil { t.Fatal(err) }
+			settings := testSettings(dist, restored)
+			settings.OnConflict = tt.policy
+			settings.Workers = 1
+			
+			// DryRun は判断のみを通知し、復元先を変更しない
+			dryRunSettings := settings
+			dryRunSettings.DryRun = true
+			messages := runTestMode(Restore, dryRunSettings)
+			requireNoErrors(t, messages)
+			if got := planActions(messages); !got[tt.action] || (tt.action != planFail && !got[planCreate]) {
+				t.Errorf("dry run plans %v, want %s", got, tt.action)
+			}
+			requireTestFiles(t, restored, tt.existing)
+			if _, err := os.Stat(filepath.Join(restored, "new.txt")); !os.IsNotExist(err) {
+				t.Errorf("dry run restored new.txt: %v", err)
+			}
+			
+			messages = runTestMode(Restore, settings)
+			if got := conflictAction(messages, filepath.Join(restored, "a.txt")); got != tt.action {
+				t.Errorf("got conflict action %q, want %q", got, tt.action)
+			}
+			if tt.aborted {
+				if countErrors(messages, "Aborted restore on conflict") != 1 {
+					t.Error("restore was not aborted")
+				}
+			} else {
+				requireNoErrors(t, messages)
+			}
+			requireTestFiles(t, restored, tt.want)
+			items, err := os.ReadDir(restored)
+			if err != nil { t.Fatal(err) }
+			// 中止した場合、エントリの順によっては中止前に new.txt を復元している
+			if !tt.aborted && len(items) != len(tt.want) {
+				t.Errorf("got %d entries in the restore directory, want %d", len(items), len(tt.want))
+			}
+		})
+	}
+}
+
+// 通知された実行予定の操作の種類を返す。
+func planActions(messages []view.MessageToView) map[string]bool {
+	actions := make(map[string]bool)
+	for _, msg := range messages {
+		if msg.MsgType == view.PLAN {
+			actions[msg.Detail] = true
+		}
+	}
+	return actions
+}
+
+// realPath の既存ファイルとの競合で通知された判断を返す。
+func conflictAction(messages []view.MessageToView, realPath string) string {
+	for _, msg := range messages {
+		if msg.MsgType == view.CONFLICT && msg.SrcPath == realPath {
+			return msg.Detail
+		}
+	}
+	return ""
+}
@@ -0,0 +1,302 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	
+	"bakashier/data"
+	"bakashier/utils"
+	"bakashier/view"
+)
+
+
+// 差分の種類。
+const (
+	diffAdded       = "added"        // 実ディレクトリにのみ存在する
+	diffDeleted     = "deleted"      // バックアップにのみ存在する
+	diffModified    = "modified"     // 内容（またはサイズ・更新日時）が異なる
+	diffTypeChanged = "type-changed" // ファイルとディレクトリが入れ替わっている
+)
+
+// ワーカーキューからジョブを受け取り、_directory_.bks のエントリと実ディレクトリを比較する。
+// SrcDir はバックアップ先の隠しディレクトリ、DistDir は比較対象の実ディレクトリを表す。
+// ファイルはサイズと更新日時で比較し、DiffContent が有効な場合は復号した内容で比較する。バックアップには何も書き込まない。
+// シンボリックリンクはリンクとして比較し、リンク先が異なる場合は変更として報告する。ハードリンクは参照先のファイルのアーカイブと比較する。
+// 復元と同じく安全でない実名・隠し名のエントリは比較せずにエラーとして報告する。
+// バックアップと同じ除外ルール（.bakashierignore とコマンドラインのルール）で除外される実ファイルは追加として報告しない。
+func diffWorker(workerId uint, settings Settings, toManagerQueue chan<- messageFromWorkerToManager, fromManagerQueue <-chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var password = settings.Password
+	
+	// 除外ルールは比較対象の実ディレクトリをバックアップ元のルートとして読み込む
+	ignoreSettings := settings
+	ignoreSettings.SrcDir = settings.DistDir
+	
+	toViewQueue <- view.MessageToView{
+		Source:   view.WORKER,
+		MsgType:  view.ADD_WORKER,
+		WorkerId: workerId,
+		Detail:   "",
+	}
+	
+	for {
+		queue := <-fromManagerQueue
+		if queue.MsgType == EXIT { break }
+		
+		var errHandler = func(prefix string, err error) {
+			toManagerQueue <- messageFromWorkerToManager{
+				WorkerId: workerId,
+				MsgType:  ERROR,
+				SrcDir:   queue.SrcDir,
+				DistDir:  queue.DistDir,
+				Detail:   fmt.Sprintf("%s: %s", prefix, err.Error()),
+			}
+		}
+		
+		// 差分をビューに通知する（パスは比較対象ディレクトリからの相対パス）
+		var diffHandler = func(kind string, realPath string) {
+			relPath, err := filepath.Rel(settings.DistDir, realPath)
+			if err != nil {
+				relPath = realPath
+			}
+			toViewQueue <- view.MessageToView{
+				Source:   view.WORKER,
+				MsgType:  view.DIFF,
+				WorkerId: workerId,
+				DistPath: relPath,
+				Detail:   kind,
+			}
+		}
+		
+		// ディレクトリ処理開始をビューに通知
+		toViewQueue <- view.MessageToView{
+			Source:   view.WORKER,
+			MsgType:  view.START_DIR,
+			WorkerId: workerId,
+			SrcPath:  queue.SrcDir,
+			DistPath: queue.DistDir,
+			Detail:   "",
+		}
+		
+		func() {
+			// _directory_.bks からエントリ一覧を読み込む。
+			directoryEntryFile := directoryEntryFileAt(queue.SrcDir, settings.SnapshotID)
+			// 空のディレクトリには _directory_.bks が作成されないため、存在しない場合は空として扱う。
+			entries, err := readDirectoryEntries(directoryEntryFile, password)
+			if errors.Is(err, os.ErrNotExist) {
+				entries, err = []data.DirectoryEntry{}, nil
+			}
+			if err != nil {
+				errHandler("Failed to load directory entries", err)
+				return
+			}
+			
+			// 実ディレクトリの一覧を読み込む。
+			files, err := os.ReadDir(queue.DistDir)
+			if err != nil {
+				errHandler("Failed to read directory", err)
+				return
+			}
+			liveFiles := make(map[string]os.DirEntry)
+			for _, file := range files {
+				liveFiles[file.Name()] = file
+			}
+			dirIgnoreRules, ignoreRules, err := loadIgnoreRules(ignoreSettings, queue.IgnoreRules, queue.DistDir)
+			if err != nil {
+				errHandler("Failed to load ignore rules", err)
+				return
+			}
+			
+			// バックアップのエントリを実ディレクトリと比較する
+			known := make(map[string]bool)
+			for _, entry := range entries {
+				if !utils.IsSafeFileName(entry.HideName) {
+					errHandler("Rejected unsafe hide name", fmt.Errorf("%q", entry.HideName))
+					continue
+				}
+				if !utils.IsSafeFileName(entry.RealName) {
+					errHandler("Rejected unsafe name", fmt.Errorf("%q", entry.RealName))
+					continue
+				}
+				known[entry.RealName] = true
+				realPath := filepath.Join(queue.DistDir, entry.RealName)
+				file, ok := liveFiles[entry.RealName]
+				if !ok {
+					diffHandler(diffDeleted, realPath)
+					continue
+				}
+				
+				isLink := file.Type()&os.ModeSymlink != 0
+				switch entry.Type {
+				case data.Directory:
+					if !file.IsDir() {
+						diffHandler(diffTypeChanged, realPath)
+						continue
+					}
+					
+					// 子ディレクトリの発見をディスパッチャに通知
+					toManagerQueue <- messageFromWorkerToManager{
+						WorkerId:    workerId,
+						MsgType:     FIND_DIR,
+						SrcDir:      filepath.Join(queue.SrcDir, entry.HideName),
+						DistDir:     realPath,
+						Detail:      "",
+						IgnoreRules: dirIgnoreRules,
+					}
+				case data.Symlink:
+					if !isLink {
+						diffHandler(diffTypeChanged, realPath)
+						continue
+					}
+					linkTarget, err := os.Readlink(realPath)
+					if err != nil {
+						errHandler("Failed to read symlink", err)
+						continue
+					}
+					if linkTarget != entry.LinkTarget {
+						diffHandler(diffModified, realPath)
+					}
+				case data.File, data.Hardlink:
+					if file.IsDir() || isLink {
+						diffHandler(diffTypeChanged, realPath)
+						continue
+					}
+					dir, target := queue.SrcDir, entry
+					if entry.Type == data.Hardlink {
+						dir, target, err = resolveHardlinkEntry(settings, entry.LinkTarget)
+						if err != nil {
+							errHandler("Failed to resolve hard link", err)
+							continue
+						}
+					}
+					archiveFile := entryContentPath(settings, dir, target)
+					
+					// ファイル処理開始をビューに通知
+					toViewQueue <- view.MessageToView{
+						Source:   view.WORKER,
+						MsgType:  view.START_FILE,
+						WorkerId: workerId,
+						SrcPath:  archiveFile,
+						DistPath: realPath,
+						Detail:   "",
+					}
+					
+					func() {
+						if settings.DiffContent {
+							equal, err := compareEntryContent(settings, dir, target, realPath)
+							if err != nil {
+								errHandler("Failed to compare file contents", err)
+								return
+							}
+							if !equal {
+								diffHandler(diffModified, realPath)
+							}
+							return
+						}
+						
+						fileInfo, err := file.Info()
+						if err != nil {
+							errHandler("Failed to get file info", err)
+							return
+						}
+						if entry.Size != uint64(fileInfo.Size()) || !entry.ModTime.Equal(fileInfo.ModTime()) {
+							diffHandler(diffModified, realPath)
+						}
+					}()
+					
+					// ファイル処理完了をビューに通知
+					toViewQueue <- view.MessageToView{
+						Source:   view.WORKER,
+						MsgType:  view.FINISH_FILE,
+						WorkerId: workerId,
+						SrcPath:  archiveFile,
+						DistPath: realPath,
+						Detail:   "",
+					}
+				default:
+					errHandler("Unknown entry type", fmt.Errorf("%v", entry.Type))
+				}
+			}
+			
+			// バックアップに存在しないエントリを追加として報告する。除外されるエントリはバックアップされないため報告しない
+			for _, file := range files {
+				if known[file.Name()] { continue }
+				if isIgnored(ignoreSettings, ignoreRules, queue.DistDir, file.Name(), file.IsDir()) { continue }
+				diffHandler(diffAdded, filepath.Join(queue.DistDir, file.Name()))
+			}
+		}()
+		
+		// ディレクトリ処理完了をビューに通知
+		toViewQueue <- view.MessageToView{
+			Source:   view.WORKER,
+			MsgType:  view.FINISH_DIR,
+			WorkerId: workerId,
+			SrcPath:  queue.SrcDir,
+			DistPath: queue.DistDir,
+			Detail:   "",
+		}
+		
+		// ディレクトリ処理完了をディスパッチャに通知
+		toManagerQueue <- messageFromWorkerToManager{
+			WorkerId: workerId,
+			MsgType:  FINISH_JOB,
+			SrcDir:   queue.SrcDir,
+			DistDir:  queue.DistDir,
+			Detail:   "",
+		}
+	}
+}
+
+// settings.SrcDir（バックアップ先）と settings.DistDir（実ディレクトリ）を比較し、差分を報告する。
+// 走査は復元と同じであるため restoreManager を使用し、複数のワーカーでジョブを分配する。
+func Diff(settings Settings, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager) {
+	var wg sync.WaitGroup
+	
+	// 対象のスナップショットを決定する
+	snapshot, err := resolveSnapshot(settings)
+	if err != nil {
+		sendFatalError(toViewQueue, "Failed to resolve snapshot", err)
+		return
+	}
+	settings.SnapshotID = snapshot
+	
+	// チャンクストアに格納されたファイルを読むため、チャンクストアがあれば開く
+	settings.chunkStore, err = openChunkStore(settings, settings.SrcDir, false)
+	if err != nil {
+		sendFatalError(toViewQueue, "Failed to open chunk store", err)
+		return
+	}
+	
+	// パックアーカイブの鍵は、この実行の間だけ保持する
+	settings.packReader = data.NewPackReader(settings.Password)
+	
+	workers := settings.Workers
+	queueSize := workers * 8
+	if workers <= 0 {
+		workers = 1
+		queueSize = 8
+	}
+	
+	workerToManagerQueue := make(chan messageFromWorkerToManager, queueSize)
+	managerToWorkerQueue := make(chan messageFromManagerToWorker, queueSize)
+	
+	workerToManagerQueue <- messageFromWorkerToManager{
+		MsgType: FIND_DIR,
+		SrcDir:  settings.SrcDir,
+		DistDir: settings.DistDir,
+		Detail:  "",
+	}
+	
+	wg.Add(int(workers) + 1)
+	go restoreManager(workers, workerToManagerQueue, managerToWorkerQueue, toViewQueue, fromViewQueue, nil, &wg)
+	for i := uint(0); i < uint(workers); i++ {
+		go diffWorker(i+1, settings, workerToManagerQueue, managerToWorkerQueue, toViewQueue, &wg)
+	}
+	wg.Wait()
+	
+	close(workerToManagerQueue)
+	close(managerToWorkerQueue)
+}
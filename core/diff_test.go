@@ -0,0 +1,80 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+	
+	"bakashier/data"
+	"bakashier/view"
+)
+
+
+// 差分の一覧を、比較対象ディレクトリからの相対パスをキーにして返す。
+func diffResults(messages []view.MessageToView) map[string]string {
+	diffs := make(map[string]string)
+	for _, msg := range messages {
+		if msg.MsgType == view.DIFF {
+			diffs[filepath.ToSlash(msg.DistPath)] = msg.Detail
+		}
+	}
+	return diffs
+}
+
+// .bakashierignore とコマンドラインのルールで除外されるエントリを、追加として報告しないことを確認する。
+func TestDiffSkipsIgnoredEntries(t *testing.T) {
+	src, dist := t.TempDir(), t.TempDir()
+	writeTestFiles(t, src, map[string]string{"a.txt": "alpha", ".bakashierignore": "*.log\n", "sub/b.txt": "bravo"})
+	requireNoErrors(t, runTestMode(Backup, testSettings(src, dist)))
+	writeTestFiles(t, src, map[string]string{"new.txt": "new", "debug.log": "log", "sub/trace.log": "log", "build/out.bin": "out", "sub/new.txt": "new"})
+	
+	settings := testSettings(dist, src)
+	settings.Filters = []string{"build/"}
+	messages := runTestMode(Diff, settings)
+	requireNoErrors(t, messages)
+	want := map[string]string{"new.txt": diffAdded, "sub/new.txt": diffAdded}
+	got := diffResults(messages)
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for path, kind := range want {
+		if got[path] != kind {
+			t.Errorf("%s: got %q, want %q", path, got[path], kind)
+		}
+	}
+}
+
+// 改ざんされた _directory_.bks の安全でない実名・隠し名のエントリを、比較せずにエラーとして報告することを確認する。
+func TestDiffRejectsUnsafeNames(t *testing.T) {
+	src, dist, outside := t.TempDir(), t.TempDir(), t.TempDir()
+	writeTestFiles(t, src, map[string]string{"a.txt": "alpha", "sub/b.txt": "bravo"})
+	settings := testSettings(src, dist)
+	requireNoErrors(t, runTestMode(Backup, settings))
+	
+	entries, err := loadDirectoryEntries(filepath.Join(dist, "_directory_.bks"), settings.Password)
+	if err != nil { t.Fatal(err) }
+	var crafted []data.DirectoryEntry
+	for _, e := range entries {
+		crafted = append(crafted, e)
+		switch e.RealName {
+		case "a.txt":
+			e.RealName = "../x"
+			crafted = append(crafted, e)
+		case "sub":
+			e.RealName = "other"
+			e.HideName = "../" + filepath.Base(outside)
+			crafted = append(crafted, e)
+		}
+	}
+	writeTestDirectoryEntries(t, dist, settings, crafted)
+	
+	messages := runTestMode(Diff, testSettings(dist, src))
+	if got := countErrors(messages, "Rejected unsafe name"); got != 1 {
+		t.Errorf("got %d unsafe name errors, want 1", got)
+	}
+	if got := countErrors(messages, "Rejected unsafe hide name"); got != 1 {
+		t.Errorf("got %d unsafe hide name errors, want 1", got)
+	}
+	if got := diffResults(messages); len(got) != 0 {
+		t.Errorf("got differences %v, want none", got)
+	}
+}
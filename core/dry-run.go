@@ -0,0 +1,33 @@
+package core
+
+import (
+	"bakashier/view"
+)
+
+
+// DryRun・整理・復元先の競合で報告する操作の種類。
+const (
+	planWrite     = "write"     // アーカイブを書き出す
+	planSkip      = "skip"      // 変更がないためスキップする
+	planUpdate    = "update"    // 内容は変更せず、権限・所有者のみを更新する
+	planDelete    = "delete"    // バックアップ先から削除する
+	planRemove    = "remove"    // 新しいスナップショットから外す（アーカイブは残す）
+	planForget    = "forget"    // スナップショットを一覧から外す
+	planExclude   = "exclude"   // 除外ルールによりバックアップしない
+	planCreate    = "create"    // 復元先にファイルを作成する
+	planOverwrite = "overwrite" // 復元先の既存ファイルを上書きする
+	planRename    = "rename"    // 復元先の既存ファイルを残し、別名で復元する
+	planFail      = "fail"      // 復元先に既存ファイルがあるため復元を中止する
+)
+
+// DryRun 時に実行予定の操作をビューに通知する。srcPath は読み込み元、distPath は書き込み・削除の対象を表す。
+func sendPlan(toViewQueue chan<- view.MessageToView, workerId uint, action string, srcPath string, distPath string) {
+	toViewQueue <- view.MessageToView{
+		Source:   view.WORKER,
+		MsgType:  view.PLAN,
+		WorkerId: workerId,
+		SrcPath:  srcPath,
+		DistPath: distPath,
+		Detail:   action,
+	}
+}
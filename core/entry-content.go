@@ -0,0 +1,103 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	
+	"bakashier/data"
+	"bakashier/utils"
+)
+
+
+// dir にあるファイルのエントリの内容の格納先を返す。
+// チャンクストアに格納している場合はチャンクストアのディレクトリ、パックアーカイブに格納している場合はパックアーカイブを返す。
+func entryContentPath(settings Settings, dir string, entry data.DirectoryEntry) string {
+	if entry.Chunked {
+		return filepath.Join(settings.SrcDir, data.ChunkStoreDirName)
+	}
+	return filepath.Join(dir, entryArchiveName(entry))
+}
+
+// ファイルのエントリの内容を格納する、ディレクトリ内の .bks のファイル名を返す。チャンクストアに格納している場合は空を返す。
+func entryArchiveName(entry data.DirectoryEntry) string {
+	switch {
+	case entry.Chunked:
+		return ""
+	case entry.PackName != "":
+		return fmt.Sprintf("%s.bks", entry.PackName)
+	default:
+		return fmt.Sprintf("%s.bks", entry.HideName)
+	}
+}
+
+// パックアーカイブの隠し名がバックアップ先のディレクトリの外を指していないかを確認する。
+func checkPackName(entry data.DirectoryEntry) error {
+	if entry.PackName != "" && !utils.IsSafeFileName(entry.PackName) {
+		return fmt.Errorf("unsafe pack name %q", entry.PackName)
+	}
+	return nil
+}
+
+// 実行の開始時に作成したパックアーカイブの読み込みを返す。作成されていない場合は、鍵を保持しない使い捨てのものを返す。
+func packReader(settings Settings) *data.PackReader {
+	if settings.packReader != nil {
+		return settings.packReader
+	}
+	return data.NewPackReader(settings.Password)
+}
+
+// dir にあるファイルのエントリの内容を、アーカイブ・パックアーカイブまたはチャンクストアから target に復元する。
+func importEntryContent(settings Settings, dir string, entry data.DirectoryEntry, target string) error {
+	switch {
+	case entry.Chunked:
+		if settings.chunkStore == nil { return errChunkStoreMissing }
+		return settings.chunkStore.ImportFile(entry.Chunks, target)
+	case entry.PackName != "":
+		if err := checkPackName(entry); err != nil { return err }
+		return packReader(settings).ImportFile(entryContentPath(settings, dir, entry), entry.PackName, entry.HideName, entry.PackOffset, entry.PackLength, target)
+	default:
+		return data.ImportStreamArchive(entryContentPath(settings, dir, entry), entry.HideName, target, settings.Password)
+	}
+}
+
+// dir にあるファイルのエントリの内容を、アーカイブ・パックアーカイブまたはチャンクストアから読み込んで検証する。
+func verifyEntryContent(settings Settings, dir string, entry data.DirectoryEntry) error {
+	if entry.Chunked {
+		if settings.chunkStore == nil { return errChunkStoreMissing }
+		return settings.chunkStore.VerifyFile(entry.Chunks)
+	}
+	if err := checkPackName(entry); err != nil { return err }
+	archiveFile := entryContentPath(settings, dir, entry)
+	if _, err := os.Stat(archiveFile); err != nil {
+		return fmt.Errorf("archive is missing")
+	}
+	if entry.PackName != "" {
+		return packReader(settings).VerifyFile(archiveFile, entry.PackName, entry.HideName, entry.PackOffset, entry.PackLength)
+	}
+	return data.VerifyStreamArchive(archiveFile, entry.HideName, settings.Password)
+}
+
+// dir にあるファイルのエントリの内容が liveFile の内容と一致するかを比較する。
+func compareEntryContent(settings Settings, dir string, entry data.DirectoryEntry, liveFile string) (bool, error) {
+	switch {
+	case entry.Chunked:
+		if settings.chunkStore == nil { return false, errChunkStoreMissing }
+		return settings.chunkStore.CompareFile(entry.Chunks, liveFile)
+	case entry.PackName != "":
+		if err := checkPackName(entry); err != nil { return false, err }
+		return packReader(settings).CompareFile(entryContentPath(settings, dir, entry), entry.PackName, entry.HideName, entry.PackOffset, entry.PackLength, liveFile)
+	default:
+		return data.CompareStreamArchive(entryContentPath(settings, dir, entry), entry.HideName, settings.Password, liveFile)
+	}
+}
+
+// dir にあるファイルのエントリの内容の格納先が存在するかを判定する。チャンクの内容は確認しない。
+func entryContentExists(settings Settings, dir string, entry data.DirectoryEntry) bool {
+	if entry.Chunked {
+		return settings.chunkStore != nil
+	}
+	if checkPackName(entry) != nil { return false }
+	_, err := os.Stat(entryContentPath(settings, dir, entry))
+	return err == nil
+}
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	
+	"bakashier/data"
+	"bakashier/utils"
+)
+
+
+// ハードリンクを識別するデバイス番号と inode 番号。
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// バックアップ中に見つけた、複数のハードリンクを持つファイルの一覧。
+// ディレクトリをまたいで共有されるため、全ワーカーで1つを使用する。
+// 内容を格納するファイル（参照先）はワーカーの処理順によらず、同じ inode のリンクのうち辞書順で最小の相対パスとする。
+// そのため最初に複数のハードリンクを持つファイルを見つけたときに scan でバックアップ元全体を走査する。ハードリンクがなければ走査しない。
+type hardlinkTable struct {
+	mu    sync.Mutex
+	scan  func() map[inodeKey]string
+	once  sync.Once
+	items map[inodeKey]string // [inodeKey]参照先のファイルのバックアップ元のルートからの相対パス
+}
+
+func newHardlinkTable(settings Settings) *hardlinkTable {
+	return &hardlinkTable{scan: func() map[inodeKey]string { return scanHardlinks(settings) }}
+}
+
+// info が複数のハードリンクを持つ場合に、その inode を識別するキーを返す。
+func hardlinkKey(info os.FileInfo) (inodeKey, bool) {
+	dev, ino, nlink, ok := utils.FileInode(info)
+	if !ok || nlink < 2 {
+		return inodeKey{}, false
+	}
+	return inodeKey{dev: dev, ino: ino}, true
+}
+
+// info の inode の参照先のファイルの相対パスを返す。
+// 走査後に作成されたリンクなど、走査で見つからなかった inode は relPath を参照先として記録する。
+// 複数のハードリンクを持たないファイルは記録せず、relPath をそのまま返す。
+func (t *hardlinkTable) claim(info os.FileInfo, relPath string) string {
+	key, ok := hardlinkKey(info)
+	if !ok { return relPath }
+	t.once.Do(func() {
+		if t.scan != nil {
+			t.items = t.scan()
+		}
+	})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.items == nil {
+		t.items = make(map[inodeKey]string)
+	}
+	if primary, ok := t.items[key]; ok {
+		return primary
+	}
+	t.items[key] = relPath
+	return relPath
+}
+
+// 参照先 relPath の内容を書き出せなかった場合に、info の inode の参照先を取り消す。
+// この後に同じ inode を見つけたワーカーは、そのファイルを参照先として内容を書き出す。
+func (t *hardlinkTable) release(info os.FileInfo, relPath string) {
+	key, ok := hardlinkKey(info)
+	if !ok { return }
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.items[key] == relPath {
+		delete(t.items, key)
+	}
+}
+
+// settings.SrcDir 以下の複数のハードリンクを持つファイルを探し、inode ごとに辞書順で最小の相対パスを返す。
+// バックアップと同じく除外ルールを適用し、FollowSymlinks が有効な場合はシンボリックリンクを辿る。
+// 読み込めないディレクトリは読み飛ばす（バックアップ自体がエラーとして報告する）。
+func scanHardlinks(settings Settings) map[inodeKey]string {
+	primaries := make(map[inodeKey]string)
+	var walk func(dir string, inherited []utils.IgnoreRule)
+	walk = func(dir string, inherited []utils.IgnoreRule) {
+		files, err := os.ReadDir(dir)
+		if err != nil { return }
+		dirRules, rules, err := loadIgnoreRules(settings, inherited, dir)
+		if err != nil { return }
+		for _, file := range files {
+			fileInfo, err := file.Info()
+			if err != nil { continue }
+			if settings.FollowSymlinks && fileInfo.Mode()&os.ModeSymlink != 0 {
+				if followed, err := followSymlink(settings, dir, file.Name()); err == nil {
+					fileInfo = followed
+				}
+			}
+			entryType := backupEntryType(fileInfo)
+			if isIgnored(settings, rules, dir, file.Name(), entryType == data.Directory) { continue }
+			switch entryType {
+			case data.Directory:
+				walk(filepath.Join(dir, file.Name()), dirRules)
+			case data.File:
+				key, ok := hardlinkKey(fileInfo)
+				if !ok { continue }
+				relPath := linkRelPath(settings.SrcDir, filepath.Join(dir, file.Name()))
+				if primary, ok := primaries[key]; !ok || relPath < primary {
+					primaries[key] = relPath
+				}
+			}
+		}
+	}
+	walk(settings.SrcDir, nil)
+	return primaries
+}
+
+// path の root からの相対パスを、ハードリンクのエントリに記録する形式で返す。
+func linkRelPath(root string, path string) string {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// ハードリンクの参照先 linkTarget のファイルのエントリを、settings.SrcDir（バックアップ先）のスナップショットから探し、エントリのあるディレクトリとエントリを返す。
+func resolveHardlinkEntry(settings Settings, linkTarget string) (dir string, target data.DirectoryEntry, err error) {
+	relPath := filepath.FromSlash(linkTarget)
+	if !filepath.IsLocal(relPath) {
+		return "", data.DirectoryEntry{}, fmt.Errorf("invalid hard link target %q", linkTarget)
+	}
+	dir = settings.SrcDir
+	names := strings.Split(relPath, string(os.PathSeparator))
+	for i, name := range names {
+		entries, err := readDirectoryEntries(directoryEntryFileAt(dir, settings.SnapshotID), settings.Password)
+		if err != nil { return "", data.DirectoryEntry{}, err }
+		found := false
+		for _, entry := range entries {
+			if entry.RealName != name || !utils.IsSafeFileName(entry.HideName) { continue }
+			if i < len(names)-1 && entry.Type == data.Directory {
+				dir = filepath.Join(dir, entry.HideName)
+				found = true
+				break
+			}
+			if i == len(names)-1 && entry.Type == data.File {
+				return dir, entry, nil
+			}
+		}
+		if !found { break }
+	}
+	return "", data.DirectoryEntry{}, fmt.Errorf("hard link target %q is not in the backup", linkTarget)
+}
+
+// 復元を保留しているハードリンク。
+type pendingHardlink struct {
+	target string
+	entry  data.DirectoryEntry
+}
+
+// 復元中のハードリンクの一覧。
+// 参照先のファイルは別のワーカーが復元するため、リンクは全ワーカーの完了後に作成する。
+type pendingHardlinks struct {
+	mu       sync.Mutex
+	restored map[string]string // [バックアップのルートからの相対パス]復元先のパス
+	items    []pendingHardlink
+}
+
+// relPath のファイルを target に復元したことを記録する。
+func (p *pendingHardlinks) restoredAs(relPath string, target string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.restored == nil {
+		p.restored = make(map[string]string)
+	}
+	p.restored[relPath] = target
+}
+
+func (p *pendingHardlinks) add(target string, entry data.DirectoryEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items = append(p.items, pendingHardlink{target: target, entry: entry})
+}
+
+// 保留しているハードリンクを、復元済みの参照先へのリンクとして作成し、失敗したリンクごとに errHandler を呼ぶ。
+// 参照先が Paths や競合の扱いで復元されていない場合や、リンクを作成できない場合は参照先のアーカイブまたはチャンクから個別に復元する。
+func (p *pendingHardlinks) apply(settings Settings, options attributeOptions, errHandler func(err error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.restored == nil {
+		p.restored = make(map[string]string)
+	}
+	for _, item := range p.items {
+		if err := os.Remove(item.target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errHandler(err)
+			continue
+		}
+		if err := checkRestoreTarget(settings, item.target); err != nil {
+			errHandler(err)
+			continue
+		}
+		if source, ok := p.restored[item.entry.LinkTarget]; ok {
+			if err := os.Link(source, item.target); err == nil { continue }
+		}
+		dir, target, err := resolveHardlinkEntry(settings, item.entry.LinkTarget)
+		if err != nil {
+			errHandler(err)
+			continue
+		}
+		if err := importEntryContent(settings, dir, target, item.target); err != nil {
+			errHandler(err)
+			continue
+		}
+		
+		// 同じファイルを参照する残りのリンクは、このファイルへのリンクとして作成する
+		if _, ok := p.restored[item.entry.LinkTarget]; !ok {
+			p.restored[item.entry.LinkTarget] = item.target
+		}
+		if err := applyEntryAttributes(item.target, item.entry, options); err != nil {
+			errHandler(err)
+		}
+	}
+}
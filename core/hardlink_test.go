@@ -0,0 +1,101 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	
+	"bakashier/data"
+)
+
+
+// src に同じ inode のファイルを3つのディレクトリに作成し、辞書順で最小の相対パスを返す。
+// ハードリンクを作成できない環境ではテストをスキップする。
+func writeTestHardlinks(t *testing.T, src string) (paths []string, primary string) {
+	t.Helper()
+	paths = []string{"z/a", "b/x", "a/y"}
+	writeTestFiles(t, src, map[string]string{paths[0]: "shared content", "b/other": "other", "a/zz": "other"})
+	for _, path := range paths[1:] {
+		if err := os.Link(filepath.Join(src, paths[0]), filepath.Join(src, filepath.FromSlash(path))); err != nil {
+			t.Skipf("hard links are not supported: %v", err)
+		}
+	}
+	return paths, "a/y"
+}
+
+// バックアップ先の dir 以下のエントリを、バックアップのルートからの相対パスをキーにして返す。
+func collectTestEntries(t *testing.T, dir string, password string, prefix string, entries map[string]data.DirectoryEntry) {
+	t.Helper()
+	items, err := loadDirectoryEntries(filepath.Join(dir, "_directory_.bks"), password)
+	if err != nil { t.Fatal(err) }
+	for _, entry := range items {
+		relPath := prefix + entry.RealName
+		entries[relPath] = entry
+		if entry.Type == data.Directory {
+			collectTestEntries(t, filepath.Join(dir, entry.HideName), password, relPath+"/", entries)
+		}
+	}
+}
+
+// ワーカーの処理順によらず、辞書順で最小の相対パスのファイルが内容を持ち、他のリンクがそれを参照することを確認する。
+// 復元したファイルが同じ inode を共有することも確認する。
+func TestHardlinkPrimaryIsDeterministic(t *testing.T) {
+	src := t.TempDir()
+	paths, primary := writeTestHardlinks(t, src)
+	
+	for i := 0; i < 5; i++ {
+		dist, restored := t.TempDir(), t.TempDir()
+		settings := testSettings(src, dist)
+		settings.Workers = 4
+		requireNoErrors(t, runTestMode(Backup, settings))
+		
+		entries := make(map[string]data.DirectoryEntry)
+		collectTestEntries(t, dist, settings.Password, "", entries)
+		for _, path := range paths {
+			entry := entries[path]
+			if path == primary {
+				if entry.Type != data.File {
+					t.Errorf("run %d: %s has type %v, want a file", i, path, entry.Type)
+				}
+			} else if entry.Type != data.Hardlink || entry.LinkTarget != primary {
+				t.Errorf("run %d: %s has type %v and target %q, want a hard link to %s", i, path, entry.Type, entry.LinkTarget, primary)
+			}
+		}
+		
+		requireNoErrors(t, runTestMode(Restore, testSettings(dist, restored)))
+		requireTestFiles(t, restored, map[string]string{"z/a": "shared content", "b/x": "shared content", "a/y": "shared content"})
+		primaryInfo, err := os.Lstat(filepath.Join(restored, primary))
+		if err != nil { t.Fatal(err) }
+		for _, path := range paths {
+			info, err := os.Lstat(filepath.Join(restored, filepath.FromSlash(path)))
+			if err != nil { t.Fatal(err) }
+			if !os.SameFile(primaryInfo, info) {
+				t.Errorf("run %d: restored %s does not share the inode of %s", i, path, primary)
+			}
+		}
+	}
+}
+
+// 参照先の内容を書き出せなかった場合に、後続のリンクが参照先を引き継ぐことを確認する。
+func TestHardlinkTableRelease(t *testing.T) {
+	src := t.TempDir()
+	_, primary := writeTestHardlinks(t, src)
+	table := newHardlinkTable(testSettings(src, t.TempDir()))
+	info, err := os.Lstat(filepath.Join(src, "b", "x"))
+	if err != nil { t.Fatal(err) }
+	
+	if got := table.claim(info, "b/x"); got != primary {
+		t.Errorf("claim returned %q, want %q", got, primary)
+	}
+	table.release(info, "b/x")
+	if got := table.claim(info, "z/a"); got != primary {
+		t.Errorf("release by a link changed the primary to %q", got)
+	}
+	table.release(info, primary)
+	if got := table.claim(info, "z/a"); got != "z/a" {
+		t.Errorf("claim after release returned %q, want z/a", got)
+	}
+	if got := table.claim(info, "b/x"); got != "z/a" {
+		t.Errorf("claim returned %q, want the new primary z/a", got)
+	}
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	
+	"bakashier/data"
+	"bakashier/utils"
+	"bakashier/view"
+)
+
+
+// src から dist にバックアップするテスト用の設定を返す。鍵の導出に時間をかけないよう、反復回数を最小にする。
+func testSettings(src string, dist string) Settings {
+	return Settings{
+		SrcDir:    src,
+		DistDir:   dist,
+		Password:  "correct horse battery staple",
+		Workers:   2,
+		ChunkSize: 64 * 1024,
+		KDF:       utils.KDFParams{Type: utils.KDFPBKDF2SHA256, Time: 1},
+	}
+}
+
+// Backup・Restore などを実行し、完了までにビューに送られたメッセージを返す。
+func runTestMode(run func(Settings, chan<- view.MessageToView, <-chan view.MessageToManager), settings Settings) []view.MessageToView {
+	toViewQueue := make(chan view.MessageToView, 64)
+	fromViewQueue := make(chan view.MessageToManager)
+	done := make(chan struct{})
+	go func() {
+		run(settings, toViewQueue, fromViewQueue)
+		close(done)
+	}()
+	
+	var messages []view.MessageToView
+	for {
+		select {
+		case msg := <-toViewQueue:
+			messages = append(messages, msg)
+		case <-done:
+			for {
+				select {
+				case msg := <-toViewQueue:
+					messages = append(messages, msg)
+				default:
+					return messages
+				}
+			}
+		}
+	}
+}
+
+// ERROR のメッセージがあればテストを失敗させる。
+func requireNoErrors(t *testing.T, messages []view.MessageToView) {
+	t.Helper()
+	for _, msg := range messages {
+		if msg.MsgType == view.ERROR {
+			t.Errorf("%s: %s", msg.SrcPath, msg.Detail)
+		}
+	}
+}
+
+// ERROR のメッセージの詳細のうち、prefix で始まるものの数を返す。
+func countErrors(messages []view.MessageToView, prefix string) int {
+	count := 0
+	for _, msg := range messages {
+		if msg.MsgType == view.ERROR && strings.HasPrefix(msg.Detail, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// バックアップ先のディレクトリ dir の _directory_.bks を entries で書き換える。改ざんされた一覧の扱いの確認に使う。
+func writeTestDirectoryEntries(t *testing.T, dir string, settings Settings, entries []data.DirectoryEntry) {
+	t.Helper()
+	content, err := data.ExportDirectoryEntries(entries)
+	if err != nil { t.Fatal(err) }
+	archive, err := data.ToArchiveData(dir, directoryEntryHideName, content, settings.Password, settings.KDF)
+	if err != nil { t.Fatal(err) }
+	if err := archive.Export(filepath.Join(dir, "_directory_.bks")); err != nil { t.Fatal(err) }
+}
+
+// dir に name の各ファイルを content の内容で作成する。
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil { t.Fatal(err) }
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil { t.Fatal(err) }
+	}
+}
+
+// dir の各ファイルの内容が files と一致することを確認する。
+func requireTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	
+	"bakashier/utils"
+)
+
+
+// バックアップ元の各ディレクトリに置く除外ルールのファイル名。
+const ignoreFileName = ".bakashierignore"
+
+// dir の各エントリに適用する除外ルールを読み込む。
+// inherited は親ディレクトリまでの .bakashierignore のルールで、祖先のファイルを読み直さないよう FIND_DIR で子ディレクトリに引き継ぐ。
+// inherited の後に dir の .bakashierignore を加えたものを dirRules として返し、さらにコマンドラインのルールを加えたものを rules として返す。
+// 後のルールほど優先されるため、深いディレクトリの .bakashierignore とコマンドラインのルールが優先される。
+func loadIgnoreRules(settings Settings, inherited []utils.IgnoreRule, dir string) (dirRules []utils.IgnoreRule, rules []utils.IgnoreRule, err error) {
+	rel, err := filepath.Rel(settings.SrcDir, dir)
+	if err != nil { return nil, nil, err }
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		rel = ""
+	}
+	
+	// 他のディレクトリと共有する inherited を書き換えないよう、追加する場合は複製する
+	dirRules = inherited[:len(inherited):len(inherited)]
+	content, err := os.ReadFile(filepath.Join(dir, ignoreFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) { return nil, nil, err }
+	if err == nil {
+		dirRules = append(dirRules, utils.ParseIgnoreRules(rel, strings.Split(string(content), "\n"))...)
+	}
+	rules = append(dirRules[:len(dirRules):len(dirRules)], utils.ParseIgnoreRules("", settings.Filters)...)
+	return dirRules, rules, nil
+}
+
+// dir 内の name がバックアップから除外されるかを判定する。
+func isIgnored(settings Settings, rules []utils.IgnoreRule, dir string, name string, isDir bool) bool {
+	rel, err := filepath.Rel(settings.SrcDir, filepath.Join(dir, name))
+	if err != nil { return false }
+	return utils.MatchIgnoreRules(rules, filepath.ToSlash(rel), isDir)
+}
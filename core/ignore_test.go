@@ -0,0 +1,62 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+// 親ディレクトリのルールを引き継いで子ディレクトリのルールを読み込み、祖先の .bakashierignore を読み直さないことを確認する。
+// 兄弟のディレクトリで引き継いだルールを共有しても、互いのルールが混ざらないことも確認する。
+func TestLoadIgnoreRulesInheritsParentRules(t *testing.T) {
+	src := t.TempDir()
+	writeTestFiles(t, src, map[string]string{
+		".bakashierignore":   "*.log\n",
+		"a/.bakashierignore": "*.tmp\n",
+		"b/.bakashierignore": "!keep.log\n*.bak\n",
+	})
+	settings := testSettings(src, t.TempDir())
+	settings.Filters = []string{"*.cli"}
+	
+	rootRules, rules, err := loadIgnoreRules(settings, nil, src)
+	if err != nil { t.Fatal(err) }
+	if !isIgnored(settings, rules, src, "x.log", false) || !isIgnored(settings, rules, src, "x.cli", false) {
+		t.Fatal("root rules do not exclude x.log and x.cli")
+	}
+	
+	// 引き継いだ後に祖先の .bakashierignore を変更しても、子ディレクトリのルールには反映されない
+	if err := os.WriteFile(filepath.Join(src, ".bakashierignore"), []byte("*.txt\n"), 0644); err != nil { t.Fatal(err) }
+	aDir, bDir := filepath.Join(src, "a"), filepath.Join(src, "b")
+	_, aRules, err := loadIgnoreRules(settings, rootRules, aDir)
+	if err != nil { t.Fatal(err) }
+	_, bRules, err := loadIgnoreRules(settings, rootRules, bDir)
+	if err != nil { t.Fatal(err) }
+	
+	tests := []struct {
+		dir   string
+		name  string
+		want  bool
+	}{
+		{"a", "x.log", true},
+		{"a", "x.tmp", true},
+		{"a", "x.txt", false},
+		{"a", "x.bak", false},
+		{"a", "keep.log", true},
+		{"a", "x.cli", true},
+		{"b", "x.log", true},
+		{"b", "keep.log", false},
+		{"b", "x.bak", true},
+		{"b", "x.tmp", false},
+		{"b", "x.cli", true},
+	}
+	for _, tt := range tests {
+		dir, rules := aDir, aRules
+		if tt.dir == "b" {
+			dir, rules = bDir, bRules
+		}
+		if got := isIgnored(settings, rules, dir, tt.name, false); got != tt.want {
+			t.Errorf("%s/%s: got %v, want %v", tt.dir, tt.name, got, tt.want)
+		}
+	}
+}
@@ -7,20 +7,28 @@ import (
 )
 
 
+// _directory_.bks の関連データとして認証する名前。
+const directoryEntryHideName = "_directory_"
+
 // _directory_.bks からエントリ一覧を読み込む。ファイルが存在しない場合は空スライスを返す。復号に password を使用する。
 func loadDirectoryEntries(directoryEntryFile string, password string) ([]data.DirectoryEntry, error) {
-	var entryFile data.ArchiveData
 	if _, err := os.Stat(directoryEntryFile); err == nil {
-		err = entryFile.Import(directoryEntryFile)
+		entries, err := readDirectoryEntries(directoryEntryFile, password)
 		if err == data.ImportArchiveTooShort { return []data.DirectoryEntry{}, nil }
 		if err == data.ImportArchiveNotValid { return []data.DirectoryEntry{}, nil }
 		if err == data.ImportArchiveUnsupportedVersion { return []data.DirectoryEntry{}, nil }
 		if err != nil { return []data.DirectoryEntry{}, err }
-		_, content, err := data.FromArchiveData(entryFile, password)
-		if err != nil { return []data.DirectoryEntry{}, err }
-		entries, err := data.ImportDirectoryEntries(content)
-		if err != nil { return []data.DirectoryEntry{}, err }
 		return entries, nil
 	}
 	return []data.DirectoryEntry{}, nil
-}
\ No newline at end of file
+}
+
+// _directory_.bks からエントリ一覧を読み込む。loadDirectoryEntries と異なり、ファイルが存在しない場合や壊れている場合もエラーを返す。
+func readDirectoryEntries(directoryEntryFile string, password string) ([]data.DirectoryEntry, error) {
+	var entryFile data.ArchiveData
+	err := entryFile.Import(directoryEntryFile)
+	if err != nil { return nil, err }
+	_, content, err := data.FromArchiveData(entryFile, directoryEntryHideName, password)
+	if err != nil { return nil, err }
+	return data.ImportDirectoryEntries(content)
+}
@@ -1,5 +1,11 @@
 package core
 
+import (
+	"fmt"
+	
+	"bakashier/utils"
+	"bakashier/view"
+)
 
 // ディスパッチャが扱うメッセージの種類。
 type workerToManagerMessageType string
@@ -8,6 +14,7 @@ const (
 	FIND_DIR   workerToManagerMessageType = "FIND_DIR"   // 処理対象ディレクトリの通知
 	FINISH_JOB workerToManagerMessageType = "FINISH_JOB" // ジョブ完了通知
 	ERROR      workerToManagerMessageType = "ERROR"      // エラー報告
+	ABORT      workerToManagerMessageType = "ABORT"      // 処理全体の中止要求（Detail に理由）
 )
 
 // ワーカーが受け取るメッセージの種類。
@@ -20,17 +27,35 @@ const (
 
 // ディスパッチャに渡すメッセージ。
 type messageFromWorkerToManager struct {
-	WorkerId uint
-	MsgType  workerToManagerMessageType
-	SrcDir   string
-	DistDir  string
-	Detail   string
+	WorkerId    uint
+	MsgType     workerToManagerMessageType
+	SrcDir      string
+	DistDir     string
+	Detail      string
+	IgnoreRules []utils.IgnoreRule // FIND_DIR で見つけたディレクトリの親までの .bakashierignore のルール
 }
 
 // ワーカーに渡すジョブまたは終了指示。
 type messageFromManagerToWorker struct {
-	MsgType managerToWorkerMessageType
-	SrcDir  string
-	DistDir string
-	Detail  string
+	MsgType     managerToWorkerMessageType
+	SrcDir      string
+	DistDir     string
+	Detail      string
+	IgnoreRules []utils.IgnoreRule // ディレクトリの親までの .bakashierignore のルール
+}
+
+// ジョブを開始する前に失敗した場合に、エラーと処理完了をビューに通知する。
+func sendFatalError(toViewQueue chan<- view.MessageToView, prefix string, err error) {
+	toViewQueue <- view.MessageToView{
+		Source:   view.MANAGER,
+		MsgType:  view.ERROR,
+		WorkerId: 0,
+		Detail:   fmt.Sprintf("%s: %s", prefix, err.Error()),
+	}
+	toViewQueue <- view.MessageToView{
+		Source:   view.MANAGER,
+		MsgType:  view.FINISHED,
+		WorkerId: 0,
+		Detail:   "",
+	}
 }
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	
+	"bakashier/data"
+	"bakashier/utils"
+)
+
+
+// バックアップで、1つのディレクトリの小さなファイルをパックアーカイブにまとめて書き出す。
+// パックアーカイブは data.PackSize に達するごとに確定し、次のファイルから新しいパックアーカイブに書き出す。
+// 確定したパックアーカイブは書き換えず、以前のスナップショットからも参照される。
+type packBuilder struct {
+	settings Settings
+	distDir  string
+	nameMap  map[string]string // [HideName]RealName（バックアップ先のディレクトリで使用中の名前）
+	writer   *data.PackWriter
+	name     string // 書き込み中のパックアーカイブの隠し名
+	planned  uint64 // DryRun で、書き込み中のパックアーカイブに追加する予定のバイト数
+	pending  []packedFile
+}
+
+// パックアーカイブ内のファイルの位置。
+type packLocation struct {
+	name   string
+	offset uint64
+	length uint64
+}
+
+// パックアーカイブに追加したファイルのエントリと、パックアーカイブを確定できなかった場合に残す以前のエントリ。
+type packedFile struct {
+	entry    data.DirectoryEntry
+	previous data.DirectoryEntry
+}
+
+func newPackBuilder(settings Settings, distDir string, nameMap map[string]string) *packBuilder {
+	return &packBuilder{
+		settings: settings,
+		distDir:  distDir,
+		nameMap:  nameMap,
+	}
+}
+
+// size バイトのファイルをパックアーカイブにまとめるかを判定する。
+func (b *packBuilder) accepts(size int64) bool {
+	return b.settings.PackThreshold > 0 && uint64(size) < b.settings.PackThreshold
+}
+
+// 書き込み中のパックアーカイブのパスを返す。書き込み中のものがない場合は新しい隠し名を割り当てる。
+func (b *packBuilder) path() string {
+	if b.name == "" {
+		b.name = utils.GenerateUniqueRandomName(b.nameMap)
+		b.nameMap[b.name] = ""
+	}
+	return filepath.Join(b.distDir, fmt.Sprintf("%s.bks", b.name))
+}
+
+// DryRun で、size バイトのファイルを追加する予定のパックアーカイブのパスを返す。
+func (b *packBuilder) plan(size int64) string {
+	path := b.path()
+	b.planned += uint64(size)
+	if b.planned >= data.PackSize {
+		b.name, b.planned = "", 0
+	}
+	return path
+}
+
+// srcFile を隠し名 hideName のファイルとしてパックアーカイブに追加し、パックアーカイブ内の位置と平文の SHA-256 を返す。
+// 追加したファイルのエントリは hold で渡し、commit で確定する。
+func (b *packBuilder) add(srcFile string, hideName string) (packLocation, []byte, error) {
+	if b.writer == nil {
+		writer, err := data.CreatePackArchive(b.path(), b.name, b.settings.Password, b.settings.KDF)
+		if err != nil { return packLocation{}, nil, err }
+		b.writer = writer
+	}
+	offset, length, checksum, err := b.writer.Add(srcFile, hideName)
+	if err != nil { return packLocation{}, nil, err }
+	return packLocation{name: b.name, offset: offset, length: length}, checksum, nil
+}
+
+// add で追加したファイルのエントリを、パックアーカイブの確定まで保持する。
+func (b *packBuilder) hold(entry data.DirectoryEntry, previous data.DirectoryEntry) {
+	b.pending = append(b.pending, packedFile{entry: entry, previous: previous})
+}
+
+// 書き込み中のパックアーカイブが上限に達したかを判定する。
+func (b *packBuilder) full() bool {
+	return b.writer != nil && b.writer.Size() >= data.PackSize
+}
+
+// 書き込み中のパックアーカイブを確定し、追加したファイルの一覧を返す。
+// エラーの場合、一覧のエントリはいずれもパックアーカイブを参照できない。ファイルを1つも追加していない場合は書き出さない。
+func (b *packBuilder) commit() ([]packedFile, error) {
+	writer, pending := b.writer, b.pending
+	b.writer, b.name, b.pending = nil, "", nil
+	if writer == nil { return nil, nil }
+	if len(pending) == 0 {
+		writer.Abort()
+		return nil, nil
+	}
+	return pending, writer.Commit()
+}
+
+// 書き込み中のパックアーカイブを破棄する。
+func (b *packBuilder) abort() {
+	if b.writer != nil {
+		b.writer.Abort()
+	}
+	b.writer, b.name, b.pending = nil, "", nil
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	
+	"bakashier/data"
+)
+
+
+// 小さなファイルを複数のパックアーカイブにまとめてバックアップし、復元では他の形式と同じく競合を解決することを確認する。
+// 上書きではシンボリックリンクの先を書き換えず、rename では既存のファイルを残して別名で復元する。
+func TestRestorePackedFilesResolvesConflicts(t *testing.T) {
+	defer func(size uint64) { data.PackSize = size }(data.PackSize)
+	data.PackSize = 128
+	
+	src, dist, restored := t.TempDir(), t.TempDir(), t.TempDir()
+	files := map[string]string{"a.txt": "alpha", "b.txt": "bravo", "c.txt": "charlie", "d.txt": "delta"}
+	writeTestFiles(t, src, files)
+	settings := testSettings(src, dist)
+	settings.PackThreshold = 1024
+	requireNoErrors(t, runTestMode(Backup, settings))
+	
+	entries, err := loadDirectoryEntries(filepath.Join(dist, "_directory_.bks"), settings.Password)
+	if err != nil { t.Fatal(err) }
+	packs := make(map[string]bool)
+	for _, e := range entries {
+		if e.Type == data.File {
+			if e.PackName == "" {
+				t.Fatalf("%s is not packed", e.RealName)
+			}
+			packs[e.PackName] = true
+		}
+	}
+	if len(packs) < 2 {
+		t.Fatalf("got %d packs, want the files split across several packs", len(packs))
+	}
+	
+	// 既存のファイルとシンボリックリンクを上書きする
+	outside := filepath.Join(t.TempDir(), "outside")
+	writeTestFiles(t, filepath.Dir(outside), map[string]string{"outside": "outside"})
+	writeTestFiles(t, restored, map[string]string{"b.txt": "existing"})
+	if err := os.Symlink(outside, filepath.Join(restored, "a.txt")); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+	requireNoErrors(t, runTestMode(Restore, testSettings(dist, restored)))
+	requireTestFiles(t, restored, files)
+	requireTestFiles(t, filepath.Dir(outside), map[string]string{"outside": "outside"})
+	if info, err := os.Lstat(filepath.Join(restored, "a.txt")); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("a.txt was not restored as a regular file: %v", err)
+	}
+	
+	// rename では既存のファイルを残す
+	writeTestFiles(t, restored, map[string]string{"c.txt": "edited"})
+	renameSettings := testSettings(dist, restored)
+	renameSettings.OnConflict = ConflictRename
+	requireNoErrors(t, runTestMode(Restore, renameSettings))
+	requireTestFiles(t, restored, map[string]string{"c.txt": "edited", "c~1.txt": "charlie", "d~1.txt": "delta"})
+}
@@ -0,0 +1,357 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	
+	"bakashier/data"
+	"bakashier/utils"
+	"bakashier/view"
+)
+
+
+// 保持ルールに従って残すスナップショットの ID を返す。
+// 最新の完了したスナップショットと、それより新しい未完了のスナップショット（再開される可能性がある）は常に残す。
+// 完了したスナップショットが1つもない場合は、何も削除しないようすべてを残す。
+func selectSnapshotsToKeep(snapshots []data.Snapshot, retention SettingsRetention) map[uint64]bool {
+	keep := make(map[uint64]bool)
+	complete := make([]data.Snapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if snapshot.Complete {
+			complete = append(complete, snapshot)
+		}
+	}
+	if len(complete) == 0 {
+		for _, snapshot := range snapshots {
+			keep[snapshot.ID] = true
+		}
+		return keep
+	}
+	sort.Slice(complete, func(i, j int) bool { return complete[i].ID > complete[j].ID })
+	
+	latest := complete[0]
+	keep[latest.ID] = true
+	for _, snapshot := range snapshots {
+		if !snapshot.Complete && snapshot.ID > latest.ID {
+			keep[snapshot.ID] = true
+		}
+	}
+	
+	for i, snapshot := range complete {
+		if uint32(i) < retention.Last {
+			keep[snapshot.ID] = true
+		}
+	}
+	
+	// 期間ごとに最新のスナップショットを新しい順に n 期間分残す
+	var keepPeriods = func(n uint32, period func(t time.Time) string) {
+		seen := make(map[string]bool)
+		for _, snapshot := range complete {
+			if uint32(len(seen)) >= n { break }
+			key := period(snapshot.Time.Local())
+			if !seen[key] {
+				seen[key] = true
+				keep[snapshot.ID] = true
+			}
+		}
+	}
+	keepPeriods(retention.Daily, func(t time.Time) string { return t.Format("2006-01-02") })
+	keepPeriods(retention.Weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepPeriods(retention.Monthly, func(t time.Time) string { return t.Format("2006-01") })
+	
+	if retention.Within > 0 {
+		since := latest.Time.Add(-retention.Within)
+		for _, snapshot := range complete {
+			if !snapshot.Time.Before(since) {
+				keep[snapshot.ID] = true
+			}
+		}
+	}
+	return keep
+}
+
+// dir にあるスナップショットの写しのうち、残すスナップショットから参照されるものを返す。
+// スナップショット K は K 以前で最も新しい写しを使うため、写し n は [n, 次の写し) に残すスナップショットがある場合に必要となる。
+func neededSnapshotEntryFiles(items []os.DirEntry, keep map[uint64]bool) map[string]bool {
+	ids := []uint64{}
+	for _, item := range items {
+		if id, ok := parseSnapshotEntryFileName(item.Name()); ok && !item.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	
+	needed := make(map[string]bool)
+	for i, id := range ids {
+		for k := range keep {
+			if k >= id && (i+1 == len(ids) || k < ids[i+1]) {
+				needed[snapshotEntryFileName(id)] = true
+				break
+			}
+		}
+	}
+	return needed
+}
+
+// ワーカーキューからジョブを受け取り、残すスナップショットから参照されないアーカイブ・ディレクトリ・写しを削除する。
+// SrcDir はバックアップ先の隠しディレクトリ、DistDir は結果表示用の実名の相対パスを表す。
+// 最新の _directory_.bks と中断されたバックアップのジャーナルから参照されるものは常に残す。
+// いずれかのエントリ一覧を読み込めない場合は、そのディレクトリでは何も削除しない。
+// チャンクストアに格納したファイルのチャンクの参照は chunkRefs に集め、全ワーカーの完了後に参照されないチャンクを削除する。
+func pruneWorker(workerId uint, settings Settings, keep map[uint64]bool, chunkRefs *chunkReferences, toManagerQueue chan<- messageFromWorkerToManager, fromManagerQueue <-chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var password = settings.Password
+	var dryRun = settings.DryRun
+	
+	toViewQueue <- view.MessageToView{
+		Source:   view.WORKER,
+		MsgType:  view.ADD_WORKER,
+		WorkerId: workerId,
+		Detail:   "",
+	}
+	
+	for {
+		queue := <-fromManagerQueue
+		if queue.MsgType == EXIT { break }
+		
+		var errHandler = func(prefix string, err error) {
+			toManagerQueue <- messageFromWorkerToManager{
+				WorkerId: workerId,
+				MsgType:  ERROR,
+				SrcDir:   queue.SrcDir,
+				DistDir:  queue.DistDir,
+				Detail:   fmt.Sprintf("%s: %s", prefix, err.Error()),
+			}
+		}
+		
+		// ディレクトリ処理開始をビューに通知
+		toViewQueue <- view.MessageToView{
+			Source:   view.WORKER,
+			MsgType:  view.START_DIR,
+			WorkerId: workerId,
+			SrcPath:  queue.SrcDir,
+			DistPath: queue.DistDir,
+			Detail:   "",
+		}
+		
+		func() {
+			items, err := os.ReadDir(queue.SrcDir)
+			if err != nil {
+				errHandler("Failed to read backup directory", err)
+				return
+			}
+			
+			// 残すエントリ一覧から参照されている名前を集める。
+			needed := neededSnapshotEntryFiles(items, keep)
+			needed["_directory_.bks"] = true
+			referenced := make(map[string]bool)
+			realNames := make(map[string]string) // [HideName]RealName
+			var addEntries = func(entries []data.DirectoryEntry) {
+				for _, entry := range entries {
+					realNames[entry.HideName] = entry.RealName
+					// ハードリンクが参照するアーカイブは、同じスナップショットの参照先のファイルのエントリからも参照されている
+					// パックアーカイブは、格納しているいずれかのファイルが参照されている間は残す
+					switch {
+					case entry.Type == data.File && entry.Chunked:
+						chunkRefs.add(entry.Chunks)
+					case entry.Type == data.File:
+						referenced[entryArchiveName(entry)] = true
+					case entry.Type == data.Directory:
+						referenced[entry.HideName] = true
+					}
+				}
+			}
+			for name := range needed {
+				entries, err := readDirectoryEntries(filepath.Join(queue.SrcDir, name), password)
+				if errors.Is(err, os.ErrNotExist) { continue }
+				if err != nil {
+					errHandler(fmt.Sprintf("Failed to load %s", name), err)
+					return
+				}
+				addEntries(entries)
+			}
+			journalEntries, journal, err := data.LoadJournal(filepath.Join(queue.SrcDir, "_journal_.bks"), journalScope(settings.SrcDir, queue.SrcDir), password, utils.KDFParams{})
+			if err != nil {
+				errHandler("Failed to load journal", err)
+				return
+			}
+			journal.Close()
+			addEntries(journalEntries)
+			
+			// 削除を実行（DryRun の場合は予定のみを通知する）
+			var remove = func(name string, all bool) {
+				target := filepath.Join(queue.SrcDir, name)
+				realPath := ""
+				if realName, ok := realNames[strings.TrimSuffix(name, ".bks")]; ok {
+					realPath = filepath.Join(queue.DistDir, realName)
+				}
+				sendPlan(toViewQueue, workerId, planDelete, realPath, target)
+				if dryRun { return }
+				var err error
+				if all {
+					err = os.RemoveAll(target)
+				} else {
+					err = os.Remove(target)
+				}
+				if err != nil {
+					errHandler("Failed to remove", err)
+				}
+			}
+			
+			// 参照されないアーカイブとディレクトリを先に削除し、その後で不要な写しを削除する
+			for _, item := range items {
+				name := item.Name()
+				if item.IsDir() && name == data.ChunkStoreDirName && queue.SrcDir == settings.SrcDir { continue }
+				if item.IsDir() {
+					if !referenced[name] {
+						remove(name, true)
+						continue
+					}
+					
+					// 子ディレクトリの発見をディスパッチャに通知
+					chunkRefs.expect()
+					toManagerQueue <- messageFromWorkerToManager{
+						WorkerId: workerId,
+						MsgType:  FIND_DIR,
+						SrcDir:   filepath.Join(queue.SrcDir, name),
+						DistDir:  filepath.Join(queue.DistDir, realNames[name]),
+						Detail:   "",
+					}
+					continue
+				}
+				if _, ok := parseSnapshotEntryFileName(name); ok { continue }
+				if strings.HasPrefix(name, "_") && strings.HasSuffix(name, "_.bks") { continue }
+				if strings.HasSuffix(name, ".bks") && !referenced[name] {
+					remove(name, false)
+				}
+			}
+			for _, item := range items {
+				if _, ok := parseSnapshotEntryFileName(item.Name()); ok && !item.IsDir() && !needed[item.Name()] {
+					remove(item.Name(), false)
+				}
+			}
+			chunkRefs.done()
+		}()
+		
+		// ディレクトリ処理完了をビューに通知
+		toViewQueue <- view.MessageToView{
+			Source:   view.WORKER,
+			MsgType:  view.FINISH_DIR,
+			WorkerId: workerId,
+			SrcPath:  queue.SrcDir,
+			DistPath: queue.DistDir,
+			Detail:   "",
+		}
+		
+		// ディレクトリ処理完了をディスパッチャに通知
+		toManagerQueue <- messageFromWorkerToManager{
+			WorkerId: workerId,
+			MsgType:  FINISH_JOB,
+			SrcDir:   queue.SrcDir,
+			DistDir:  queue.DistDir,
+			Detail:   "",
+		}
+	}
+}
+
+// settings.SrcDir（バックアップ先）のスナップショットを settings.Retention に従って整理する。
+// 先に期限切れのスナップショットを一覧から外し、その後で参照されなくなったファイルを削除するため、
+// 途中で中断しても残すスナップショットは壊れず、残ったファイルは次回の整理で削除される。
+// チャンクストアがある場合は、全ディレクトリの処理後に、残すスナップショットから参照されないチャンクを削除する。
+func Prune(settings Settings, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager) {
+	var wg sync.WaitGroup
+	
+	// 残すスナップショットを決定し、期限切れのスナップショットを一覧から外す
+	snapshots, kdf, err := loadSnapshots(settings.SrcDir, settings.Password)
+	if err != nil {
+		sendFatalError(toViewQueue, "Failed to load snapshots", err)
+		return
+	}
+	if len(snapshots) == 0 {
+		sendFatalError(toViewQueue, "Failed to prune", fmt.Errorf("no snapshots recorded in %s", settings.SrcDir))
+		return
+	}
+	keep := selectSnapshotsToKeep(snapshots, settings.Retention)
+	kept := make([]data.Snapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if keep[snapshot.ID] {
+			kept = append(kept, snapshot)
+			continue
+		}
+		sendPlan(toViewQueue, 0, planForget, "", fmt.Sprintf("snapshot %d (%s)", snapshot.ID, snapshot.Time.Format("2006-01-02 15:04:05")))
+	}
+	if !settings.DryRun && len(kept) != len(snapshots) {
+		if err := saveSnapshots(settings.SrcDir, settings.Password, kdf, kept); err != nil {
+			sendFatalError(toViewQueue, "Failed to save snapshots", err)
+			return
+		}
+	}
+	
+	// チャンクストアがあれば開く
+	settings.chunkStore, err = openChunkStore(settings, settings.SrcDir, false)
+	if err != nil {
+		sendFatalError(toViewQueue, "Failed to open chunk store", err)
+		return
+	}
+	
+	workers := settings.Workers
+	queueSize := workers * 8
+	if workers <= 0 {
+		workers = 1
+		queueSize = 8
+	}
+	
+	workerToManagerQueue := make(chan messageFromWorkerToManager, queueSize)
+	managerToWorkerQueue := make(chan messageFromManagerToWorker, queueSize)
+	
+	workerToManagerQueue <- messageFromWorkerToManager{
+		MsgType: FIND_DIR,
+		SrcDir:  settings.SrcDir,
+		DistDir: "",
+		Detail:  "",
+	}
+	
+	// 全ワーカーの完了後に、参照されないチャンクを削除する
+	var chunkRefs chunkReferences
+	chunkRefs.expect()
+	var finalize func()
+	if settings.chunkStore != nil {
+		finalize = func() {
+			err := chunkRefs.prune(settings, toViewQueue, func(err error) {
+				toViewQueue <- view.MessageToView{
+					Source:   view.MANAGER,
+					MsgType:  view.ERROR,
+					WorkerId: 0,
+					Detail:   fmt.Sprintf("Failed to remove chunk: %s", err.Error()),
+				}
+			})
+			if err != nil {
+				toViewQueue <- view.MessageToView{
+					Source:   view.MANAGER,
+					MsgType:  view.ERROR,
+					WorkerId: 0,
+					Detail:   fmt.Sprintf("Skipped removing unreferenced chunks: %s", err.Error()),
+				}
+			}
+		}
+	}
+	
+	wg.Add(int(workers) + 1)
+	go restoreManager(workers, workerToManagerQueue, managerToWorkerQueue, toViewQueue, fromViewQueue, finalize, &wg)
+	for i := uint(0); i < uint(workers); i++ {
+		go pruneWorker(i+1, settings, keep, &chunkRefs, workerToManagerQueue, managerToWorkerQueue, toViewQueue, &wg)
+	}
+	wg.Wait()
+	
+	close(workerToManagerQueue)
+	close(managerToWorkerQueue)
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	
+	"bakashier/data"
+)
+
+
+// 日時の順に ID を振った完了済みのスナップショットの一覧を返す。
+func testSnapshots(times ...time.Time) []data.Snapshot {
+	snapshots := make([]data.Snapshot, 0, len(times))
+	for i, t := range times {
+		snapshots = append(snapshots, data.Snapshot{ID: uint64(i + 1), Time: t, Complete: true})
+	}
+	return snapshots
+}
+
+func testKeepIDs(ids ...uint64) map[uint64]bool {
+	keep := make(map[uint64]bool)
+	for _, id := range ids {
+		keep[id] = true
+	}
+	return keep
+}
+
+func TestSelectSnapshotsToKeep(t *testing.T) {
+	at := func(day int, hour int) time.Time {
+		return time.Date(2026, time.March, day, hour, 0, 0, 0, time.Local)
+	}
+	// 2026-03-02 は月曜日
+	daily := testSnapshots(at(2, 10), at(2, 12), at(3, 9), at(4, 8), at(4, 20))
+	monthly := testSnapshots(
+		time.Date(2026, time.January, 10, 12, 0, 0, 0, time.Local),
+		time.Date(2026, time.January, 20, 12, 0, 0, 0, time.Local),
+		time.Date(2026, time.February, 5, 12, 0, 0, 0, time.Local),
+		time.Date(2026, time.March, 1, 12, 0, 0, 0, time.Local),
+	)
+	
+	tests := []struct {
+		name      string
+		snapshots []data.Snapshot
+		retention SettingsRetention
+		want      map[uint64]bool
+	}{
+		{"no rules keep only the latest", daily, SettingsRetention{}, testKeepIDs(5)},
+		{"last", daily, SettingsRetention{Last: 3}, testKeepIDs(3, 4, 5)},
+		{"last beyond the count", daily, SettingsRetention{Last: 10}, testKeepIDs(1, 2, 3, 4, 5)},
+		{"daily keeps the newest of each day", daily, SettingsRetention{Daily: 2}, testKeepIDs(3, 5)},
+		{"daily beyond the days", daily, SettingsRetention{Daily: 7}, testKeepIDs(2, 3, 5)},
+		{"weekly", testSnapshots(at(2, 10), at(8, 10), at(9, 10), at(16, 10)), SettingsRetention{Weekly: 2}, testKeepIDs(3, 4)},
+		{"monthly", monthly, SettingsRetention{Monthly: 2}, testKeepIDs(3, 4)},
+		{"monthly beyond the months", monthly, SettingsRetention{Monthly: 12}, testKeepIDs(2, 3, 4)},
+		{"within is relative to the latest", daily, SettingsRetention{Within: 36 * time.Hour}, testKeepIDs(3, 4, 5)},
+		{"rules are combined", daily, SettingsRetention{Last: 1, Daily: 1, Within: 13 * time.Hour}, testKeepIDs(4, 5)},
+	}
+	for _, tt := range tests {
+		if got := selectSnapshotsToKeep(tt.snapshots, tt.retention); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectSnapshotsToKeepIncomplete(t *testing.T) {
+	now := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.Local)
+	snapshots := []data.Snapshot{
+		{ID: 1, Time: now, Complete: true},
+		{ID: 2, Time: now.Add(time.Hour), Complete: false},
+		{ID: 3, Time: now.Add(2 * time.Hour), Complete: true},
+		{ID: 4, Time: now.Add(3 * time.Hour), Complete: false},
+	}
+	
+	// 最新の完了したスナップショットより新しい未完了のスナップショットは残し、古いものは残さない
+	if got, want := selectSnapshotsToKeep(snapshots, SettingsRetention{}), testKeepIDs(3, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// 保持ルールは完了したスナップショットのみを数える
+	if got, want := selectSnapshotsToKeep(snapshots, SettingsRetention{Last: 2}), testKeepIDs(1, 3, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("last: got %v, want %v", got, want)
+	}
+	
+	// 完了したスナップショットがない場合はすべて残す
+	incomplete := []data.Snapshot{{ID: 1, Time: now}, {ID: 2, Time: now.Add(time.Hour)}}
+	if got, want := selectSnapshotsToKeep(incomplete, SettingsRetention{Last: 1}), testKeepIDs(1, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("no complete snapshot: got %v, want %v", got, want)
+	}
+}
@@ -3,20 +3,25 @@ package core
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"sync"
 	"time"
 	
 	"bakashier/data"
+	"bakashier/utils"
 	"bakashier/view"
 )
 
 
 // キューからメッセージを受け取り、ワーカーにジョブを配分する。
-// 全ジョブ完了後に各ワーカーに EXIT を送って終了する。
-func restoreManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToManager, toWorkerQueue chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager, wg *sync.WaitGroup) {
+// 全ジョブ完了後に各ワーカーに EXIT を送って終了する。finalize が nil でない場合は、FINISHED を送る前に呼ぶ。
+func restoreManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToManager, toWorkerQueue chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager, finalize func(), wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer func() {
+		if finalize != nil {
+			finalize()
+		}
 		toViewQueue <- view.MessageToView{
 			Source:   view.MANAGER,
 			MsgType:  view.FINISHED,
@@ -46,10 +51,11 @@ func restoreManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToMa
 			switch msg.MsgType {
 			case FIND_DIR:
 				untreatedMessage = append(untreatedMessage, messageFromManagerToWorker{
-					MsgType: NEXT_JOB,
-					SrcDir:  msg.SrcDir,
-					DistDir: msg.DistDir,
-					Detail:  msg.Detail,
+					MsgType:     NEXT_JOB,
+					SrcDir:      msg.SrcDir,
+					DistDir:     msg.DistDir,
+					Detail:      msg.Detail,
+					IgnoreRules: msg.IgnoreRules,
 				})
 				untreated++
 			case FINISH_JOB:
@@ -61,6 +67,15 @@ func restoreManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToMa
 					WorkerId: msg.WorkerId,
 					Detail:   msg.Detail,
 				}
+			case ABORT:
+				// ワーカーから中止要求が来た場合は、終了指示と同様に残りのジョブを破棄する
+				toViewQueue <- view.MessageToView{
+					Source:   view.MANAGER,
+					MsgType:  view.ERROR,
+					WorkerId: msg.WorkerId,
+					Detail:   msg.Detail,
+				}
+				termination = true
 			}
 		default:
 		}
@@ -145,11 +160,77 @@ func restoreManager(workers uint32, fromWorkerQueue <-chan messageFromWorkerToMa
 	}
 }
 
+// 復元先の名前を決定する。安全な名前はそのまま返す。
+// 安全でない名前は unsafeNames が有効な場合のみ、usedNames と衝突しない安全な名前に置き換える。
+func resolveRestoreName(name string, unsafeNames bool, usedNames map[string]bool) (string, bool) {
+	if utils.IsSafeFileName(name) {
+		return name, true
+	}
+	if !unsafeNames {
+		return "", false
+	}
+	base := utils.ToSafeFileName(name)
+	safe := base
+	for i := 1; usedNames[safe]; i++ {
+		safe = fmt.Sprintf("%s~%d", base, i)
+	}
+	usedNames[safe] = true
+	return safe, true
+}
+
+// settings.Paths による絞り込みで、復元先 realPath のエントリを復元するか（restore）、
+// ディレクトリの場合は一致する子孫を探して走査するか（descend）を返す。
+// パターンに一致したディレクトリの子孫はすべて復元する。
+func selectRestorePath(settings Settings, realPath string) (restore bool, descend bool) {
+	if len(settings.Paths) == 0 {
+		return true, true
+	}
+	relPath, err := filepath.Rel(settings.DistDir, realPath)
+	if err != nil {
+		return false, false
+	}
+	if relPath == "." {
+		return false, true
+	}
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range settings.Paths {
+		for dir := relPath; dir != "."; dir = path.Dir(dir) {
+			if utils.MatchPathPattern(pattern, dir) {
+				return true, true
+			}
+		}
+		if utils.MatchPathPatternPrefix(pattern, relPath) {
+			descend = true
+		}
+	}
+	return false, descend
+}
+
+// 書き出す直前に、target が復元先の内側にあり、既存のシンボリックリンクでないことを確認し直す。
+// 他のワーカーが並行して復元先にディレクトリやシンボリックリンクを作成するため、エントリを読み込んだ時点の確認だけでは足りない。
+func checkRestoreTarget(settings Settings, target string) error {
+	if !utils.IsWithinDirectory(settings.DistDir, target) {
+		return fmt.Errorf("%w: %s", utils.ErrUnsafePath, target)
+	}
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %s", utils.ErrUnsafePath, target)
+	}
+	return nil
+}
+
 // ワーカーキューからジョブを受け取り、_directory_.bks と .bks ファイルから復元する。
 // ディレクトリエントリに従い、隠し名の .bks を復号して実名で distDir に書き出す。
-func restoreWorker(workerId uint, password string, toManagerQueue chan<- messageFromWorkerToManager, fromManagerQueue <-chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, wg *sync.WaitGroup, limit SettingsLimit) {
+// 実名が settings.DistDir の外を指す場合は拒否し、RestoreUnsafeNames が有効な場合は安全な名前に置き換える。
+// DryRun が有効な場合は作成・上書きされるファイルを PLAN で通知するのみで、復元先には何も書き込まない。
+// settings.Paths が指定されている場合は、一致するエントリとその途中のディレクトリのみを復元する。
+// ファイルには復元直後に権限・所有者・更新日時を適用し、ディレクトリは directories に追加して全ワーカーの完了後に適用する。
+// ハードリンクは links に追加し、参照先のファイルの復元を待つため全ワーカーの完了後に作成する。
+func restoreWorker(workerId uint, settings Settings, directories *pendingDirectories, links *pendingHardlinks, toManagerQueue chan<- messageFromWorkerToManager, fromManagerQueue <-chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, wg *sync.WaitGroup) {
 	defer wg.Done()
 	var processedSize uint64 = 0
+	var password = settings.Password
+	var limit = settings.Limit
+	var attributes = restoreAttributeOptions(settings)
 	
 	toViewQueue <- view.MessageToView{
 		Source:   view.WORKER,
@@ -172,6 +253,48 @@ func restoreWorker(workerId uint, password string, toManagerQueue chan<- message
 			}
 		}
 		
+		// 既存のファイルとの競合の判断をビューに通知し、復元を続けるかを返す。
+		// fail の場合はマネージャに中止を要求し、aborted を設定する。
+		// 上書きする既存のエントリがシンボリックリンクまたは他のハードリンクを持つファイルの場合は、リンク先を書き換えないよう先に削除する。
+		aborted := false
+		var handleConflict = func(realPath string, target string, action string) bool {
+			if action != planCreate {
+				toViewQueue <- view.MessageToView{
+					Source:   view.WORKER,
+					MsgType:  view.CONFLICT,
+					WorkerId: workerId,
+					SrcPath:  realPath,
+					DistPath: target,
+					Detail:   action,
+				}
+			}
+			switch action {
+			case planSkip:
+				return false
+			case planFail:
+				toManagerQueue <- messageFromWorkerToManager{
+					WorkerId: workerId,
+					MsgType:  ABORT,
+					SrcDir:   queue.SrcDir,
+					DistDir:  queue.DistDir,
+					Detail:   fmt.Sprintf("Aborted restore on conflict with existing file: %s", realPath),
+				}
+				aborted = true
+				return false
+			case planOverwrite:
+				if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+					_, _, nlink, _ := utils.FileInode(info)
+					if info.Mode()&os.ModeSymlink != 0 || nlink > 1 {
+						if err := os.Remove(target); err != nil {
+							errHandler("Failed to remove existing link", err)
+							return false
+						}
+					}
+				}
+			}
+			return true
+		}
+		
 		// ディレクトリ処理開始をビューに通知
 		toViewQueue <- view.MessageToView{
 			Source:   view.WORKER,
@@ -183,30 +306,74 @@ func restoreWorker(workerId uint, password string, toManagerQueue chan<- message
 		}
 		
 		func() {
-			err := os.MkdirAll(queue.DistDir, 0755)
-			if err != nil {
-				errHandler("Failed to create directory", err)
-				return
+			// 絞り込み中のディレクトリは、一致するファイルを復元するときに作成する
+			if selected, _ := selectRestorePath(settings, queue.DistDir); selected && !settings.DryRun {
+				err := utils.MkdirWithin(settings.DistDir, queue.DistDir)
+				if err != nil {
+					errHandler("Failed to create directory", err)
+					return
+				}
 			}
 			
 			// _directory_.bks からエントリ一覧を読み込む。
-			directoryEntryFile := filepath.Join(queue.SrcDir, "_directory_.bks")
+			directoryEntryFile := directoryEntryFileAt(queue.SrcDir, settings.SnapshotID)
 			entries, err := loadDirectoryEntries(directoryEntryFile, password)
 			if err != nil {
 				errHandler("Failed to load directory entries", err)
 				return
 			}
 			
+			// 安全な実名のみを予約し、置き換え後の名前が衝突しないようにする。
+			// 同じ実名のエントリが複数ある一覧（シンボリックリンクと同名のディレクトリなど）は改ざんされているため、その名前はいずれも復元しない
+			usedNames := make(map[string]bool)
+			duplicated := make(map[string]bool)
+			for _, entry := range entries {
+				if usedNames[entry.RealName] {
+					duplicated[entry.RealName] = true
+				}
+				if utils.IsSafeFileName(entry.RealName) {
+					usedNames[entry.RealName] = true
+				}
+			}
+			
 			// リストアを実行
 			for _, entry := range entries {
+				if !utils.IsSafeFileName(entry.HideName) {
+					errHandler("Rejected unsafe hide name", fmt.Errorf("%q", entry.HideName))
+					continue
+				}
+				if duplicated[entry.RealName] {
+					errHandler("Rejected duplicate name", fmt.Errorf("%q", entry.RealName))
+					continue
+				}
+				realName, ok := resolveRestoreName(entry.RealName, settings.RestoreUnsafeNames, usedNames)
+				if !ok {
+					errHandler("Rejected unsafe name", fmt.Errorf("%q", entry.RealName))
+					continue
+				}
+				if realName != entry.RealName {
+					errHandler("Renamed unsafe name", fmt.Errorf("%q -> %q", entry.RealName, realName))
+				}
+				realPath := filepath.Join(queue.DistDir, realName)
+				if !utils.IsWithinDirectory(settings.DistDir, realPath) {
+					errHandler("Rejected path outside of restore directory", fmt.Errorf("%q", realPath))
+					continue
+				}
+				restore, descend := selectRestorePath(settings, realPath)
+				
 				switch entry.Type {
 				case data.Directory:
+					if !descend { continue }
 					hiddenDir := filepath.Join(queue.SrcDir, entry.HideName)
-					realDir := filepath.Join(queue.DistDir, entry.RealName)
-					err = os.MkdirAll(realDir, 0755)
-					if err != nil {
-						errHandler("Failed to create directory", err)
-						return
+					realDir := realPath
+					if restore && !settings.DryRun {
+						// 既存のシンボリックリンクをたどって復元先の外にディレクトリを作成しない
+						err = utils.MkdirWithin(settings.DistDir, realDir)
+						if err != nil {
+							errHandler("Failed to create directory", err)
+							return
+						}
+						directories.add(realDir, entry)
 					}
 					
 					// 子ディレクトリの発見をディスパッチャに通知
@@ -218,7 +385,8 @@ func restoreWorker(workerId uint, password string, toManagerQueue chan<- message
 						Detail:   "",
 					}
 				case data.File:
-					archiveFile := filepath.Join(queue.SrcDir, fmt.Sprintf("%s.bks", entry.HideName))
+					if !restore { continue }
+					archiveFile := entryContentPath(settings, queue.SrcDir, entry)
 					
 					// ファイル処理開始をビューに通知
 					toViewQueue <- view.MessageToView{
@@ -226,17 +394,46 @@ func restoreWorker(workerId uint, password string, toManagerQueue chan<- message
 						MsgType:  view.START_FILE,
 						WorkerId: workerId,
 						SrcPath:  archiveFile,
-						DistPath: filepath.Join(queue.DistDir, entry.RealName),
+						DistPath: realPath,
 						Detail:   "",
 					}
 					
 					func() {
-						err, realFile := data.ImportStreamArchive(archiveFile, queue.DistDir, password)
+						// 既存のファイルとの競合を解決する
+						target, action, err := resolveConflict(settings.OnConflict, realPath, entry.ModTime, usedNames)
 						if err != nil {
-							errHandler("Failed to import stream archive", err)
+							errHandler("Failed to check restore target", err)
 							return
 						}
-						_ = os.Chtimes(realFile, time.Now(), entry.ModTime)
+						
+						// DryRun の場合は競合の判断を含めた実行予定のみを通知する
+						if settings.DryRun {
+							sendPlan(toViewQueue, workerId, action, archiveFile, target)
+							return
+						}
+						
+						if !handleConflict(realPath, target, action) { return }
+						
+						if len(settings.Paths) > 0 {
+							err := utils.MkdirWithin(settings.DistDir, queue.DistDir)
+							if err != nil {
+								errHandler("Failed to create directory", err)
+								return
+							}
+						}
+						if err := checkRestoreTarget(settings, target); err != nil {
+							errHandler("Rejected restore target", err)
+							return
+						}
+						err = importEntryContent(settings, queue.SrcDir, entry, target)
+						if err != nil {
+							errHandler("Failed to import file contents", err)
+							return
+						}
+						links.restoredAs(linkRelPath(settings.DistDir, realPath), target)
+						if err := applyEntryAttributes(target, entry, attributes); err != nil {
+							errHandler("Failed to restore attributes", err)
+						}
 						
 						if limit.Size > 0 && limit.Wait > 0 {
 							processedSize += uint64(entry.Size)
@@ -253,9 +450,84 @@ func restoreWorker(workerId uint, password string, toManagerQueue chan<- message
 						MsgType:  view.FINISH_FILE,
 						WorkerId: workerId,
 						SrcPath:  archiveFile,
-						DistPath: filepath.Join(queue.DistDir, entry.RealName),
+						DistPath: realPath,
 						Detail:   "",
 					}
+					if aborted { return }
+				case data.Symlink:
+					if !restore { continue }
+					func() {
+						// 既存のファイルとの競合を解決する
+						target, action, err := resolveConflict(settings.OnConflict, realPath, entry.ModTime, usedNames)
+						if err != nil {
+							errHandler("Failed to check restore target", err)
+							return
+						}
+						
+						// DryRun の場合は競合の判断を含めた実行予定のみを通知する
+						if settings.DryRun {
+							sendPlan(toViewQueue, workerId, action, "", target)
+							return
+						}
+						if !handleConflict(realPath, target, action) { return }
+						
+						if len(settings.Paths) > 0 {
+							err := utils.MkdirWithin(settings.DistDir, queue.DistDir)
+							if err != nil {
+								errHandler("Failed to create directory", err)
+								return
+							}
+						}
+						
+						// 既存のファイルはシンボリックリンクで置き換えられないため、上書きする場合は先に削除する
+						if action == planOverwrite {
+							if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+								errHandler("Failed to remove existing file", err)
+								return
+							}
+						}
+						if err := checkRestoreTarget(settings, target); err != nil {
+							errHandler("Rejected restore target", err)
+							return
+						}
+						if err := os.Symlink(entry.LinkTarget, target); err != nil {
+							errHandler("Failed to create symlink", err)
+							return
+						}
+						if err := applyEntryAttributes(target, entry, attributes); err != nil {
+							errHandler("Failed to restore attributes", err)
+						}
+					}()
+					if aborted { return }
+				case data.Hardlink:
+					if !restore { continue }
+					func() {
+						// 既存のファイルとの競合を解決する
+						target, action, err := resolveConflict(settings.OnConflict, realPath, entry.ModTime, usedNames)
+						if err != nil {
+							errHandler("Failed to check restore target", err)
+							return
+						}
+						
+						// DryRun の場合は競合の判断を含めた実行予定のみを通知する
+						if settings.DryRun {
+							sendPlan(toViewQueue, workerId, action, filepath.Join(settings.DistDir, filepath.FromSlash(entry.LinkTarget)), target)
+							return
+						}
+						if !handleConflict(realPath, target, action) { return }
+						
+						if len(settings.Paths) > 0 {
+							err := utils.MkdirWithin(settings.DistDir, queue.DistDir)
+							if err != nil {
+								errHandler("Failed to create directory", err)
+								return
+							}
+						}
+						
+						// 参照先のファイルは別のワーカーが復元するため、リンクは全ワーカーの完了後に作成する
+						links.add(target, entry)
+					}()
+					if aborted { return }
 				default:
 					errHandler("Unknown entry type", fmt.Errorf("%v", entry.Type))
 					return
@@ -289,6 +561,24 @@ func restoreWorker(workerId uint, password string, toManagerQueue chan<- message
 func Restore(settings Settings, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager) {
 	var wg sync.WaitGroup
 	
+	// 対象のスナップショットを決定する
+	snapshot, err := resolveSnapshot(settings)
+	if err != nil {
+		sendFatalError(toViewQueue, "Failed to resolve snapshot", err)
+		return
+	}
+	settings.SnapshotID = snapshot
+	
+	// チャンクストアに格納されたファイルを読むため、チャンクストアがあれば開く
+	settings.chunkStore, err = openChunkStore(settings, settings.SrcDir, false)
+	if err != nil {
+		sendFatalError(toViewQueue, "Failed to open chunk store", err)
+		return
+	}
+	
+	// パックアーカイブの鍵は、この実行の間だけ保持する
+	settings.packReader = data.NewPackReader(settings.Password)
+	
 	workers := settings.Workers
 	queueSize := workers * 8
 	if workers <= 0 {
@@ -306,10 +596,32 @@ func Restore(settings Settings, toViewQueue chan<- view.MessageToView, fromViewQ
 		Detail:  "",
 	}
 	
+	// 全ワーカーの完了後に、ハードリンクを作成してから復元したディレクトリの属性を適用する
+	var directories pendingDirectories
+	var links pendingHardlinks
+	var finalize = func() {
+		links.apply(settings, restoreAttributeOptions(settings), func(err error) {
+			toViewQueue <- view.MessageToView{
+				Source:   view.MANAGER,
+				MsgType:  view.ERROR,
+				WorkerId: 0,
+				Detail:   fmt.Sprintf("Failed to restore hard link: %s", err.Error()),
+			}
+		})
+		directories.apply(restoreAttributeOptions(settings), func(err error) {
+			toViewQueue <- view.MessageToView{
+				Source:   view.MANAGER,
+				MsgType:  view.ERROR,
+				WorkerId: 0,
+				Detail:   fmt.Sprintf("Failed to restore attributes: %s", err.Error()),
+			}
+		})
+	}
+	
 	wg.Add(int(workers) + 1)
-	go restoreManager(workers, workerToManagerQueue, managerToWorkerQueue, toViewQueue, fromViewQueue, &wg)
+	go restoreManager(workers, workerToManagerQueue, managerToWorkerQueue, toViewQueue, fromViewQueue, finalize, &wg)
 	for i := uint(0); i < uint(workers); i++ {
-		go restoreWorker(i+1, settings.Password, workerToManagerQueue, managerToWorkerQueue, toViewQueue, &wg, settings.Limit)
+		go restoreWorker(i+1, settings, &directories, &links, workerToManagerQueue, managerToWorkerQueue, toViewQueue, &wg)
 	}
 	wg.Wait()
 	
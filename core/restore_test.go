@@ -0,0 +1,88 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	
+	"bakashier/data"
+)
+
+
+// 改ざんされた _directory_.bks の実名で、復元先の外に書き込まないことを確認する。
+// 親ディレクトリを指す名前・絶対パスの名前に加え、外部を指すシンボリックリンクと同名のディレクトリ・ファイルの組を含める。
+func TestRestoreRejectsCraftedEntries(t *testing.T) {
+	src, dist, restored, outside := t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()
+	writeTestFiles(t, src, map[string]string{"a.txt": "alpha", "sub/f.txt": "inside"})
+	if err := os.Symlink(outside, filepath.Join(src, "link")); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+	settings := testSettings(src, dist)
+	requireNoErrors(t, runTestMode(Backup, settings))
+	
+	entries, err := loadDirectoryEntries(filepath.Join(dist, "_directory_.bks"), settings.Password)
+	if err != nil { t.Fatal(err) }
+	byName := make(map[string]data.DirectoryEntry)
+	for _, e := range entries {
+		byName[e.RealName] = e
+	}
+	rename := func(e data.DirectoryEntry, name string) data.DirectoryEntry {
+		e.RealName = name
+		return e
+	}
+	crafted := []data.DirectoryEntry{
+		byName["a.txt"],
+		rename(byName["a.txt"], "../x"),
+		rename(byName["a.txt"], filepath.Join(outside, "absolute")),
+		// シンボリックリンクを先に作成させ、同名のディレクトリ・ファイルをリンク経由で書き出させようとする
+		rename(byName["link"], "pair"),
+		rename(byName["sub"], "pair"),
+		rename(byName["link"], "filepair"),
+		rename(byName["a.txt"], "filepair"),
+	}
+	writeTestDirectoryEntries(t, dist, settings, crafted)
+	
+	for _, unsafeNames := range []bool{false, true} {
+		target := filepath.Join(restored, map[bool]string{false: "strict", true: "renamed"}[unsafeNames])
+		restoreSettings := testSettings(dist, target)
+		restoreSettings.RestoreUnsafeNames = unsafeNames
+		messages := runTestMode(Restore, restoreSettings)
+		if got := countErrors(messages, "Rejected duplicate name"); got != 4 {
+			t.Errorf("unsafe names %v: got %d duplicate name errors, want 4", unsafeNames, got)
+		}
+		requireTestFiles(t, target, map[string]string{"a.txt": "alpha"})
+		for _, name := range []string{"pair", "filepair"} {
+			if _, err := os.Lstat(filepath.Join(target, name)); !os.IsNotExist(err) {
+				t.Errorf("unsafe names %v: %s was restored: %v", unsafeNames, name, err)
+			}
+		}
+	}
+	
+	// 復元先の外には何も書き込まれていない
+	items, err := os.ReadDir(outside)
+	if err != nil { t.Fatal(err) }
+	if len(items) != 0 {
+		t.Fatalf("restore wrote %d entries outside of the restore directory", len(items))
+	}
+	if _, err := os.Lstat(filepath.Join(restored, "..", "x")); !os.IsNotExist(err) {
+		t.Fatalf("restore wrote to the parent of the restore directory: %v", err)
+	}
+}
+
+// 既存のシンボリックリンクと同じ名前のディレクトリを復元する際に、リンクをたどらないことを確認する。
+func TestRestoreDoesNotFollowExistingSymlinkDirectory(t *testing.T) {
+	src, dist, restored, outside := t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()
+	writeTestFiles(t, src, map[string]string{"sub/f.txt": "inside"})
+	requireNoErrors(t, runTestMode(Backup, testSettings(src, dist)))
+	if err := os.Symlink(outside, filepath.Join(restored, "sub")); err != nil {
+		t.Skipf("symlinks are not supported: %v", err)
+	}
+	
+	messages := runTestMode(Restore, testSettings(dist, restored))
+	if countErrors(messages, "Failed to create directory") == 0 {
+		t.Fatal("symlinked directory was not reported")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "f.txt")); !os.IsNotExist(err) {
+		t.Fatalf("restore wrote through the symlink: %v", err)
+	}
+}
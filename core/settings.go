@@ -1,11 +1,27 @@
 package core
 
+import (
+	"time"
+	
+	"bakashier/data"
+	"bakashier/utils"
+)
+
 
 type SettingsLimit struct {
 	Size uint64
 	Wait uint64
 }
 
+// スナップショットの保持ルール。0 のルールは使用しない。
+type SettingsRetention struct {
+	Last    uint32        // 最新から N 個
+	Daily   uint32        // 最新から N 日分（各日の最新）
+	Weekly  uint32        // 最新から N 週分（各週の最新）
+	Monthly uint32        // 最新から N か月分（各月の最新）
+	Within  time.Duration // 最新のスナップショットからこの期間内
+}
+
 type Settings struct {
 	SrcDir  string
 	DistDir string
@@ -13,4 +29,25 @@ type Settings struct {
 	Workers uint32
 	ChunkSize uint64
 	Limit SettingsLimit
+	KDF utils.KDFParams
+	RestoreUnsafeNames bool
+	NoOwner bool // 復元時に所有者を変更しない（root 以外では常に変更しない）
+	SkipXattrNamespaces []string // 復元時に適用しない拡張属性の名前空間（user, trusted, security, system）
+	DiffContent bool
+	DryRun bool
+	Filters []string // gitignore 形式の除外ルール（--include は先頭に '!' を付けて並べる）
+	PruneExcluded bool
+	FollowSymlinks bool // バックアップでシンボリックリンクをリンクとして記録せず、リンク先を辿る
+	Xattrs bool // バックアップで拡張属性（POSIX ACL を含む）を記録する
+	Checksum bool // バックアップで内容の SHA-256 を比較して変更を判定する
+	ChecksumInterval time.Duration // Checksum で、サイズと更新日時が一致するファイルの内容を再確認する間隔（0 = 毎回）
+	Dedup bool // バックアップ先にチャンクストアを作成し、ファイルを内容で区切ったチャンクとして重複を排除して格納する
+	PackThreshold uint64 // バックアップで、このサイズ（バイト）未満のファイルをディレクトリごとのパックアーカイブにまとめる（0 = まとめない）
+	SnapshotID uint64      // バックアップでは作成するスナップショット、それ以外では対象のスナップショット（0 = 最新）
+	SnapshotTime time.Time // 対象のスナップショットを日時で指定する（この日時以前で最新のもの）
+	Retention SettingsRetention
+	Paths []string // 復元するパス（バックアップのルートからの '/' 区切りの相対パスまたはグロブ、空の場合はすべて）
+	OnConflict ConflictPolicy // 復元先に既存のファイルがある場合の扱い（空の場合は上書き）
+	chunkStore *data.ChunkStore // バックアップ先のチャンクストア（存在しない場合は nil）
+	packReader *data.PackReader // パックアーカイブの読み込みに使う、実行ごとの鍵のキャッシュ
 }
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	
+	"bakashier/data"
+	"bakashier/utils"
+)
+
+
+// バックアップ先のルートに置くスナップショット一覧のファイル名と、関連データとして認証する名前。
+const snapshotsFileName = "_snapshots_.bks"
+const snapshotsHideName = "_snapshots_"
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// スナップショット id 時点の _directory_.bks の写しのファイル名を返す。
+func snapshotEntryFileName(id uint64) string {
+	return fmt.Sprintf("_directory_%d_.bks", id)
+}
+
+// name がスナップショットの _directory_.bks の写しであれば、そのスナップショット ID を返す。
+func parseSnapshotEntryFileName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, "_directory_") || !strings.HasSuffix(name, "_.bks") {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "_directory_"), "_.bks"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// dir のスナップショット snapshot 時点のエントリ一覧のパスを返す。snapshot が 0 の場合は最新の _directory_.bks を返す。
+// バックアップは変更のあったディレクトリにのみ写しを書くため、snapshot 以前で最も新しい写しを選ぶ。
+// 該当する写しがない場合（そのスナップショットでは空のディレクトリ）は、存在しないパスを返す。
+func directoryEntryFileAt(dir string, snapshot uint64) string {
+	if snapshot == 0 {
+		return filepath.Join(dir, "_directory_.bks")
+	}
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return filepath.Join(dir, snapshotEntryFileName(snapshot))
+	}
+	var found uint64 = 0
+	for _, item := range items {
+		if id, ok := parseSnapshotEntryFileName(item.Name()); ok && id <= snapshot && id > found {
+			found = id
+		}
+	}
+	if found == 0 {
+		return filepath.Join(dir, snapshotEntryFileName(snapshot))
+	}
+	return filepath.Join(dir, snapshotEntryFileName(found))
+}
+
+// dir の最新およびすべてのスナップショットのエントリ一覧から参照されているファイル名を返す。
+// ファイルは "<HideName>.bks"（パックアーカイブに格納したファイルは "<PackName>.bks"）、ディレクトリは "<HideName>" として返す。
+// シンボリックリンクとチャンクストアに格納したファイルは対応するファイルを持たない。
+func referencedNames(dir string, password string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	items, err := os.ReadDir(dir)
+	if err != nil { return nil, err }
+	for _, item := range items {
+		if _, ok := parseSnapshotEntryFileName(item.Name()); !ok && item.Name() != "_directory_.bks" {
+			continue
+		}
+		entries, err := readDirectoryEntries(filepath.Join(dir, item.Name()), password)
+		if err != nil { return nil, fmt.Errorf("%s: %w", item.Name(), err) }
+		for _, entry := range entries {
+			switch {
+			case entry.Type == data.File && !entry.Chunked:
+				referenced[entryArchiveName(entry)] = true
+			case entry.Type == data.Directory:
+				referenced[entry.HideName] = true
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// distDir のスナップショット一覧と、一覧の書き出しに使われた KDF を読み込む。一覧が存在しない場合は空スライスを返す。
+func loadSnapshots(distDir string, password string) ([]data.Snapshot, utils.KDFParams, error) {
+	var archive data.ArchiveData
+	err := archive.Import(filepath.Join(distDir, snapshotsFileName))
+	if errors.Is(err, os.ErrNotExist) { return []data.Snapshot{}, utils.KDFParams{}, nil }
+	if err != nil { return nil, utils.KDFParams{}, err }
+	_, content, err := data.FromArchiveData(archive, snapshotsHideName, password)
+	if err != nil { return nil, utils.KDFParams{}, err }
+	snapshots, err := data.ImportSnapshots(content)
+	if err != nil { return nil, utils.KDFParams{}, err }
+	return snapshots, archive.KDF, nil
+}
+
+// distDir にスナップショット一覧を書き出す。
+func saveSnapshots(distDir string, password string, kdf utils.KDFParams, snapshots []data.Snapshot) error {
+	content, err := data.ExportSnapshots(snapshots)
+	if err != nil { return err }
+	archive, err := data.ToArchiveData(snapshotsHideName, snapshotsHideName, content, password, kdf)
+	if err != nil { return err }
+	return archive.Export(filepath.Join(distDir, snapshotsFileName))
+}
+
+// 完了したスナップショットから、id が一致するもの、または at 以前で最も新しいものを返す。
+func findSnapshot(snapshots []data.Snapshot, id uint64, at time.Time) (data.Snapshot, error) {
+	var found *data.Snapshot
+	for i, snapshot := range snapshots {
+		if !snapshot.Complete { continue }
+		if id != 0 {
+			if snapshot.ID == id {
+				return snapshot, nil
+			}
+			continue
+		}
+		if snapshot.Time.After(at) { continue }
+		if found == nil || snapshot.ID > found.ID {
+			found = &snapshots[i]
+		}
+	}
+	if found == nil {
+		if id != 0 {
+			return data.Snapshot{}, fmt.Errorf("%w: %d", ErrSnapshotNotFound, id)
+		}
+		return data.Snapshot{}, fmt.Errorf("%w: at %s", ErrSnapshotNotFound, at.Format(time.RFC3339))
+	}
+	return *found, nil
+}
+
+// settings.SnapshotID または settings.SnapshotTime で指定されたスナップショットの ID を返す。
+// どちらも指定されていない場合は最新の状態を表す 0 を返す。
+func resolveSnapshot(settings Settings) (uint64, error) {
+	if settings.SnapshotID == 0 && settings.SnapshotTime.IsZero() {
+		return 0, nil
+	}
+	snapshots, _, err := loadSnapshots(settings.SrcDir, settings.Password)
+	if err != nil { return 0, err }
+	snapshot, err := findSnapshot(snapshots, settings.SnapshotID, settings.SnapshotTime)
+	if err != nil { return 0, err }
+	return snapshot.ID, nil
+}
+
+// distDir に記録されたスナップショットの一覧を返す。
+func ListSnapshots(distDir string, password string) ([]data.Snapshot, error) {
+	snapshots, _, err := loadSnapshots(distDir, password)
+	return snapshots, err
+}
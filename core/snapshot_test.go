@@ -0,0 +1,178 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	
+	"bakashier/view"
+)
+
+
+func TestFindSnapshot(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2026, 1, 2, hour, 0, 0, 0, time.UTC) }
+	snapshots := testSnapshots(at(1), at(2), at(3), at(4))
+	snapshots[2].Complete = false
+	
+	tests := []struct {
+		name string
+		id   uint64
+		at   time.Time
+		want uint64
+	}{
+		{"by id", 2, time.Time{}, 2},
+		{"by id ignores the time", 1, at(4), 1},
+		{"exact time", 0, at(2), 2},
+		{"latest before the time", 0, at(2).Add(30 * time.Minute), 2},
+		{"incomplete snapshots are skipped", 0, at(3), 2},
+		{"after the latest", 0, at(9), 4},
+		{"incomplete id", 3, time.Time{}, 0},
+		{"unknown id", 9, time.Time{}, 0},
+		{"before the first", 0, at(0), 0},
+	}
+	for _, tt := range tests {
+		got, err := findSnapshot(snapshots, tt.id, tt.at)
+		if tt.want == 0 {
+			if !errors.Is(err, ErrSnapshotNotFound) {
+				t.Errorf("%s: got snapshot %d, %v, want ErrSnapshotNotFound", tt.name, got.ID, err)
+			}
+			continue
+		}
+		if err != nil || got.ID != tt.want {
+			t.Errorf("%s: got snapshot %d, %v, want %d", tt.name, got.ID, err, tt.want)
+		}
+	}
+}
+
+// スナップショットの写しは変更のあったディレクトリにのみ書かれるため、指定したスナップショット以前で最も新しい写しを選ぶことを確認する。
+func TestDirectoryEntryFileAt(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"_directory_.bks", snapshotEntryFileName(1), snapshotEntryFileName(3), "_directory_x_.bks"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil { t.Fatal(err) }
+	}
+	tests := []struct {
+		snapshot uint64
+		want     string
+	}{
+		{0, "_directory_.bks"},
+		{1, snapshotEntryFileName(1)},
+		{2, snapshotEntryFileName(1)},
+		{3, snapshotEntryFileName(3)},
+		{7, snapshotEntryFileName(3)},
+	}
+	for _, tt := range tests {
+		if got := directoryEntryFileAt(dir, tt.snapshot); got != filepath.Join(dir, tt.want) {
+			t.Errorf("snapshot %d: got %s, want %s", tt.snapshot, filepath.Base(got), tt.want)
+		}
+	}
+	
+	// 写しのないディレクトリ・存在しないディレクトリでは、存在しないパスを返す
+	empty := t.TempDir()
+	for _, path := range []string{directoryEntryFileAt(empty, 2), directoryEntryFileAt(filepath.Join(empty, "missing"), 2)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want a missing path", path, err)
+		}
+	}
+}
+
+// 2回のバックアップの後、スナップショットを ID・日時で指定して以前の状態を復元できることを確認する。
+// 2回目のバックアップは変更・削除されたファイルの以前のバージョンを削除せず、残した数を警告する。
+func TestRestoreSnapshotByIDAndTime(t *testing.T) {
+	src, dist := t.TempDir(), t.TempDir()
+	first := map[string]string{"a.txt": "first version", "b.txt": "deleted later", "sub/c.txt": "unchanged"}
+	writeTestFiles(t, src, first)
+	settings := testSettings(src, dist)
+	requireNoErrors(t, runTestMode(Backup, settings))
+	
+	// 更新日時の比較で変更を検出できるよう、時刻をずらして変更する
+	writeTestFiles(t, src, map[string]string{"a.txt": "second version", "d.txt": "added"})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(src, "a.txt"), later, later); err != nil { t.Fatal(err) }
+	if err := os.Remove(filepath.Join(src, "b.txt")); err != nil { t.Fatal(err) }
+	
+	dryRunSettings := settings
+	dryRunSettings.DryRun = true
+	messages := runTestMode(Backup, dryRunSettings)
+	requireNoErrors(t, messages)
+	if !hasPlan(messages, planRemove, filepath.Join(src, "b.txt")) {
+		t.Error("dry run does not list the removed file")
+	}
+	if warnings := warningDetails(messages); len(warnings) != 1 || !strings.Contains(warnings[0], "2 changed or removed entries would be kept") {
+		t.Errorf("dry run warnings: %q", warnings)
+	}
+	
+	messages = runTestMode(Backup, settings)
+	requireNoErrors(t, messages)
+	if warnings := warningDetails(messages); len(warnings) != 1 || !strings.Contains(warnings[0], "2 changed or removed entries are kept") {
+		t.Errorf("backup warnings: %q", warnings)
+	}
+	second := map[string]string{"a.txt": "second version", "d.txt": "added", "sub/c.txt": "unchanged"}
+	
+	snapshots, err := ListSnapshots(dist, settings.Password)
+	if err != nil { t.Fatal(err) }
+	if len(snapshots) != 2 || !snapshots[0].Complete || !snapshots[1].Complete {
+		t.Fatalf("got snapshots %+v", snapshots)
+	}
+	
+	restore := func(id uint64, at time.Time) (string, []view.MessageToView) {
+		restored := t.TempDir()
+		restoreSettings := testSettings(dist, restored)
+		restoreSettings.SnapshotID = id
+		restoreSettings.SnapshotTime = at
+		return restored, runTestMode(Restore, restoreSettings)
+	}
+	requireRestored := func(name string, restored string, messages []view.MessageToView, files map[string]string, missing string) {
+		t.Helper()
+		requireNoErrors(t, messages)
+		requireTestFiles(t, restored, files)
+		if _, err := os.Stat(filepath.Join(restored, missing)); !os.IsNotExist(err) {
+			t.Errorf("%s: %s was restored: %v", name, missing, err)
+		}
+	}
+	
+	restored, messages := restore(snapshots[0].ID, time.Time{})
+	requireRestored("first by id", restored, messages, first, "d.txt")
+	restored, messages = restore(0, snapshots[1].Time.Add(-time.Nanosecond))
+	requireRestored("first by time", restored, messages, first, "d.txt")
+	restored, messages = restore(snapshots[1].ID, time.Time{})
+	requireRestored("second by id", restored, messages, second, "b.txt")
+	restored, messages = restore(0, time.Time{})
+	requireRestored("latest", restored, messages, second, "b.txt")
+	
+	// 存在しないスナップショットは何も復元しない
+	restored, messages = restore(9, time.Time{})
+	if countErrors(messages, "Failed to resolve snapshot") != 1 {
+		t.Error("unknown snapshot was not reported")
+	}
+	if items, _ := os.ReadDir(restored); len(items) != 0 {
+		t.Errorf("restored %d entries for an unknown snapshot", len(items))
+	}
+	restored, messages = restore(0, snapshots[0].Time.Add(-time.Hour))
+	if countErrors(messages, "Failed to resolve snapshot") != 1 {
+		t.Error("time before the first snapshot was not reported")
+	}
+}
+
+// 実行予定に action の srcPath があるかを返す。
+func hasPlan(messages []view.MessageToView, action string, srcPath string) bool {
+	for _, msg := range messages {
+		if msg.MsgType == view.PLAN && msg.Detail == action && msg.SrcPath == srcPath {
+			return true
+		}
+	}
+	return false
+}
+
+func warningDetails(messages []view.MessageToView) []string {
+	var warnings []string
+	for _, msg := range messages {
+		if msg.MsgType == view.WARNING {
+			warnings = append(warnings, msg.Detail)
+		}
+	}
+	return warnings
+}
+
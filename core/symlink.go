@@ -0,0 +1,41 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	
+	"bakashier/data"
+)
+
+
+var errSymlinkLoop = errors.New("symlink loop")
+
+// info からバックアップするエントリの種類を返す。ディレクトリ・シンボリックリンク以外は通常のファイルとして扱う。
+func backupEntryType(info os.FileInfo) data.DirectoryEntryType {
+	if info.IsDir() {
+		return data.Directory
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return data.Symlink
+	}
+	return data.File
+}
+
+// dir のシンボリックリンク name を辿り、リンク先の情報を返す。
+// リンク先が settings.SrcDir から dir までのいずれかのディレクトリと同じ場合は、無限に辿らないよう errSymlinkLoop を返す。
+func followSymlink(settings Settings, dir string, name string) (os.FileInfo, error) {
+	info, err := os.Stat(filepath.Join(dir, name))
+	if err != nil { return nil, err }
+	if !info.IsDir() { return info, nil }
+	
+	root := filepath.Clean(settings.SrcDir)
+	for ancestor := filepath.Clean(dir); ; ancestor = filepath.Dir(ancestor) {
+		if ancestorInfo, err := os.Stat(ancestor); err == nil && os.SameFile(ancestorInfo, info) {
+			return nil, fmt.Errorf("%w: %s points to %s", errSymlinkLoop, name, ancestor)
+		}
+		if ancestor == root || ancestor == filepath.Dir(ancestor) { break }
+	}
+	return info, nil
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	
+	"bakashier/data"
+	"bakashier/utils"
+	"bakashier/view"
+)
+
+
+// ワーカーキューからジョブを受け取り、_directory_.bks と .bks ファイルを検証する。
+// SrcDir はバックアップ先の隠しディレクトリ、DistDir は結果表示用の実名の相対パスを表す。
+// すべてのチャンクを復号・展開して CRC32 を確認し、エントリと実ファイルの過不足も確認する。ディスクには何も書き込まない。
+func verifyWorker(workerId uint, settings Settings, toManagerQueue chan<- messageFromWorkerToManager, fromManagerQueue <-chan messageFromManagerToWorker, toViewQueue chan<- view.MessageToView, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var password = settings.Password
+	
+	toViewQueue <- view.MessageToView{
+		Source:   view.WORKER,
+		MsgType:  view.ADD_WORKER,
+		WorkerId: workerId,
+		Detail:   "",
+	}
+	
+	for {
+		queue := <-fromManagerQueue
+		if queue.MsgType == EXIT { break }
+		
+		// 検証結果をビューに通知する（err が nil なら成功）
+		var resultHandler = func(srcPath string, realPath string, err error) {
+			detail := ""
+			if err != nil {
+				detail = err.Error()
+			}
+			if realPath == "" {
+				realPath = "."
+			}
+			toViewQueue <- view.MessageToView{
+				Source:   view.WORKER,
+				MsgType:  view.RESULT,
+				WorkerId: workerId,
+				SrcPath:  srcPath,
+				DistPath: realPath,
+				Detail:   detail,
+			}
+		}
+		
+		// ディレクトリ処理開始をビューに通知
+		toViewQueue <- view.MessageToView{
+			Source:   view.WORKER,
+			MsgType:  view.START_DIR,
+			WorkerId: workerId,
+			SrcPath:  queue.SrcDir,
+			DistPath: queue.DistDir,
+			Detail:   "",
+		}
+		
+		func() {
+			// _directory_.bks からエントリ一覧を読み込む。
+			directoryEntryFile := directoryEntryFileAt(queue.SrcDir, settings.SnapshotID)
+			// 空のディレクトリには _directory_.bks が作成されないため、存在しない場合は空として扱う。
+			entries, err := readDirectoryEntries(directoryEntryFile, password)
+			if errors.Is(err, os.ErrNotExist) {
+				entries, err = []data.DirectoryEntry{}, nil
+			}
+			if err != nil {
+				resultHandler(directoryEntryFile, queue.DistDir, fmt.Errorf("failed to load directory entries: %w", err))
+				return
+			}
+			
+			// 検証を実行
+			known := make(map[string]bool)
+			for _, entry := range entries {
+				realPath := filepath.Join(queue.DistDir, entry.RealName)
+				if !utils.IsSafeFileName(entry.HideName) {
+					resultHandler(queue.SrcDir, realPath, fmt.Errorf("unsafe hide name %q", entry.HideName))
+					continue
+				}
+				if !utils.IsSafeFileName(entry.RealName) {
+					resultHandler(queue.SrcDir, realPath, fmt.Errorf("unsafe name %q", entry.RealName))
+				}
+				
+				switch entry.Type {
+				case data.Directory:
+					hiddenDir := filepath.Join(queue.SrcDir, entry.HideName)
+					known[entry.HideName] = true
+					if info, err := os.Stat(hiddenDir); err != nil || !info.IsDir() {
+						resultHandler(hiddenDir, realPath, fmt.Errorf("backup directory is missing"))
+						continue
+					}
+					
+					// 子ディレクトリの発見をディスパッチャに通知
+					toManagerQueue <- messageFromWorkerToManager{
+						WorkerId: workerId,
+						MsgType:  FIND_DIR,
+						SrcDir:   hiddenDir,
+						DistDir:  realPath,
+						Detail:   "",
+					}
+				case data.File:
+					archiveFile := entryContentPath(settings, queue.SrcDir, entry)
+					if !entry.Chunked {
+						known[entryArchiveName(entry)] = true
+					}
+					
+					// ファイル処理開始をビューに通知
+					toViewQueue <- view.MessageToView{
+						Source:   view.WORKER,
+						MsgType:  view.START_FILE,
+						WorkerId: workerId,
+						SrcPath:  archiveFile,
+						DistPath: realPath,
+						Detail:   "",
+					}
+					
+					resultHandler(archiveFile, realPath, verifyEntryContent(settings, queue.SrcDir, entry))
+					
+					// ファイル処理完了をビューに通知
+					toViewQueue <- view.MessageToView{
+						Source:   view.WORKER,
+						MsgType:  view.FINISH_FILE,
+						WorkerId: workerId,
+						SrcPath:  archiveFile,
+						DistPath: realPath,
+						Detail:   "",
+					}
+				case data.Symlink:
+					// リンク先はエントリ一覧に含まれ、検証するアーカイブはない
+					if entry.LinkTarget == "" {
+						resultHandler(queue.SrcDir, realPath, fmt.Errorf("symlink has no target"))
+					}
+				case data.Hardlink:
+					// 参照先のアーカイブの内容は、参照先のファイルのエントリで検証する
+					dir, target, err := resolveHardlinkEntry(settings, entry.LinkTarget)
+					if err != nil {
+						resultHandler(queue.SrcDir, realPath, err)
+					} else if !entryContentExists(settings, dir, target) {
+						resultHandler(entryContentPath(settings, dir, target), realPath, fmt.Errorf("hard link archive is missing"))
+					}
+				default:
+					resultHandler(queue.SrcDir, realPath, fmt.Errorf("unknown entry type %v", entry.Type))
+				}
+			}
+			
+			// エントリに存在しないファイルを検出する
+			items, err := os.ReadDir(queue.SrcDir)
+			if err != nil {
+				resultHandler(queue.SrcDir, queue.DistDir, fmt.Errorf("failed to read backup directory: %w", err))
+				return
+			}
+			var referenced map[string]bool
+			for _, item := range items {
+				if known[item.Name()] { continue }
+				if item.IsDir() && item.Name() == data.ChunkStoreDirName && queue.SrcDir == settings.SrcDir { continue }
+				itemPath := filepath.Join(queue.SrcDir, item.Name())
+				name := strings.ToLower(item.Name())
+				if !item.IsDir() && name == "_journal_.bks" {
+					resultHandler(itemPath, queue.DistDir, fmt.Errorf("backup was interrupted (journal exists)"))
+					continue
+				}
+				if !item.IsDir() && strings.HasPrefix(name, "_") && strings.HasSuffix(name, "_.bks") {
+					continue
+				}
+				
+				// 他のスナップショットから参照されているアーカイブは孤立したファイルとみなさない
+				if referenced == nil {
+					referenced, err = referencedNames(queue.SrcDir, password)
+					if err != nil {
+						resultHandler(queue.SrcDir, queue.DistDir, fmt.Errorf("failed to load snapshot directory entries: %w", err))
+						return
+					}
+				}
+				if referenced[item.Name()] { continue }
+				resultHandler(itemPath, filepath.Join(queue.DistDir, item.Name()), fmt.Errorf("orphan file not referenced by any snapshot"))
+			}
+		}()
+		
+		// ディレクトリ処理完了をビューに通知
+		toViewQueue <- view.MessageToView{
+			Source:   view.WORKER,
+			MsgType:  view.FINISH_DIR,
+			WorkerId: workerId,
+			SrcPath:  queue.SrcDir,
+			DistPath: queue.DistDir,
+			Detail:   "",
+		}
+		
+		// ディレクトリ処理完了をディスパッチャに通知
+		toManagerQueue <- messageFromWorkerToManager{
+			WorkerId: workerId,
+			MsgType:  FINISH_JOB,
+			SrcDir:   queue.SrcDir,
+			DistDir:  queue.DistDir,
+			Detail:   "",
+		}
+	}
+}
+
+// settings.SrcDir（バックアップ先）のすべてのアーカイブを、復元せずに検証する。
+// 走査は復元と同じであるため restoreManager を使用し、複数のワーカーでジョブを分配する。
+func Verify(settings Settings, toViewQueue chan<- view.MessageToView, fromViewQueue <-chan view.MessageToManager) {
+	var wg sync.WaitGroup
+	
+	// 対象のスナップショットを決定する
+	snapshot, err := resolveSnapshot(settings)
+	if err != nil {
+		sendFatalError(toViewQueue, "Failed to resolve snapshot", err)
+		return
+	}
+	settings.SnapshotID = snapshot
+	
+	// チャンクストアに格納されたファイルを読むため、チャンクストアがあれば開く
+	settings.chunkStore, err = openChunkStore(settings, settings.SrcDir, false)
+	if err != nil {
+		sendFatalError(toViewQueue, "Failed to open chunk store", err)
+		return
+	}
+	
+	// パックアーカイブの鍵は、この実行の間だけ保持する
+	settings.packReader = data.NewPackReader(settings.Password)
+	
+	workers := settings.Workers
+	queueSize := workers * 8
+	if workers <= 0 {
+		workers = 1
+		queueSize = 8
+	}
+	
+	workerToManagerQueue := make(chan messageFromWorkerToManager, queueSize)
+	managerToWorkerQueue := make(chan messageFromManagerToWorker, queueSize)
+	
+	workerToManagerQueue <- messageFromWorkerToManager{
+		MsgType: FIND_DIR,
+		SrcDir:  settings.SrcDir,
+		DistDir: "",
+		Detail:  "",
+	}
+	
+	wg.Add(int(workers) + 1)
+	go restoreManager(workers, workerToManagerQueue, managerToWorkerQueue, toViewQueue, fromViewQueue, nil, &wg)
+	for i := uint(0); i < uint(workers); i++ {
+		go verifyWorker(i+1, settings, workerToManagerQueue, managerToWorkerQueue, toViewQueue, &wg)
+	}
+	wg.Wait()
+	
+	close(workerToManagerQueue)
+	close(managerToWorkerQueue)
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	
+	"bakashier/view"
+)
+
+
+// 検証に失敗した結果を、表示用の実名のパスをキーにして返す。
+func failedResults(messages []view.MessageToView) map[string]string {
+	failed := make(map[string]string)
+	for _, msg := range messages {
+		if msg.MsgType == view.RESULT && msg.Detail != "" {
+			failed[msg.DistPath] = msg.Detail
+		}
+	}
+	return failed
+}
+
+// 壊れたアーカイブ・孤立したファイル・中断されたバックアップのジャーナルを、それぞれ検証の失敗として報告することを確認する。
+func TestVerifyReportsDamage(t *testing.T) {
+	src, dist := t.TempDir(), t.TempDir()
+	writeTestFiles(t, src, map[string]string{"a.txt": strings.Repeat("alpha ", 1000), "sub/b.txt": "bravo"})
+	requireNoErrors(t, runTestMode(Backup, testSettings(src, dist)))
+	
+	verifySettings := testSettings(dist, "")
+	messages := runTestMode(Verify, verifySettings)
+	requireNoErrors(t, messages)
+	if failed := failedResults(messages); len(failed) != 0 {
+		t.Fatalf("intact backup failed verification: %v", failed)
+	}
+	
+	// a.txt のアーカイブの中央の1バイトを書き換える
+	entries, err := loadDirectoryEntries(filepath.Join(dist, "_directory_.bks"), verifySettings.Password)
+	if err != nil { t.Fatal(err) }
+	corrupted := false
+	for _, entry := range entries {
+		if entry.RealName != "a.txt" { continue }
+		archiveFile := filepath.Join(dist, entryArchiveName(entry))
+		content, err := os.ReadFile(archiveFile)
+		if err != nil { t.Fatal(err) }
+		content[len(content)/2] ^= 0xFF
+		if err := os.WriteFile(archiveFile, content, 0644); err != nil { t.Fatal(err) }
+		corrupted = true
+	}
+	if !corrupted {
+		t.Fatal("a.txt is not in the backup")
+	}
+	if err := os.WriteFile(filepath.Join(dist, "stray.bks"), []byte("stray"), 0644); err != nil { t.Fatal(err) }
+	if err := os.WriteFile(filepath.Join(dist, "_journal_.bks"), []byte("journal"), 0644); err != nil { t.Fatal(err) }
+	
+	failed := failedResults(runTestMode(Verify, verifySettings))
+	want := map[string]string{
+		"a.txt":     "",
+		"stray.bks": "orphan file",
+		".":         "backup was interrupted",
+	}
+	for path, detail := range want {
+		got, ok := failed[path]
+		if !ok {
+			t.Errorf("%s did not fail verification", path)
+		} else if !strings.Contains(got, detail) {
+			t.Errorf("%s: got %q, want %q", path, got, detail)
+		}
+	}
+	if len(failed) != len(want) {
+		t.Errorf("got failures %v, want only %v", failed, want)
+	}
+}
@@ -4,8 +4,31 @@ import (
 	"encoding/binary"
 	"errors"
 	"os"
+	
+	"bakashier/utils"
+)
+
+
+// .bks のフォーマットバージョン。
+const (
+	ArchiveVersion1 uint16 = 1 // 名前・チャンクごとにソルトを持ち、都度鍵を導出する
+	ArchiveVersion2 uint16 = 2 // ヘッダーにソルトと KDF パラメータを持ち、鍵を1度だけ導出する
+	ArchiveVersion3 uint16 = 3 // v2 に加え、チャンク数を持ち、チャンク順序と HideName を関連データで認証する
+	ArchiveVersion4 uint16 = 4 // v3 に加え、末尾にチャンクごとの平文の SHA-256 を持つ。チャンクは番号のみを認証し、差分更新で再利用できる
+	ArchiveVersion5 uint16 = 5 // v4 に加え、末尾にファイルサイズとホールの範囲を持つ。チャンクはホールを除いたデータのみを持つ
 )
 
+// v2 の KDF ヘッダー: Type(1) + Salt(16) + Time(4) + Memory(4) + Threads(1) = 26
+const kdfHeaderSize = 1 + utils.SaltSize + 4 + 4 + 1
+
+// 関連データの種類。
+const (
+	associatedName   byte = 'N'
+	associatedChunk  byte = 'C'
+	associatedBlock  byte = 'B'
+	associatedDigest byte = 'H'
+	associatedPacked byte = 'P'
+)
 
 type ArchiveEntry struct {
 	Data []byte
@@ -14,56 +37,174 @@ type ArchiveEntry struct {
 
 // アーカイブ内の「名前」と「データ」の生バイトを保持する。
 // 実体は暗号化・圧縮された内容であり、FromArchiveData で復号・展開する。
+// Version が 2 以上の場合は KDF の鍵で、1 の場合はエントリごとのソルトで暗号化されている。
+// Version が 3 の場合は HideName とチャンク数・順序が関連データとして認証されている。
 type ArchiveData struct {
-	Name ArchiveEntry
-	Data []ArchiveEntry
+	Version    uint16
+	KDF        utils.KDFParams
+	ChunkCount uint64
+	Name       ArchiveEntry
+	Data       []ArchiveEntry
 }
 
 var ImportArchiveTooShort = errors.New("file is too short")
 var ImportArchiveNotValid = errors.New("file is not a valid archived file")
 var ImportArchiveUnsupportedVersion = errors.New("unsupported version number")
+var ImportArchiveChunkMismatch = errors.New("archive chunks are missing, reordered or tampered")
+var ImportArchiveNameMismatch = errors.New("archive name authentication failed (wrong password or archive moved from another entry)")
+
+// AES-GCM の関連データを生成する。
+// 形式: kind(1) + HideNameLen(4) + HideName + index(8) + total(8) + final(1)
+func associatedData(kind byte, hideName string, index uint64, total uint64) []byte {
+	ad := make([]byte, 0, 1+4+len(hideName)+8+8+1)
+	ad = append(ad, kind)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(hideName)))
+	ad = append(ad, hideName...)
+	ad = binary.BigEndian.AppendUint64(ad, index)
+	ad = binary.BigEndian.AppendUint64(ad, total)
+	if kind == associatedChunk && index+1 == total {
+		ad = append(ad, 1)
+	} else {
+		ad = append(ad, 0)
+	}
+	return ad
+}
+
+// v4 のチャンクの関連データを生成する。
+// チャンクを別の HideName・チャンク数のアーカイブでも再利用できるよう、番号のみを認証する。
+// HideName とチャンク数は、末尾の SHA-256 の一覧の関連データで認証する。
+// 形式: kind(1) + index(8)
+func blockAssociatedData(index uint64) []byte {
+	ad := make([]byte, 0, 1+8)
+	ad = append(ad, associatedBlock)
+	ad = binary.BigEndian.AppendUint64(ad, index)
+	return ad
+}
+
+// KDF パラメータを v2 ヘッダーのバイト列に変換する。
+func encodeKDFHeader(params utils.KDFParams) []byte {
+	header := make([]byte, kdfHeaderSize)
+	header[0] = byte(params.Type)
+	copy(header[1:1+utils.SaltSize], params.Salt)
+	binary.BigEndian.PutUint32(header[1+utils.SaltSize:5+utils.SaltSize], params.Time)
+	binary.BigEndian.PutUint32(header[5+utils.SaltSize:9+utils.SaltSize], params.Memory)
+	header[9+utils.SaltSize] = params.Threads
+	return header
+}
+
+// v2 ヘッダーのバイト列から KDF パラメータを取り出す。
+// 不正なヘッダーによるメモリ枯渇や長時間の停止を防ぐため、上限を超えるパラメータは拒否する。
+func decodeKDFHeader(header []byte) (utils.KDFParams, error) {
+	if len(header) < kdfHeaderSize { return utils.KDFParams{}, ImportArchiveTooShort }
+	salt := make([]byte, utils.SaltSize)
+	copy(salt, header[1:1+utils.SaltSize])
+	params := utils.KDFParams{
+		Type:    utils.KDFType(header[0]),
+		Salt:    salt,
+		Time:    binary.BigEndian.Uint32(header[1+utils.SaltSize : 5+utils.SaltSize]),
+		Memory:  binary.BigEndian.Uint32(header[5+utils.SaltSize : 9+utils.SaltSize]),
+		Threads: header[9+utils.SaltSize],
+	}
+	switch params.Type {
+	case utils.KDFPBKDF2SHA256:
+		if params.Time == 0 || params.Time > utils.MaxPBKDF2Iterations { return utils.KDFParams{}, ImportArchiveNotValid }
+	case utils.KDFArgon2id:
+		if params.Time == 0 || params.Time > utils.MaxArgon2Time { return utils.KDFParams{}, ImportArchiveNotValid }
+		if params.Threads == 0 || params.Memory < 8*uint32(params.Threads) || params.Memory > utils.MaxArgon2Memory { return utils.KDFParams{}, ImportArchiveNotValid }
+	default:
+		return utils.KDFParams{}, ImportArchiveNotValid
+	}
+	return params, nil
+}
 
 // fileName の .bks ファイルを読み、ヘッダー検証と CRC32 チェック後に d に格納する。
-// フォーマット: "BKS" + version(2) + nameLen(4) + name + CRC32(4) + dataLen(8) + data + CRC32(4) + dataLen(8) + data + CRC32(4) + ...
+// v1: "BKS" + version(2) + nameLen(4) + name + CRC32(4) + dataLen(8) + data + CRC32(4) + dataLen(8) + data + CRC32(4) + ...
+// v2: "BKS" + version(2) + KDF(26) + nameLen(4) + name + CRC32(4) + dataLen(8) + data + CRC32(4) + ...
+// v3: "BKS" + version(2) + KDF(26) + chunkCount(8) + nameLen(4) + name + CRC32(4) + dataLen(8) + data + CRC32(4) + ...
 func (d *ArchiveData) Import(fileName string) error {
 	content, err := os.ReadFile(fileName)
 	if err != nil { return err }
-	if len(content) < 9 { return ImportArchiveTooShort }
-	if content[0] != byte('B') || content[1] != byte('K') || content[2] != byte('S') { return ImportArchiveNotValid }
-	if binary.BigEndian.Uint16(content[3:5]) != 1 { return ImportArchiveUnsupportedVersion }
+	archive, err := parseArchiveData(content)
+	if err != nil { return err }
+	*d = archive
+	return nil
+}
+
+// .bks のバイト列をパースする。すべての長さフィールドを残りの入力長と照合し、
+// 不正な入力に対しては panic せず ImportArchive* のエラーを返す。
+func parseArchiveData(content []byte) (ArchiveData, error) {
+	var d ArchiveData
+	var err error
+	if len(content) < 5 { return ArchiveData{}, ImportArchiveTooShort }
+	if content[0] != byte('B') || content[1] != byte('K') || content[2] != byte('S') { return ArchiveData{}, ImportArchiveNotValid }
+	
+	d.Version = binary.BigEndian.Uint16(content[3:5])
+	content = content[5:]
+	switch d.Version {
+	case ArchiveVersion1:
+	case ArchiveVersion2, ArchiveVersion3:
+		d.KDF, err = decodeKDFHeader(content)
+		if err != nil { return ArchiveData{}, err }
+		content = content[kdfHeaderSize:]
+		if d.Version == ArchiveVersion3 {
+			if len(content) < 8 { return ArchiveData{}, ImportArchiveTooShort }
+			d.ChunkCount = binary.BigEndian.Uint64(content[0:8])
+			content = content[8:]
+		}
+	default:
+		return ArchiveData{}, ImportArchiveUnsupportedVersion
+	}
 	
-	archived_name_len := binary.BigEndian.Uint32(content[5:9])
-	name_end := 9 + uint32(archived_name_len)
+	// 名前
+	if len(content) < 4 { return ArchiveData{}, ImportArchiveTooShort }
+	archived_name_len := uint64(binary.BigEndian.Uint32(content[0:4]))
+	content = content[4:]
+	if archived_name_len+4 > uint64(len(content)) { return ArchiveData{}, ImportArchiveTooShort }
 	d.Name = ArchiveEntry{
-		Data: content[9:name_end],
-		Hash: content[name_end:name_end+4],
+		Data: content[:archived_name_len],
+		Hash: content[archived_name_len:archived_name_len+4],
 	}
+	content = content[archived_name_len+4:]
 	
-	data_start := uint64(name_end) + 4
-	for data_start < uint64(len(content)) {
-		data_len := binary.BigEndian.Uint64(content[data_start:data_start+8])
-		data_end := data_start + 8 + uint64(data_len)
+	// データ
+	for len(content) > 0 {
+		if len(content) < 8 { return ArchiveData{}, ImportArchiveTooShort }
+		data_len := binary.BigEndian.Uint64(content[0:8])
+		content = content[8:]
+		if data_len > uint64(len(content)) || uint64(len(content))-data_len < 4 { return ArchiveData{}, ImportArchiveTooShort }
 		d.Data = append(d.Data, ArchiveEntry{
-			Data: content[data_start+8:data_end],
-			Hash: content[data_end:data_end+4],
+			Data: content[:data_len],
+			Hash: content[data_len:data_len+4],
 		})
-		data_start = data_end + 4
+		content = content[data_len+4:]
 	}
-	return nil
+	if d.Version == ArchiveVersion3 && uint64(len(d.Data)) != d.ChunkCount { return ArchiveData{}, ImportArchiveChunkMismatch }
+	return d, nil
 }
 
 // d の内容を .bks 形式で fileName に書き出す。name/data の後に CRC32 を付加する。
+// 一時ファイルに書き込んでから置き換えるため、書き込み中に中断されても既存の fileName は壊れない。
 func (d ArchiveData) Export(fileName string) error {
 	var content []byte
 	var version_bin = make([]byte, 2)
 	var archived_name_len_bin  = make([]byte, 4)
 	var archived_data_len_bin  = make([]byte, 8)
-	binary.BigEndian.PutUint16(version_bin, 1)
+	version := d.Version
+	if version == 0 {
+		version = ArchiveVersion1
+	}
+	binary.BigEndian.PutUint16(version_bin, version)
 	
 	content = append(content, byte('B'))
 	content = append(content, byte('K'))
 	content = append(content, byte('S'))
 	content = append(content, version_bin...)
+	if version >= ArchiveVersion2 {
+		content = append(content, encodeKDFHeader(d.KDF)...)
+	}
+	if version >= ArchiveVersion3 {
+		content = binary.BigEndian.AppendUint64(content, d.ChunkCount)
+	}
 	
 	// 名前
 	binary.BigEndian.PutUint32(archived_name_len_bin, uint32(len(d.Name.Data)))
@@ -79,5 +220,5 @@ func (d ArchiveData) Export(fileName string) error {
 		content = append(content, data.Hash...)
 	}
 	
-	return os.WriteFile(fileName, content, 0644)
+	return utils.WriteFileAtomic(fileName, content, 0644)
 }
@@ -0,0 +1,67 @@
+package data
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+// ArchiveData を書き出したバイト列を返す。
+func encodeTestArchiveData(t testing.TB, archive ArchiveData) []byte {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "archive.bks")
+	if err := archive.Export(fileName); err != nil { t.Fatal(err) }
+	content, err := os.ReadFile(fileName)
+	if err != nil { t.Fatal(err) }
+	return content
+}
+
+// 任意の入力に対して parseArchiveData が panic せず、受け付けた入力は書き出すと同じバイト列に戻ることを確認する。
+func FuzzParseArchiveData(f *testing.F) {
+	chunks := [][]byte{[]byte("first"), []byte("second")}
+	for _, version := range []uint16{ArchiveVersion1, ArchiveVersion2, ArchiveVersion3} {
+		f.Add(encodeTestArchiveData(f, testArchiveData(f, version, "name", "hide-name", chunks)))
+	}
+	// v4・v5 はストリームアーカイブのみのバージョンのため、未対応として拒否する
+	for _, version := range []uint16{ArchiveVersion4, ArchiveVersion5} {
+		f.Add(testStreamArchive(f, version, "name", "hide-name", chunks))
+	}
+	f.Add([]byte("BKS"))
+	
+	f.Fuzz(func(t *testing.T, content []byte) {
+		archive, err := parseArchiveData(content)
+		if err != nil { return }
+		if archive.Version < ArchiveVersion1 || archive.Version > ArchiveVersion3 {
+			t.Fatalf("accepted version %d", archive.Version)
+		}
+		if !bytes.Equal(encodeTestArchiveData(t, archive), content) {
+			t.Fatal("re-encoded archive differs from the input")
+		}
+	})
+}
+
+// 途中で切れた入力と未対応のバージョンを拒否することを確認する。
+func TestParseArchiveDataRejectsTruncated(t *testing.T) {
+	chunks := [][]byte{[]byte("first"), []byte("second")}
+	for _, version := range []uint16{ArchiveVersion1, ArchiveVersion2, ArchiveVersion3} {
+		content := encodeTestArchiveData(t, testArchiveData(t, version, "name", "hide-name", chunks))
+		if _, err := parseArchiveData(content); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		for n := 0; n < len(content); n++ {
+			archive, err := parseArchiveData(content[:n])
+			// v1・v2 はチャンク数を持たないため、チャンクの境界で切れた入力は受け付ける
+			if err == nil && (version == ArchiveVersion3 || len(archive.Data) == len(chunks)) {
+				t.Fatalf("v%d: accepted a prefix of %d bytes", version, n)
+			}
+		}
+	}
+	for _, version := range []uint16{ArchiveVersion4, ArchiveVersion5} {
+		content := testStreamArchive(t, version, "name", "hide-name", chunks)
+		if _, err := parseArchiveData(content); err != ImportArchiveUnsupportedVersion {
+			t.Fatalf("v%d: got %v", version, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+
+var ErrSourceFileChanged = errors.New("source file changed while it was being read")
+
+// ソースを chunkSize ごとに読み出す。io.ReadFull で読み込むため、短い読み込みが起きても
+// チャンクは実際に読んだバイトだけで構成され、ゼロ埋めされることはない。
+type chunkReader struct {
+	src io.Reader
+	buf []byte
+}
+
+func newChunkReader(src io.Reader, chunkSize uint64) *chunkReader {
+	return &chunkReader{
+		src: src,
+		buf: make([]byte, chunkSize),
+	}
+}
+
+// 次のチャンクを返す。読み終えた場合は io.EOF を返す。
+// 戻り値のスライスは次の呼び出しで上書きされる。
+func (r *chunkReader) Next() ([]byte, error) {
+	n, err := io.ReadFull(r.src, r.buf)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return r.buf[:n], nil
+}
+
+// 読み込み前の情報 before と読み込み後のファイルを比較し、読み込み中に変更されていないかを確認する。
+// サイズが変わった、更新日時が変わった、または読み込んだバイト数が一致しない場合は ErrSourceFileChanged を返す。
+func checkSourceUnchanged(src *os.File, before os.FileInfo, readBytes uint64) error {
+	if readBytes != uint64(before.Size()) {
+		return ErrSourceFileChanged
+	}
+	
+	// 末尾以降にデータが追記されていないか
+	if n, _ := src.Read(make([]byte, 1)); n > 0 {
+		return ErrSourceFileChanged
+	}
+	
+	after, err := src.Stat()
+	if err != nil { return err }
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return ErrSourceFileChanged
+	}
+	return nil
+}
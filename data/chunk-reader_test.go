@@ -0,0 +1,68 @@
+package data
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+
+// 読み込みの前後でファイルが伸びた・縮んだ・書き換えられた場合に、checkSourceUnchanged が ErrSourceFileChanged を返すことを確認する。
+func TestCheckSourceUnchanged(t *testing.T) {
+	appendBytes := func(t *testing.T, path string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil { t.Fatal(err) }
+		defer f.Close()
+		if _, err := f.Write([]byte("appended")); err != nil { t.Fatal(err) }
+	}
+	tests := []struct {
+		name       string
+		beforeRead func(t *testing.T, path string) // 情報を取得してから読み込むまでの変更
+		afterRead  func(t *testing.T, path string) // 読み込んでから確認するまでの変更
+		want       error
+	}{
+		{name: "unchanged", want: nil},
+		{name: "grown before read", beforeRead: appendBytes, want: ErrSourceFileChanged},
+		{name: "shrunk before read", beforeRead: func(t *testing.T, path string) {
+			if err := os.Truncate(path, 100); err != nil { t.Fatal(err) }
+		}, want: ErrSourceFileChanged},
+		{name: "grown after read", afterRead: appendBytes, want: ErrSourceFileChanged},
+		{name: "rewritten with the same size", afterRead: func(t *testing.T, path string) {
+			writeRandomFile(t, path, 1000, 2)
+			later := time.Now().Add(time.Hour)
+			if err := os.Chtimes(path, later, later); err != nil { t.Fatal(err) }
+		}, want: ErrSourceFileChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "src")
+			writeRandomFile(t, path, 1000, 1)
+			src, err := os.Open(path)
+			if err != nil { t.Fatal(err) }
+			defer src.Close()
+			before, err := src.Stat()
+			if err != nil { t.Fatal(err) }
+			
+			if tt.beforeRead != nil {
+				tt.beforeRead(t, path)
+			}
+			// 伸びていても縮んでいても読めるだけ読み込む。伸びていない場合は stat のサイズまで読み込む
+			var reader io.Reader = src
+			if tt.beforeRead == nil {
+				reader = io.LimitReader(src, before.Size())
+			}
+			content, err := io.ReadAll(reader)
+			if err != nil { t.Fatal(err) }
+			if tt.afterRead != nil {
+				tt.afterRead(t, path)
+			}
+			
+			if err := checkSourceUnchanged(src, before, uint64(len(content))); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	
+	"bakashier/utils"
+)
+
+
+// バックアップ先のルートに置くチャンクストアのディレクトリ名。
+const ChunkStoreDirName = "_chunks_"
+
+// チャンクストアの鍵のファイル名と、関連データとして認証する名前。
+const chunkStoreKeyFileName = "_key_.bks"
+const chunkStoreKeyHideName = "_chunks_"
+
+// チャンクファイルのフォーマットバージョン。
+const ChunkVersion1 uint16 = 1
+
+// チャンク ID（平文の HMAC-SHA256）のバイト数。
+const ChunkIDSize = sha256.Size
+
+// 有効なチャンクファイルの最小のバイト数: "BKC" + version(2) + nonce(12) + 空の平文を圧縮したデータ(8) + タグ(16)
+const chunkFileMinSize = 5 + 12 + 8 + 16
+
+var ErrChunkStoreNotFound = errors.New("chunk store not found")
+var ErrChunkMismatch = errors.New("chunk is tampered or does not match its ID")
+
+// 内容アドレスで重複を排除する、暗号化されたチャンクストア。
+// チャンクは鍵付きハッシュ（HMAC-SHA256）の ID で <dir>/<ID の先頭2文字>/<ID>.bks に1度だけ保存する。
+// 鍵はリポジトリごとに乱数で生成し、パスワードで暗号化して _key_.bks に保存する。
+// チャンクの書き込みは一時ファイルからのリネームで行うため、複数のワーカーから同時に使用できる。
+type ChunkStore struct {
+	dir    string
+	idKey  []byte      // チャンク ID の鍵
+	encKey []byte      // チャンクの暗号化の鍵
+	gear   [256]uint64 // 内容で区切るためのローリングハッシュの表
+}
+
+// dir のチャンクストアを開く。create が true で dir に鍵がない場合は、新しい鍵を生成してチャンクストアを作成する。
+// 鍵がなく create が false の場合は ErrChunkStoreNotFound を返す。
+func OpenChunkStore(dir string, password string, kdf utils.KDFParams, create bool) (*ChunkStore, error) {
+	keyFile := filepath.Join(dir, chunkStoreKeyFileName)
+	var archive ArchiveData
+	err := archive.Import(keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		if !create { return nil, ErrChunkStoreNotFound }
+		return createChunkStore(dir, password, kdf)
+	}
+	if err != nil { return nil, err }
+	_, masterKey, err := FromArchiveData(archive, chunkStoreKeyHideName, password)
+	if err != nil { return nil, err }
+	if len(masterKey) != utils.KeySize { return nil, ImportArchiveNotValid }
+	return newChunkStore(dir, masterKey), nil
+}
+
+func createChunkStore(dir string, password string, kdf utils.KDFParams) (*ChunkStore, error) {
+	masterKey := make([]byte, utils.KeySize)
+	if _, err := io.ReadFull(rand.Reader, masterKey); err != nil { return nil, err }
+	if err := os.MkdirAll(dir, 0755); err != nil { return nil, err }
+	archive, err := ToArchiveData(chunkStoreKeyFileName, chunkStoreKeyHideName, masterKey, password, kdf)
+	if err != nil { return nil, err }
+	if err := archive.Export(filepath.Join(dir, chunkStoreKeyFileName)); err != nil { return nil, err }
+	return newChunkStore(dir, masterKey), nil
+}
+
+// 鍵から用途ごとの鍵とローリングハッシュの表を導出する。
+func newChunkStore(dir string, masterKey []byte) *ChunkStore {
+	derive := func(label []byte) []byte {
+		mac := hmac.New(sha256.New, masterKey)
+		mac.Write(label)
+		return mac.Sum(nil)
+	}
+	store := &ChunkStore{
+		dir:    dir,
+		idKey:  derive([]byte("chunk id")),
+		encKey: derive([]byte("chunk encryption")),
+	}
+	for i := range store.gear {
+		store.gear[i] = binary.BigEndian.Uint64(derive([]byte{'g', 'e', 'a', 'r', byte(i)}))
+	}
+	return store
+}
+
+// チャンクの平文から ID を計算する。
+func (s *ChunkStore) chunkID(chunk []byte) []byte {
+	mac := hmac.New(sha256.New, s.idKey)
+	mac.Write(chunk)
+	return mac.Sum(nil)
+}
+
+// チャンク ID のファイルのパスを返す。
+func (s *ChunkStore) chunkPath(id []byte) string {
+	name := hex.EncodeToString(id)
+	return filepath.Join(s.dir, name[:2], name+".bks")
+}
+
+// チャンクの関連データを生成する。形式: kind(1) + ID(32)
+func chunkAssociatedData(id []byte) []byte {
+	ad := make([]byte, 0, 1+len(id))
+	ad = append(ad, associatedChunk)
+	return append(ad, id...)
+}
+
+// チャンクを保存し、ID を返す。同じ ID のチャンクが既にある場合は書き込まない。
+// 既にあるチャンクファイルが最小のサイズに満たない場合は、壊れているものとして書き直す。
+// 形式: "BKC" + version(2) + 暗号化した圧縮済みの平文
+func (s *ChunkStore) putChunk(chunk []byte) ([]byte, error) {
+	id := s.chunkID(chunk)
+	path := s.chunkPath(id)
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Size() >= chunkFileMinSize {
+		return id, nil
+	}
+	compressed, err := utils.CompressBytes(chunk)
+	if err != nil { return nil, err }
+	encrypted, err := utils.EncryptBytesWithKey(compressed, s.encKey, chunkAssociatedData(id))
+	if err != nil { return nil, err }
+	
+	content := make([]byte, 0, 5+len(encrypted))
+	content = append(content, []byte("BKC")...)
+	content = binary.BigEndian.AppendUint16(content, ChunkVersion1)
+	content = append(content, encrypted...)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil { return nil, err }
+	if err := utils.WriteFileAtomic(path, content, 0644); err != nil { return nil, err }
+	return id, nil
+}
+
+// ID のチャンクを読み込んで復号・展開し、平文の ID を照合する。
+func (s *ChunkStore) getChunk(id []byte) ([]byte, error) {
+	if len(id) != ChunkIDSize { return nil, ErrChunkMismatch }
+	content, err := os.ReadFile(s.chunkPath(id))
+	if err != nil { return nil, err }
+	if len(content) < 5 { return nil, ImportArchiveTooShort }
+	if content[0] != byte('B') || content[1] != byte('K') || content[2] != byte('C') {
+		return nil, ImportArchiveNotValid
+	}
+	if binary.BigEndian.Uint16(content[3:5]) != ChunkVersion1 {
+		return nil, ImportArchiveUnsupportedVersion
+	}
+	decrypted, err := utils.DecryptBytesWithKey(content[5:], s.encKey, chunkAssociatedData(id))
+	if err != nil { return nil, ErrChunkMismatch }
+	chunk, err := utils.DecompressBytes(decrypted)
+	if err != nil { return nil, err }
+	if !hmac.Equal(s.chunkID(chunk), id) { return nil, ErrChunkMismatch }
+	return chunk, nil
+}
+
+// srcFile を内容で区切ってチャンクストアに保存し、チャンク ID の一覧と平文の SHA-256 を返す。
+// 読み込み中にファイルが変更された場合は ErrSourceFileChanged を返す。書き込んだチャンクは次回の整理で削除される。
+func (s *ChunkStore) ExportFile(srcFile string) ([][]byte, []byte, error) {
+	src, err := os.Open(srcFile)
+	if err != nil { return nil, nil, err }
+	defer src.Close()
+	fileInfo, err := src.Stat()
+	if err != nil { return nil, nil, err }
+	
+	chunker := newContentChunker(src, &s.gear)
+	checksum := sha256.New()
+	ids := [][]byte{}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF { break }
+		if err != nil { return nil, nil, err }
+		checksum.Write(chunk)
+		id, err := s.putChunk(chunk)
+		if err != nil { return nil, nil, err }
+		ids = append(ids, id)
+	}
+	
+	// 読み込み中にファイルが変更されていないかを確認する
+	if err := checkSourceUnchanged(src, fileInfo, chunker.ReadBytes()); err != nil {
+		return nil, nil, err
+	}
+	return ids, checksum.Sum(nil), nil
+}
+
+// チャンク ID の一覧のチャンクを順に復号・展開し、destFile に書き出す。
+func (s *ChunkStore) ImportFile(ids [][]byte, destFile string) error {
+	return s.readFile(ids, func() (io.WriteCloser, error) {
+		return os.Create(destFile)
+	})
+}
+
+// チャンク ID の一覧のすべてのチャンクを復号・展開して検証する。ファイルは書き出さない。
+func (s *ChunkStore) VerifyFile(ids [][]byte) error {
+	return s.readFile(ids, func() (io.WriteCloser, error) {
+		return nopWriteCloser{io.Discard}, nil
+	})
+}
+
+// チャンク ID の一覧のチャンクを復号・展開した内容が liveFile の内容と一致するかを比較する。ファイルは書き出さない。
+func (s *ChunkStore) CompareFile(ids [][]byte, liveFile string) (bool, error) {
+	live, err := os.Open(liveFile)
+	if err != nil { return false, err }
+	defer live.Close()
+	
+	comparer := &compareWriter{src: live, equal: true}
+	err = s.readFile(ids, func() (io.WriteCloser, error) {
+		return nopWriteCloser{comparer}, nil
+	})
+	if err != nil { return false, err }
+	
+	// チャンクより実ファイルが長い場合は不一致
+	if comparer.equal {
+		if n, _ := live.Read(make([]byte, 1)); n > 0 {
+			comparer.equal = false
+		}
+	}
+	return comparer.equal, nil
+}
+
+// チャンク ID の一覧のチャンクを順に読み込み、openDest で開いた書き出し先に書き込む。
+// 書き出し先を閉じる際のエラーも返し、最後の書き込みの失敗を見逃さないようにする。
+func (s *ChunkStore) readFile(ids [][]byte, openDest func() (io.WriteCloser, error)) error {
+	dest, err := openDest()
+	if err != nil { return err }
+	for _, id := range ids {
+		chunk, err := s.getChunk(id)
+		if err != nil {
+			dest.Close()
+			return err
+		}
+		if _, err := dest.Write(chunk); err != nil {
+			dest.Close()
+			return err
+		}
+	}
+	return dest.Close()
+}
+
+// チャンクストアに保存されているチャンクの一覧（[ID の16進文字列]パス）と、書き込みが中断された一時ファイルのパスを返す。
+func (s *ChunkStore) ListChunks() (map[string]string, []string, error) {
+	chunks := make(map[string]string)
+	temps := []string{}
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil { return nil, nil, err }
+	for _, dir := range dirs {
+		if !dir.IsDir() { continue }
+		items, err := os.ReadDir(filepath.Join(s.dir, dir.Name()))
+		if err != nil { return nil, nil, err }
+		for _, item := range items {
+			path := filepath.Join(s.dir, dir.Name(), item.Name())
+			if utils.IsTempFileName(item.Name()) {
+				temps = append(temps, path)
+				continue
+			}
+			name := strings.TrimSuffix(item.Name(), ".bks")
+			if id, err := hex.DecodeString(name); err == nil && len(id) == ChunkIDSize && strings.HasPrefix(name, dir.Name()) {
+				chunks[name] = path
+			}
+		}
+	}
+	return chunks, temps, nil
+}
+
+// チャンク ID を ListChunks のキーと同じ16進文字列に変換する。
+func ChunkIDString(id []byte) string {
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,128 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+func openTestChunkStore(t *testing.T, dir string, create bool) *ChunkStore {
+	t.Helper()
+	store, err := OpenChunkStore(dir, testPassword, testKDF, create)
+	if err != nil { t.Fatal(err) }
+	return store
+}
+
+// chunks の ID を ListChunks のキーの集合に変換する。
+func chunkIDSet(ids [][]byte) map[string]bool {
+	set := make(map[string]bool)
+	for _, id := range ids {
+		set[ChunkIDString(id)] = true
+	}
+	return set
+}
+
+// ファイルを格納して復元・検証・比較でき、同じ内容は重複して格納しないことを確認する。
+func TestChunkStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, ChunkStoreDirName)
+	if _, err := OpenChunkStore(storeDir, testPassword, testKDF, false); !errors.Is(err, ErrChunkStoreNotFound) {
+		t.Fatalf("missing store: got %v", err)
+	}
+	store := openTestChunkStore(t, storeDir, true)
+	
+	srcFile := filepath.Join(dir, "src")
+	// チャンクストアの鍵は作成ごとに異なり区切りの位置も変わるため、最大サイズを超えて必ず複数のチャンクになるようにする
+	content := writeRandomFile(t, srcFile, int(MaxContentChunkSize)+1024*1024, 4)
+	ids, checksum, err := store.ExportFile(srcFile)
+	if err != nil { t.Fatal(err) }
+	if len(ids) < 2 {
+		t.Fatalf("got %d chunks", len(ids))
+	}
+	if sum := sha256.Sum256(content); !bytes.Equal(checksum, sum[:]) {
+		t.Fatal("checksum mismatch")
+	}
+	chunks, temps, err := store.ListChunks()
+	if err != nil { t.Fatal(err) }
+	if len(chunks) != len(chunkIDSet(ids)) || len(temps) != 0 {
+		t.Fatalf("got %d chunks and %d temp files", len(chunks), len(temps))
+	}
+	
+	// 開き直したチャンクストアでも同じ ID になり、チャンクは増えない
+	reopened := openTestChunkStore(t, storeDir, false)
+	copyFile := filepath.Join(dir, "copy")
+	if err := os.WriteFile(copyFile, content, 0644); err != nil { t.Fatal(err) }
+	copyIDs, _, err := reopened.ExportFile(copyFile)
+	if err != nil { t.Fatal(err) }
+	if len(copyIDs) != len(ids) || !mapsEqual(chunkIDSet(copyIDs), chunkIDSet(ids)) {
+		t.Fatal("same content produced different chunks")
+	}
+	after, _, err := store.ListChunks()
+	if err != nil { t.Fatal(err) }
+	if len(after) != len(chunks) {
+		t.Fatalf("got %d chunks after storing the same content, want %d", len(after), len(chunks))
+	}
+	
+	destFile := filepath.Join(dir, "restored")
+	if err := reopened.ImportFile(ids, destFile); err != nil { t.Fatal(err) }
+	if restored := mustReadFile(t, destFile); !bytes.Equal(restored, content) {
+		t.Fatal("restored content mismatch")
+	}
+	if err := reopened.VerifyFile(ids); err != nil { t.Fatal(err) }
+	if equal, err := reopened.CompareFile(ids, srcFile); err != nil || !equal {
+		t.Fatalf("compare: %v, %v", equal, err)
+	}
+	content[len(content)-1] ^= 0xFF
+	if err := os.WriteFile(copyFile, content, 0644); err != nil { t.Fatal(err) }
+	if equal, err := reopened.CompareFile(ids, copyFile); err != nil || equal {
+		t.Fatalf("compare changed file: %v, %v", equal, err)
+	}
+	
+	if _, err := OpenChunkStore(storeDir, "wrong password", testKDF, false); err == nil {
+		t.Fatal("opened the chunk store with a wrong password")
+	}
+}
+
+// 途中で切れたチャンクファイルは次に同じチャンクを格納する際に書き直し、入れ替えたチャンクは検出することを確認する。
+func TestChunkStoreDamagedChunks(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestChunkStore(t, filepath.Join(dir, ChunkStoreDirName), true)
+	srcFile := filepath.Join(dir, "src")
+	writeRandomFile(t, srcFile, int(MaxContentChunkSize)+1024*1024, 5)
+	ids, _, err := store.ExportFile(srcFile)
+	if err != nil { t.Fatal(err) }
+	if len(ids) < 2 {
+		t.Fatalf("got %d chunks", len(ids))
+	}
+	
+	// 入れ替えたチャンクは ID と一致しない
+	first, second := store.chunkPath(ids[0]), store.chunkPath(ids[1])
+	firstContent, secondContent := mustReadFile(t, first), mustReadFile(t, second)
+	if err := os.WriteFile(first, secondContent, 0644); err != nil { t.Fatal(err) }
+	if err := store.VerifyFile(ids); !errors.Is(err, ErrChunkMismatch) {
+		t.Fatalf("swapped chunk: got %v", err)
+	}
+	if err := os.WriteFile(first, firstContent, 0644); err != nil { t.Fatal(err) }
+	
+	// 空になったチャンクは、同じ内容を格納し直すと書き直される
+	if err := os.Truncate(first, 0); err != nil { t.Fatal(err) }
+	if err := store.VerifyFile(ids); err == nil {
+		t.Fatal("truncated chunk was accepted")
+	}
+	if _, _, err := store.ExportFile(srcFile); err != nil { t.Fatal(err) }
+	if err := store.VerifyFile(ids); err != nil {
+		t.Fatalf("truncated chunk was not rewritten: %v", err)
+	}
+}
+
+func mapsEqual(a map[string]bool, b map[string]bool) bool {
+	if len(a) != len(b) { return false }
+	for key := range a {
+		if !b[key] { return false }
+	}
+	return true
+}
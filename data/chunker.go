@@ -0,0 +1,78 @@
+package data
+
+import (
+	"io"
+)
+
+
+// 内容で区切るチャンクの最小・平均・最大サイズ。
+const (
+	MinContentChunkSize uint64 = 512 * 1024      // 512KiB
+	AvgContentChunkSize uint64 = 1024 * 1024     // 1MiB
+	MaxContentChunkSize uint64 = 8 * 1024 * 1024 // 8MiB
+)
+
+// ローリングハッシュの上位 20 ビットがすべて 0 になる位置で区切る（平均 1MiB）。
+const contentChunkMask uint64 = ((1 << 20) - 1) << 44
+
+// ソースを内容に応じた位置で区切って読み出す（Gear ハッシュによる Content-Defined Chunking）。
+// 区切りの位置は直前の 64 バイトのみで決まるため、データの挿入・削除があってもそれ以外のチャンクは変わらない。
+// gear はリポジトリの鍵から生成し、区切りの位置からファイルの内容を推測されにくくする。
+type contentChunker struct {
+	src       io.Reader
+	gear      *[256]uint64
+	buf       []byte
+	start     int // buf 内の未処理のデータの先頭
+	end       int // buf 内の未処理のデータの末尾
+	eof       bool
+	readBytes uint64
+}
+
+func newContentChunker(src io.Reader, gear *[256]uint64) *contentChunker {
+	return &contentChunker{
+		src:  src,
+		gear: gear,
+		buf:  make([]byte, MaxContentChunkSize),
+	}
+}
+
+// 次のチャンクを返す。読み終えた場合は io.EOF を返す。
+// 戻り値のスライスは次の呼び出しで上書きされる。
+func (c *contentChunker) Next() ([]byte, error) {
+	// 未処理のデータを先頭に移し、最大サイズまで読み込む
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for !c.eof && c.end < len(c.buf) {
+		n, err := c.src.Read(c.buf[c.end:])
+		c.end += n
+		c.readBytes += uint64(n)
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+	
+	// 最小サイズ以降でハッシュが条件を満たす位置、または最大サイズで区切る
+	cut := c.end
+	var hash uint64 = 0
+	for i := 0; i < c.end; i++ {
+		hash = (hash << 1) + c.gear[c.buf[i]]
+		if uint64(i+1) >= MinContentChunkSize && hash&contentChunkMask == 0 {
+			cut = i + 1
+			break
+		}
+	}
+	c.start = cut
+	return c.buf[:cut], nil
+}
+
+// 読み込んだ合計バイト数を返す。
+func (c *contentChunker) ReadBytes() uint64 {
+	return c.readBytes
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+
+// 固定の鍵から作成したチャンクストアのローリングハッシュの表を返す。
+func testGear() *[256]uint64 {
+	store := newChunkStore("", bytes.Repeat([]byte{0x42}, 32))
+	return &store.gear
+}
+
+// content を内容で区切ったチャンクの一覧を返す。
+func contentChunks(t *testing.T, content []byte) [][]byte {
+	t.Helper()
+	chunker := newContentChunker(bytes.NewReader(content), testGear())
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF { break }
+		if err != nil { t.Fatal(err) }
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+	if chunker.ReadBytes() != uint64(len(content)) {
+		t.Fatalf("read %d bytes, want %d", chunker.ReadBytes(), len(content))
+	}
+	return chunks
+}
+
+func randomBytes(size int, seed int64) []byte {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+// チャンクが元の内容を順に構成し、最後のチャンクを除いて最小・最大サイズの範囲に収まることを確認する。
+func TestContentChunkerSizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"smaller than the minimum", randomBytes(1000, 1)},
+		{"random", randomBytes(12*1024*1024, 2)},
+		{"zeros", make([]byte, 20*1024*1024)},
+	}
+	for _, tt := range tests {
+		chunks := contentChunks(t, tt.content)
+		if !bytes.Equal(bytes.Join(chunks, nil), tt.content) {
+			t.Fatalf("%s: chunks do not reproduce the content", tt.name)
+		}
+		for i, chunk := range chunks {
+			size := uint64(len(chunk))
+			if size > MaxContentChunkSize || (i+1 < len(chunks) && size < MinContentChunkSize) || size == 0 {
+				t.Errorf("%s: chunk %d has %d bytes", tt.name, i, size)
+			}
+		}
+	}
+}
+
+// データを挿入・削除しても、変更した位置の前後以外のチャンクが変わらないことを確認する。
+func TestContentChunkerBoundaryStability(t *testing.T) {
+	original := randomBytes(16*1024*1024, 3)
+	offset := 7*1024*1024 + 123
+	inserted := append(append(append([]byte{}, original[:offset]...), []byte("inserted bytes")...), original[offset:]...)
+	removed := append(append([]byte{}, original[:offset]...), original[offset+5000:]...)
+	
+	originalChunks := contentChunks(t, original)
+	if len(originalChunks) < 8 {
+		t.Fatalf("got only %d chunks", len(originalChunks))
+	}
+	known := make(map[string]bool)
+	for _, chunk := range originalChunks {
+		known[string(chunk)] = true
+	}
+	for name, content := range map[string][]byte{"insert": inserted, "remove": removed} {
+		changed := 0
+		for _, chunk := range contentChunks(t, content) {
+			if !known[string(chunk)] {
+				changed++
+			}
+		}
+		// 変更を含むチャンクと、区切りが揃うまでの次のチャンクのみが変わる
+		if changed > 2 {
+			t.Errorf("%s: %d of %d chunks changed", name, changed, len(originalChunks))
+		}
+	}
+}
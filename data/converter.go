@@ -9,27 +9,37 @@ import (
 
 
 // ファイル名・ファイル内容・パスワードを受け取り、圧縮・暗号化した ArchiveData に変換する。
-func ToArchiveData(filename string, content []byte, password string) (ArchiveData, error) {
+// 鍵は kdf のパラメータでアーカイブごとに1度だけ導出し、hideName とチャンク順序を認証する v3 形式で返す。
+func ToArchiveData(filename string, hideName string, content []byte, password string, kdf utils.KDFParams) (ArchiveData, error) {
 	if password == "" {
 		return ArchiveData{}, errors.New("password is required")
 	}
 	
+	// 鍵導出
+	kdf, err := utils.NewKDFParams(kdf)
+	if err != nil { return ArchiveData{}, err }
+	key, err := utils.DeriveKey(password, kdf)
+	if err != nil { return ArchiveData{}, err }
+	
 	// 名前
 	nameBytes := []byte(filename)
 	nameHash := utils.CRC32HashBytes(nameBytes)
 	compressedName, err := utils.CompressBytes(nameBytes)
 	if err != nil { return ArchiveData{}, err }
-	encryptedName, err := utils.EncryptBytesWithPassword(compressedName, password)
+	encryptedName, err := utils.EncryptBytesWithKey(compressedName, key, associatedData(associatedName, hideName, 0, 1))
 	if err != nil { return ArchiveData{}, err }
 	
 	// データ
 	contentHash := utils.CRC32HashBytes(content)
 	compressedContent, err := utils.CompressBytes(content)
 	if err != nil { return ArchiveData{}, err }
-	encryptedContent, err := utils.EncryptBytesWithPassword(compressedContent, password)
+	encryptedContent, err := utils.EncryptBytesWithKey(compressedContent, key, associatedData(associatedChunk, hideName, 0, 1))
 	if err != nil { return ArchiveData{}, err }
 	
 	return ArchiveData{
+		Version:    ArchiveVersion3,
+		KDF:        kdf,
+		ChunkCount: 1,
 		Name: ArchiveEntry{
 			Data: encryptedName,
 			Hash: nameHash,
@@ -44,14 +54,37 @@ func ToArchiveData(filename string, content []byte, password string) (ArchiveDat
 }
 
 // ArchiveData とパスワードを受け取り、復号・展開してファイル名とファイル内容に戻す。
-func FromArchiveData(archive ArchiveData, password string) (filename string, content []byte, err error) {
+// v3 の場合は hideName とチャンク数・順序が作成時と一致することを検証する。
+func FromArchiveData(archive ArchiveData, hideName string, password string) (filename string, content []byte, err error) {
 	if password == "" {
 		return "", nil, errors.New("password is required")
 	}
 	
+	// バージョンに応じた復号関数
+	decrypt := func(cipherData []byte, additionalData []byte) ([]byte, error) {
+		return utils.DecryptBytesWithPassword(cipherData, password)
+	}
+	if archive.Version >= ArchiveVersion2 {
+		key, err := utils.DeriveKey(password, archive.KDF)
+		if err != nil { return "", nil, err }
+		decrypt = func(cipherData []byte, additionalData []byte) ([]byte, error) {
+			if archive.Version < ArchiveVersion3 {
+				additionalData = nil
+			}
+			return utils.DecryptBytesWithKey(cipherData, key, additionalData)
+		}
+	}
+	if archive.Version >= ArchiveVersion3 && uint64(len(archive.Data)) != archive.ChunkCount {
+		return "", nil, ImportArchiveChunkMismatch
+	}
+	total := uint64(len(archive.Data))
+	
 	// 名前
-	decryptedName, err := utils.DecryptBytesWithPassword(archive.Name.Data, password)
-	if err != nil { return "", nil, err }
+	decryptedName, err := decrypt(archive.Name.Data, associatedData(associatedName, hideName, 0, total))
+	if err != nil {
+		if archive.Version >= ArchiveVersion3 { return "", nil, ImportArchiveNameMismatch }
+		return "", nil, err
+	}
 	nameBytes, err := utils.DecompressBytes(decryptedName)
 	if err != nil { return "", nil, err }
 	nameHash := utils.CRC32HashBytes(nameBytes)
@@ -60,17 +93,20 @@ func FromArchiveData(archive ArchiveData, password string) (filename string, con
 	}
 	
 	content = []byte{}
-	for _, data := range archive.Data {
-		decryptedContent, err := utils.DecryptBytesWithPassword(data.Data, password)
-		if err != nil { return "", nil, err }
-		content, err = utils.DecompressBytes(decryptedContent)
+	for index, data := range archive.Data {
+		decryptedContent, err := decrypt(data.Data, associatedData(associatedChunk, hideName, uint64(index), total))
+		if err != nil {
+			if archive.Version >= ArchiveVersion3 { return "", nil, ImportArchiveChunkMismatch }
+			return "", nil, err
+		}
+		decompressedContent, err := utils.DecompressBytes(decryptedContent)
 		if err != nil { return "", nil, err }
-		contentHash := utils.CRC32HashBytes(content)
+		contentHash := utils.CRC32HashBytes(decompressedContent)
 		if !bytes.Equal(contentHash, data.Hash) {
 			return "", nil, errors.New("file is not a valid archived file (hash mismatch)")
 		}
 		
-		content = append(content, data.Hash...)
+		content = append(content, decompressedContent...)
 	}
 	
 	return string(nameBytes), content, nil
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+
+// 各バージョンの ArchiveData を書き出して読み込み、名前と内容が元に戻ることを確認する。
+func TestArchiveDataRoundTrip(t *testing.T) {
+	chunks := [][]byte{[]byte("first chunk"), {}, bytes.Repeat([]byte{0xAB}, 4096)}
+	content := bytes.Join(chunks, nil)
+	for _, version := range []uint16{ArchiveVersion1, ArchiveVersion2, ArchiveVersion3} {
+		archive := testArchiveData(t, version, "docs/report.txt", "hide-name", chunks)
+		fileName := filepath.Join(t.TempDir(), "archive.bks")
+		if err := archive.Export(fileName); err != nil { t.Fatal(err) }
+		
+		var imported ArchiveData
+		if err := imported.Import(fileName); err != nil {
+			t.Fatalf("v%d: Import: %v", version, err)
+		}
+		if imported.Version != version {
+			t.Fatalf("v%d: imported version %d", version, imported.Version)
+		}
+		name, got, err := FromArchiveData(imported, "hide-name", testPassword)
+		if err != nil {
+			t.Fatalf("v%d: FromArchiveData: %v", version, err)
+		}
+		if name != "docs/report.txt" || !bytes.Equal(got, content) {
+			t.Fatalf("v%d: got name %q and %d bytes", version, name, len(got))
+		}
+	}
+}
+
+// ToArchiveData で作成した v3 の ArchiveData を書き出して読み込み、元に戻ることを確認する。
+func TestToArchiveDataRoundTrip(t *testing.T) {
+	content := []byte("directory entries")
+	archive, err := ToArchiveData("/src/dir", "_directory_", content, testPassword, testKDF)
+	if err != nil { t.Fatal(err) }
+	if archive.Version != ArchiveVersion3 || archive.ChunkCount != 1 {
+		t.Fatalf("got version %d with %d chunks", archive.Version, archive.ChunkCount)
+	}
+	fileName := filepath.Join(t.TempDir(), "archive.bks")
+	if err := archive.Export(fileName); err != nil { t.Fatal(err) }
+	
+	var imported ArchiveData
+	if err := imported.Import(fileName); err != nil { t.Fatal(err) }
+	name, got, err := FromArchiveData(imported, "_directory_", testPassword)
+	if err != nil { t.Fatal(err) }
+	if name != "/src/dir" || !bytes.Equal(got, content) {
+		t.Fatalf("got name %q and content %q", name, got)
+	}
+}
+
+// v3 では隠し名・チャンクの順序・チャンク数を認証し、v2 以前と同じく誤ったパスワードを拒否することを確認する。
+func TestFromArchiveDataRejectsTampering(t *testing.T) {
+	chunks := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	archive := testArchiveData(t, ArchiveVersion3, "file", "hide-name", chunks)
+	
+	if _, _, err := FromArchiveData(archive, "other-name", testPassword); !errors.Is(err, ImportArchiveNameMismatch) {
+		t.Fatalf("other hide name: got %v", err)
+	}
+	
+	swapped := archive
+	swapped.Data = []ArchiveEntry{archive.Data[1], archive.Data[0], archive.Data[2]}
+	if _, _, err := FromArchiveData(swapped, "hide-name", testPassword); !errors.Is(err, ImportArchiveChunkMismatch) {
+		t.Fatalf("swapped chunks: got %v", err)
+	}
+	
+	dropped := archive
+	dropped.Data = archive.Data[:2]
+	dropped.ChunkCount = 2
+	if _, _, err := FromArchiveData(dropped, "hide-name", testPassword); err == nil {
+		t.Fatal("dropped chunk: expected an error")
+	}
+	
+	for _, version := range []uint16{ArchiveVersion1, ArchiveVersion2, ArchiveVersion3} {
+		archive := testArchiveData(t, version, "file", "hide-name", chunks)
+		if _, _, err := FromArchiveData(archive, "hide-name", "wrong password"); err == nil {
+			t.Fatalf("v%d: wrong password: expected an error", version)
+		}
+	}
+}
@@ -8,76 +8,241 @@ import (
 )
 
 
-// エントリがディレクトリかファイルかを表す。
+// エントリがディレクトリ・ファイル・シンボリックリンク・ハードリンクのいずれかを表す。
 type DirectoryEntryType byte
 const (
 	Unknown   DirectoryEntryType = 'U'
 	Directory DirectoryEntryType = 'D'
 	File      DirectoryEntryType = 'F'
+	Symlink   DirectoryEntryType = 'L'
+	Hardlink  DirectoryEntryType = 'H' // 別のファイルと inode を共有し、そのファイルのアーカイブを参照する
 )
 
-// 1つのファイルまたはディレクトリの実名・隠し名・サイズ・更新日時を保持する。
+// 拡張属性（POSIX ACL を含む）の名前と値。
+type ExtendedAttribute struct {
+	Name  string
+	Value []byte
+}
+
+// 1つのファイル・ディレクトリ・シンボリックリンクの実名・隠し名・サイズ・更新日時・権限・所有者・リンク先・拡張属性・チェックサム・チャンクの一覧・パックアーカイブ内の位置を保持する。
 type DirectoryEntry struct {
-	Type     DirectoryEntryType
-	RealName string
-	HideName string
-	Size     uint64
-	ModTime  time.Time
+	Type         DirectoryEntryType
+	RealName     string
+	HideName     string
+	Size         uint64
+	ModTime      time.Time
+	Mode         uint32              // 権限ビットと setuid/setgid/sticky（os.FileMode の値）
+	Uid          uint32
+	Gid          uint32
+	HasMode      bool                // Mode が記録されているか（v1 のエントリでは false）
+	HasOwner     bool                // Uid/Gid が記録されているか（所有者を取得できない環境では false）
+	LinkTarget   string              // シンボリックリンクのリンク先、またはハードリンクが参照するファイルのバックアップ元のルートからの相対パス（v3 以降）
+	Xattrs       []ExtendedAttribute // 拡張属性（v4 以降）
+	Checksum     []byte              // ファイルの平文の SHA-256（v5 以降、記録していない場合は空）
+	ChecksumTime time.Time           // Checksum をファイルの内容から計算した日時
+	Chunked      bool                // 内容を .bks のアーカイブではなくチャンクストアに格納しているか（v6 以降）
+	Chunks       [][]byte            // Chunked の場合の、内容を順に構成するチャンクの ID
+	PackName     string              // 内容をパックアーカイブに格納している場合の、パックアーカイブの隠し名（v7 以降、格納していない場合は空）
+	PackOffset   uint64              // パックアーカイブ内のデータの位置
+	PackLength   uint64              // パックアーカイブ内の暗号化したデータのバイト数
 }
 
+// エントリ一覧のフォーマットバージョン。
+// v1 はヘッダーを持たず、v2 以降は先頭に "BKD" + version(2) を置く（v1 の先頭は Type のため区別できる）。
+const DirectoryEntryVersion uint16 = 7
+
+const dirEntryVersionHeaderSize = 3 + 2
+
 // 1エントリの固定長ヘッダー: Type(1) + RealNameLen(4) + HideNameLen(4) + Size(8) + ModTime(8) = 25
 const dirEntryHeaderSize = 1 + 4 + 4 + 8 + 8
 
+// v2 以降で ModTime の後に続く属性: Mode(4) + Uid(4) + Gid(4) + Flags(1) = 13
+// v3 ではさらに LinkTargetLen(4) + LinkTarget が続く。
+// v4 ではさらに XattrCount(4) と、拡張属性ごとの NameLen(4) + Name + ValueLen(4) + Value が続く。
+// v5 ではさらに ChecksumLen(4) + Checksum + ChecksumTime(8) が続く。
+// v6 ではさらに ChunkCount(4) + ChunkID(32) * ChunkCount が続く。
+// v7 ではさらに PackNameLen(4) + PackName + PackOffset(8) + PackLength(8) が続く。
+const dirEntryAttributeSize = 4 + 4 + 4 + 1
+
+// 属性の Flags のビット。
+const (
+	dirEntryFlagMode    byte = 1 << 0
+	dirEntryFlagOwner   byte = 1 << 1
+	dirEntryFlagChunked byte = 1 << 2
+)
+
+var ImportDirectoryEntriesNotValid = errors.New("directory entry: invalid or truncated entry")
+
 // バイナリ列をパースし、DirectoryEntry のスライスに変換する。
+// ヘッダーのない v1、権限・所有者を含む v2、リンク先を含む v3、拡張属性を含む v4、チェックサムを含む v5、チャンクの一覧を含む v6、パックアーカイブ内の位置を含む v7 を受け付ける。
+// 長さフィールドはすべて残りの入力長と照合し、不正な場合は ImportDirectoryEntriesNotValid を返す。
 func ImportDirectoryEntries(content []byte) ([]DirectoryEntry, error) {
 	var entries []DirectoryEntry
-	r := bytes.NewReader(content)
-	for r.Len() >= dirEntryHeaderSize {
-		var typ DirectoryEntryType
-		if err := binary.Read(r, binary.BigEndian, &typ); err != nil {
-			return nil, err
+	var version uint16 = 1
+	var attributeSize uint64 = 0
+	if len(content) >= 3 && string(content[0:3]) == "BKD" {
+		if len(content) < dirEntryVersionHeaderSize {
+			return nil, ImportDirectoryEntriesNotValid
 		}
-		var realNameLen, hideNameLen uint32
-		if err := binary.Read(r, binary.BigEndian, &realNameLen); err != nil {
-			return nil, err
+		version = binary.BigEndian.Uint16(content[3:5])
+		if version < 2 || version > DirectoryEntryVersion {
+			return nil, ImportDirectoryEntriesNotValid
 		}
-		if err := binary.Read(r, binary.BigEndian, &hideNameLen); err != nil {
-			return nil, err
+		content = content[dirEntryVersionHeaderSize:]
+		attributeSize = dirEntryAttributeSize
+		if version >= 3 {
+			attributeSize += 4
 		}
-		remaining := int64(r.Len())
-		if int64(realNameLen)+int64(hideNameLen)+16 > remaining {
-			return nil, errors.New("directory entry: invalid or truncated entry")
+		if version >= 4 {
+			attributeSize += 4
 		}
-		realName := make([]byte, realNameLen)
-		if _, err := r.Read(realName); err != nil {
-			return nil, err
+		if version >= 5 {
+			attributeSize += 4 + 8
 		}
-		hideName := make([]byte, hideNameLen)
-		if _, err := r.Read(hideName); err != nil {
-			return nil, err
+		if version >= 6 {
+			attributeSize += 4
 		}
-		var size uint64
-		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
-			return nil, err
+		if version >= 7 {
+			attributeSize += 4 + 8 + 8
 		}
-		var modTimeNano int64
-		if err := binary.Read(r, binary.BigEndian, &modTimeNano); err != nil {
-			return nil, err
+	}
+	for len(content) > 0 {
+		if uint64(len(content)) < dirEntryHeaderSize+attributeSize {
+			return nil, ImportDirectoryEntriesNotValid
 		}
-		entries = append(entries, DirectoryEntry{
+		typ := DirectoryEntryType(content[0])
+		realNameLen := uint64(binary.BigEndian.Uint32(content[1:5]))
+		hideNameLen := uint64(binary.BigEndian.Uint32(content[5:9]))
+		content = content[9:]
+		if realNameLen+hideNameLen+16+attributeSize > uint64(len(content)) {
+			return nil, ImportDirectoryEntriesNotValid
+		}
+		realName := string(content[:realNameLen])
+		content = content[realNameLen:]
+		hideName := string(content[:hideNameLen])
+		content = content[hideNameLen:]
+		size := binary.BigEndian.Uint64(content[0:8])
+		modTimeNano := int64(binary.BigEndian.Uint64(content[8:16]))
+		content = content[16:]
+		entry := DirectoryEntry{
 			Type:     typ,
-			RealName: string(realName),
-			HideName: string(hideName),
+			RealName: realName,
+			HideName: hideName,
 			Size:     size,
 			ModTime:  time.Unix(0, modTimeNano),
-		})
+		}
+		if attributeSize > 0 {
+			flags := content[12]
+			entry.Mode = binary.BigEndian.Uint32(content[0:4])
+			entry.Uid = binary.BigEndian.Uint32(content[4:8])
+			entry.Gid = binary.BigEndian.Uint32(content[8:12])
+			entry.HasMode = flags&dirEntryFlagMode != 0
+			entry.HasOwner = flags&dirEntryFlagOwner != 0
+			entry.Chunked = flags&dirEntryFlagChunked != 0
+			content = content[dirEntryAttributeSize:]
+		}
+		if version >= 3 {
+			linkTarget, rest, ok := readLengthPrefixed(content)
+			if !ok {
+				return nil, ImportDirectoryEntriesNotValid
+			}
+			entry.LinkTarget = string(linkTarget)
+			content = rest
+		}
+		if version >= 4 {
+			if len(content) < 4 {
+				return nil, ImportDirectoryEntriesNotValid
+			}
+			count := uint64(binary.BigEndian.Uint32(content[0:4]))
+			content = content[4:]
+			// 拡張属性は1つあたり最低 8 バイトのため、残りの入力長を超える個数は不正とする
+			if count > uint64(len(content))/8 {
+				return nil, ImportDirectoryEntriesNotValid
+			}
+			for i := uint64(0); i < count; i++ {
+				name, rest, ok := readLengthPrefixed(content)
+				if !ok {
+					return nil, ImportDirectoryEntriesNotValid
+				}
+				value, rest, ok := readLengthPrefixed(rest)
+				if !ok {
+					return nil, ImportDirectoryEntriesNotValid
+				}
+				entry.Xattrs = append(entry.Xattrs, ExtendedAttribute{Name: string(name), Value: append([]byte{}, value...)})
+				content = rest
+			}
+		}
+		if version >= 5 {
+			checksum, rest, ok := readLengthPrefixed(content)
+			if !ok || len(rest) < 8 {
+				return nil, ImportDirectoryEntriesNotValid
+			}
+			if len(checksum) > 0 {
+				entry.Checksum = append([]byte{}, checksum...)
+			}
+			if checksumTimeNano := int64(binary.BigEndian.Uint64(rest[0:8])); checksumTimeNano != 0 {
+				entry.ChecksumTime = time.Unix(0, checksumTimeNano)
+			}
+			content = rest[8:]
+		}
+		if version >= 6 {
+			if len(content) < 4 {
+				return nil, ImportDirectoryEntriesNotValid
+			}
+			count := uint64(binary.BigEndian.Uint32(content[0:4]))
+			content = content[4:]
+			if count > uint64(len(content))/ChunkIDSize {
+				return nil, ImportDirectoryEntriesNotValid
+			}
+			for i := uint64(0); i < count; i++ {
+				entry.Chunks = append(entry.Chunks, append([]byte{}, content[:ChunkIDSize]...))
+				content = content[ChunkIDSize:]
+			}
+		}
+		if version >= 7 {
+			packName, rest, ok := readLengthPrefixed(content)
+			if !ok || len(rest) < 16 {
+				return nil, ImportDirectoryEntriesNotValid
+			}
+			entry.PackName = string(packName)
+			entry.PackOffset = binary.BigEndian.Uint64(rest[0:8])
+			entry.PackLength = binary.BigEndian.Uint64(rest[8:16])
+			content = rest[16:]
+		}
+		entries = append(entries, entry)
 	}
 	return entries, nil
 }
 
-// DirectoryEntry のスライスをバイナリ列にシリアライズする。
+// 長さ(4) + 値の形式のフィールドを読み、値と残りの入力を返す。
+func readLengthPrefixed(content []byte) ([]byte, []byte, bool) {
+	if len(content) < 4 {
+		return nil, nil, false
+	}
+	length := uint64(binary.BigEndian.Uint32(content[0:4]))
+	content = content[4:]
+	if length > uint64(len(content)) {
+		return nil, nil, false
+	}
+	return content[:length], content[length:], true
+}
+
+// 長さ(4) + 値の形式のフィールドを書き込む。
+func writeLengthPrefixed(buf *bytes.Buffer, value []byte) error {
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(value))); err != nil {
+		return err
+	}
+	_, err := buf.Write(value)
+	return err
+}
+
+// DirectoryEntry のスライスを最新のフォーマットのバイナリ列にシリアライズする。
 func ExportDirectoryEntries(entries []DirectoryEntry) ([]byte, error) {
 	var buf bytes.Buffer
+	buf.WriteString("BKD")
+	if err := binary.Write(&buf, binary.BigEndian, DirectoryEntryVersion); err != nil {
+		return nil, err
+	}
 	for _, e := range entries {
 		if err := binary.Write(&buf, binary.BigEndian, e.Type); err != nil {
 			return nil, err
@@ -102,6 +267,63 @@ func ExportDirectoryEntries(entries []DirectoryEntry) ([]byte, error) {
 		if err := binary.Write(&buf, binary.BigEndian, e.ModTime.UnixNano()); err != nil {
 			return nil, err
 		}
+		flags := byte(0)
+		if e.HasMode {
+			flags |= dirEntryFlagMode
+		}
+		if e.HasOwner {
+			flags |= dirEntryFlagOwner
+		}
+		if e.Chunked {
+			flags |= dirEntryFlagChunked
+		}
+		if err := binary.Write(&buf, binary.BigEndian, []uint32{e.Mode, e.Uid, e.Gid}); err != nil {
+			return nil, err
+		}
+		if err := buf.WriteByte(flags); err != nil {
+			return nil, err
+		}
+		if err := writeLengthPrefixed(&buf, []byte(e.LinkTarget)); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.BigEndian, uint32(len(e.Xattrs))); err != nil {
+			return nil, err
+		}
+		for _, xattr := range e.Xattrs {
+			if err := writeLengthPrefixed(&buf, []byte(xattr.Name)); err != nil {
+				return nil, err
+			}
+			if err := writeLengthPrefixed(&buf, xattr.Value); err != nil {
+				return nil, err
+			}
+		}
+		if err := writeLengthPrefixed(&buf, e.Checksum); err != nil {
+			return nil, err
+		}
+		var checksumTimeNano int64 = 0
+		if !e.ChecksumTime.IsZero() {
+			checksumTimeNano = e.ChecksumTime.UnixNano()
+		}
+		if err := binary.Write(&buf, binary.BigEndian, checksumTimeNano); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.BigEndian, uint32(len(e.Chunks))); err != nil {
+			return nil, err
+		}
+		for _, id := range e.Chunks {
+			if len(id) != ChunkIDSize {
+				return nil, errors.New("directory entry: invalid chunk ID")
+			}
+			if _, err := buf.Write(id); err != nil {
+				return nil, err
+			}
+		}
+		if err := writeLengthPrefixed(&buf, []byte(e.PackName)); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.BigEndian, []uint64{e.PackOffset, e.PackLength}); err != nil {
+			return nil, err
+		}
 	}
 	return buf.Bytes(), nil
 }
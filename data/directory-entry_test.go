@@ -0,0 +1,146 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+
+func testDirectoryEntries() []DirectoryEntry {
+	modTime := time.Unix(1700000000, 123456789)
+	return []DirectoryEntry{
+		{
+			Type:     Directory,
+			RealName: "sub",
+			HideName: "hide-sub",
+			ModTime:  modTime,
+			Mode:     0o755,
+			Uid:      1000,
+			Gid:      1000,
+			HasMode:  true,
+			HasOwner: true,
+		},
+		{
+			Type:         File,
+			RealName:     "report.txt",
+			HideName:     "hide-report",
+			Size:         12345,
+			ModTime:      modTime,
+			Mode:         0o640,
+			HasMode:      true,
+			Xattrs:       []ExtendedAttribute{{Name: "user.comment", Value: []byte("hello")}},
+			Checksum:     bytes.Repeat([]byte{0x11}, 32),
+			ChecksumTime: time.Unix(1700000100, 0),
+			PackName:     "hide-pack",
+			PackOffset:   31,
+			PackLength:   64,
+		},
+		{
+			Type:     File,
+			RealName: "image.raw",
+			HideName: "hide-image",
+			Size:     1 << 30,
+			ModTime:  modTime,
+			Chunked:  true,
+			Chunks:   [][]byte{bytes.Repeat([]byte{0x22}, ChunkIDSize), bytes.Repeat([]byte{0x33}, ChunkIDSize)},
+		},
+		{
+			Type:       Symlink,
+			RealName:   "link",
+			HideName:   "hide-link",
+			ModTime:    modTime,
+			LinkTarget: "../target",
+		},
+		{
+			Type:       Hardlink,
+			RealName:   "report-link.txt",
+			HideName:   "hide-report-link",
+			Size:       12345,
+			ModTime:    modTime,
+			LinkTarget: "report.txt",
+		},
+	}
+}
+
+// v1〜v7 のエントリ一覧を読み込み、各バージョンに含まれるフィールドが元に戻ることを確認する。
+func TestImportDirectoryEntriesAllVersions(t *testing.T) {
+	for version := uint16(1); version <= DirectoryEntryVersion; version++ {
+		var want []DirectoryEntry
+		for _, e := range testDirectoryEntries() {
+			want = append(want, entryForVersion(e, version))
+		}
+		got, err := ImportDirectoryEntries(encodeTestDirectoryEntries(version, want))
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("v%d: got %+v, want %+v", version, got, want)
+		}
+	}
+}
+
+// ExportDirectoryEntries が最新のバージョンで書き出し、ImportDirectoryEntries で元に戻ることを確認する。
+func TestExportDirectoryEntriesRoundTrip(t *testing.T) {
+	entries := testDirectoryEntries()
+	content, err := ExportDirectoryEntries(entries)
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(content, encodeTestDirectoryEntries(DirectoryEntryVersion, entries)) {
+		t.Fatal("exported entries differ from the latest format")
+	}
+	got, err := ImportDirectoryEntries(content)
+	if err != nil { t.Fatal(err) }
+	if !reflect.DeepEqual(got, entries) {
+		t.Fatalf("got %+v, want %+v", got, entries)
+	}
+	
+	empty, err := ExportDirectoryEntries(nil)
+	if err != nil { t.Fatal(err) }
+	got, err = ImportDirectoryEntries(empty)
+	if err != nil || len(got) != 0 {
+		t.Fatalf("empty: got %v, %v", got, err)
+	}
+}
+
+// 途中で切れたエントリ一覧と未対応のバージョンを拒否することを確認する。
+func TestImportDirectoryEntriesRejectsTruncated(t *testing.T) {
+	content, err := ExportDirectoryEntries(testDirectoryEntries()[:1])
+	if err != nil { t.Fatal(err) }
+	for n := 1; n < len(content); n++ {
+		if n == dirEntryVersionHeaderSize { continue }
+		if _, err := ImportDirectoryEntries(content[:n]); !errors.Is(err, ImportDirectoryEntriesNotValid) {
+			t.Fatalf("prefix of %d bytes: got %v", n, err)
+		}
+	}
+	
+	unsupported := append([]byte("BKD"), 0, byte(DirectoryEntryVersion+1))
+	if _, err := ImportDirectoryEntries(unsupported); !errors.Is(err, ImportDirectoryEntriesNotValid) {
+		t.Fatalf("unsupported version: got %v", err)
+	}
+}
+
+// 任意の入力に対して ImportDirectoryEntries が panic せず、受け付けた入力は書き出して読み込むと同じエントリに戻ることを確認する。
+func FuzzImportDirectoryEntries(f *testing.F) {
+	for version := uint16(1); version <= DirectoryEntryVersion; version++ {
+		var entries []DirectoryEntry
+		for _, e := range testDirectoryEntries() {
+			entries = append(entries, entryForVersion(e, version))
+		}
+		f.Add(encodeTestDirectoryEntries(version, entries))
+	}
+	f.Add([]byte("BKD"))
+	
+	f.Fuzz(func(t *testing.T, content []byte) {
+		entries, err := ImportDirectoryEntries(content)
+		if err != nil { return }
+		exported, err := ExportDirectoryEntries(entries)
+		if err != nil { t.Fatal(err) }
+		got, err := ImportDirectoryEntries(exported)
+		if err != nil { t.Fatal(err) }
+		if !reflect.DeepEqual(got, entries) {
+			t.Fatalf("got %+v, want %+v", got, entries)
+		}
+	})
+}
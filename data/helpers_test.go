@@ -0,0 +1,245 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"time"
+	
+	"bakashier/utils"
+)
+
+
+const testPassword = "correct horse battery staple"
+
+// テストでは鍵の導出に時間をかけないよう、反復回数を最小にする。
+var testKDF = utils.KDFParams{Type: utils.KDFPBKDF2SHA256, Time: 1}
+
+// テスト用のアーカイブのチャンクサイズ。
+const testChunkSize uint64 = 64 * 1024
+
+// version（v1〜v3）の ArchiveData を作成する。chunks の各要素を1つのチャンクとして暗号化する。
+// ToArchiveData は v3 の1チャンクのみを作成するため、以前のバージョンと複数チャンクの組み立てはここで行う。
+func testArchiveData(t testing.TB, version uint16, fileName string, hideName string, chunks [][]byte) ArchiveData {
+	t.Helper()
+	archive := ArchiveData{Version: version}
+	encrypt := func(plain []byte, additionalData []byte) []byte {
+		compressed, err := utils.CompressBytes(plain)
+		if err != nil { t.Fatal(err) }
+		encrypted, err := utils.EncryptBytesWithPassword(compressed, testPassword)
+		if err != nil { t.Fatal(err) }
+		return encrypted
+	}
+	if version >= ArchiveVersion2 {
+		kdf, err := utils.NewKDFParams(testKDF)
+		if err != nil { t.Fatal(err) }
+		key, err := utils.DeriveKey(testPassword, kdf)
+		if err != nil { t.Fatal(err) }
+		archive.KDF = kdf
+		encrypt = func(plain []byte, additionalData []byte) []byte {
+			if version < ArchiveVersion3 {
+				additionalData = nil
+			}
+			compressed, err := utils.CompressBytes(plain)
+			if err != nil { t.Fatal(err) }
+			encrypted, err := utils.EncryptBytesWithKey(compressed, key, additionalData)
+			if err != nil { t.Fatal(err) }
+			return encrypted
+		}
+	}
+	if version >= ArchiveVersion3 {
+		archive.ChunkCount = uint64(len(chunks))
+	}
+	
+	total := uint64(len(chunks))
+	archive.Name = ArchiveEntry{
+		Data: encrypt([]byte(fileName), associatedData(associatedName, hideName, 0, total)),
+		Hash: utils.CRC32HashBytes([]byte(fileName)),
+	}
+	for index, chunk := range chunks {
+		archive.Data = append(archive.Data, ArchiveEntry{
+			Data: encrypt(chunk, associatedData(associatedChunk, hideName, uint64(index), total)),
+			Hash: utils.CRC32HashBytes(chunk),
+		})
+	}
+	return archive
+}
+
+// version のエントリ一覧のバイナリ列を作成する。ExportDirectoryEntries は最新のバージョンのみを書き出すため、
+// 以前のバージョンの読み込みの確認にはこの関数を使う。version に含まれないフィールドは書き出さない。
+func encodeTestDirectoryEntries(version uint16, entries []DirectoryEntry) []byte {
+	var content []byte
+	if version >= 2 {
+		content = append(content, "BKD"...)
+		content = binary.BigEndian.AppendUint16(content, version)
+	}
+	appendLengthPrefixed := func(value []byte) {
+		content = binary.BigEndian.AppendUint32(content, uint32(len(value)))
+		content = append(content, value...)
+	}
+	for _, e := range entries {
+		content = append(content, byte(e.Type))
+		content = binary.BigEndian.AppendUint32(content, uint32(len(e.RealName)))
+		content = binary.BigEndian.AppendUint32(content, uint32(len(e.HideName)))
+		content = append(content, e.RealName...)
+		content = append(content, e.HideName...)
+		content = binary.BigEndian.AppendUint64(content, e.Size)
+		content = binary.BigEndian.AppendUint64(content, uint64(e.ModTime.UnixNano()))
+		if version >= 2 {
+			flags := byte(0)
+			if e.HasMode {
+				flags |= dirEntryFlagMode
+			}
+			if e.HasOwner {
+				flags |= dirEntryFlagOwner
+			}
+			if e.Chunked {
+				flags |= dirEntryFlagChunked
+			}
+			content = binary.BigEndian.AppendUint32(content, e.Mode)
+			content = binary.BigEndian.AppendUint32(content, e.Uid)
+			content = binary.BigEndian.AppendUint32(content, e.Gid)
+			content = append(content, flags)
+		}
+		if version >= 3 {
+			appendLengthPrefixed([]byte(e.LinkTarget))
+		}
+		if version >= 4 {
+			content = binary.BigEndian.AppendUint32(content, uint32(len(e.Xattrs)))
+			for _, xattr := range e.Xattrs {
+				appendLengthPrefixed([]byte(xattr.Name))
+				appendLengthPrefixed(xattr.Value)
+			}
+		}
+		if version >= 5 {
+			appendLengthPrefixed(e.Checksum)
+			var checksumTimeNano int64 = 0
+			if !e.ChecksumTime.IsZero() {
+				checksumTimeNano = e.ChecksumTime.UnixNano()
+			}
+			content = binary.BigEndian.AppendUint64(content, uint64(checksumTimeNano))
+		}
+		if version >= 6 {
+			content = binary.BigEndian.AppendUint32(content, uint32(len(e.Chunks)))
+			for _, id := range e.Chunks {
+				content = append(content, id...)
+			}
+		}
+		if version >= 7 {
+			appendLengthPrefixed([]byte(e.PackName))
+			content = binary.BigEndian.AppendUint64(content, e.PackOffset)
+			content = binary.BigEndian.AppendUint64(content, e.PackLength)
+		}
+	}
+	return content
+}
+
+// e から version に含まれないフィールドを取り除いたエントリを返す。
+func entryForVersion(e DirectoryEntry, version uint16) DirectoryEntry {
+	if version < 2 {
+		e.Mode, e.Uid, e.Gid = 0, 0, 0
+		e.HasMode, e.HasOwner = false, false
+	}
+	if version < 3 {
+		e.LinkTarget = ""
+	}
+	if version < 4 {
+		e.Xattrs = nil
+	}
+	if version < 5 {
+		e.Checksum = nil
+		e.ChecksumTime = time.Time{}
+	}
+	if version < 6 {
+		e.Chunked = false
+		e.Chunks = nil
+	}
+	if version < 7 {
+		e.PackName = ""
+		e.PackOffset, e.PackLength = 0, 0
+	}
+	return e
+}
+
+// version（v1〜v5）のストリームアーカイブのバイト列を作成する。chunks の各要素を1つのチャンクとして暗号化する。
+// ExportStreamArchive は最新のバージョンのみを書き出すため、以前のバージョンの読み込みの確認にはこの関数を使う。
+// v5 はホールを持たない。
+func testStreamArchive(t testing.TB, version uint16, fileName string, hideName string, chunks [][]byte) []byte {
+	t.Helper()
+	compress := func(plain []byte) []byte {
+		compressed, err := utils.CompressBytes(plain)
+		if err != nil { t.Fatal(err) }
+		return compressed
+	}
+	encrypt := func(plain []byte, additionalData []byte) []byte {
+		encrypted, err := utils.EncryptBytesWithPassword(compress(plain), testPassword)
+		if err != nil { t.Fatal(err) }
+		return encrypted
+	}
+	var key []byte
+	chunkCount := uint64(len(chunks))
+	
+	var content []byte
+	content = append(content, "BKS"...)
+	content = binary.BigEndian.AppendUint16(content, version)
+	if version >= ArchiveVersion2 {
+		kdf, err := utils.NewKDFParams(testKDF)
+		if err != nil { t.Fatal(err) }
+		key, err = utils.DeriveKey(testPassword, kdf)
+		if err != nil { t.Fatal(err) }
+		encrypt = func(plain []byte, additionalData []byte) []byte {
+			if version < ArchiveVersion3 {
+				additionalData = nil
+			}
+			encrypted, err := utils.EncryptBytesWithKey(compress(plain), key, additionalData)
+			if err != nil { t.Fatal(err) }
+			return encrypted
+		}
+		content = append(content, encodeKDFHeader(kdf)...)
+	}
+	if version >= ArchiveVersion3 {
+		content = binary.BigEndian.AppendUint64(content, chunkCount)
+	}
+	
+	// 名前
+	encryptedName := encrypt([]byte(fileName), associatedData(associatedName, hideName, 0, chunkCount))
+	content = binary.BigEndian.AppendUint32(content, uint32(len(encryptedName)))
+	content = append(content, encryptedName...)
+	content = append(content, utils.CRC32HashBytes(encryptedName)...)
+	
+	// チャンク
+	var digests [][]byte
+	var fileSize uint64 = 0
+	for index, chunk := range chunks {
+		chunkAD := associatedData(associatedChunk, hideName, uint64(index), chunkCount)
+		if version >= ArchiveVersion4 {
+			chunkAD = blockAssociatedData(uint64(index))
+		}
+		encrypted := encrypt(chunk, chunkAD)
+		content = binary.BigEndian.AppendUint64(content, uint64(len(encrypted)))
+		content = append(content, encrypted...)
+		content = append(content, utils.CRC32HashBytes(chunk)...)
+		digest := sha256.Sum256(chunk)
+		digests = append(digests, digest[:])
+		fileSize += uint64(len(chunk))
+	}
+	
+	// チャンクの SHA-256 の一覧
+	switch version {
+	case ArchiveVersion4:
+		table := binary.BigEndian.AppendUint64(nil, testChunkSize)
+		for _, digest := range digests {
+			table = append(table, digest...)
+		}
+		encryptedTable, err := utils.EncryptBytesWithKey(table, key, associatedData(associatedDigest, hideName, 0, chunkCount))
+		if err != nil { t.Fatal(err) }
+		content = append(content, encryptedTable...)
+		content = append(content, utils.CRC32HashBytes(encryptedTable)...)
+		content = binary.BigEndian.AppendUint64(content, uint64(len(encryptedTable)))
+	case ArchiveVersion5:
+		trailer, err := encodeDigestTrailer(key, hideName, digestTrailer{chunkSize: testChunkSize, digests: digests, fileSize: fileSize})
+		if err != nil { t.Fatal(err) }
+		content = append(content, trailer...)
+	}
+	return content
+}
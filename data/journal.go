@@ -0,0 +1,156 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	
+	"bakashier/utils"
+)
+
+
+// ジャーナルのフォーマットバージョン。
+// v2 からレコードをジャーナルのあるディレクトリに結び付ける。ディレクトリに結び付かない v1 のジャーナルは壊れたものとして作り直す。
+const JournalVersion uint16 = 2
+
+// ジャーナルのヘッダー: "BKJ" + version(2) + KDF(26)
+const journalHeaderSize = 3 + 2 + kdfHeaderSize
+
+const associatedJournal byte = 'J'
+
+var ErrJournalMismatch = errors.New("journal authentication failed (wrong password or journal copied from another directory)")
+
+// バックアップ中に書き出しが完了したエントリを追記していくジャーナル。
+// 中断されたバックアップを再開する際に、書き出し済みの .bks を再利用するために使う。
+// 形式: "BKJ" + version(2) + KDF(26) + recordLen(4) + record + recordLen(4) + record + ...
+// record は1エントリ分の ExportDirectoryEntries を暗号化したもので、ディレクトリ scope とレコード番号を関連データとして認証する。
+// 追記のたびにディレクトリとジャーナルを fsync し、電源断の後も記録したエントリの .bks が残るようにする。
+type Journal struct {
+	path     string
+	scope    string
+	password string
+	kdf      utils.KDFParams
+	file     *os.File
+	key      []byte
+	count    uint64
+	validEnd int64
+}
+
+// path のジャーナルを読み込み、記録済みのエントリと追記用の Journal を返す。
+// scope はジャーナルのあるディレクトリのバックアップ先のルートからの相対パスで、他のディレクトリからコピーされたジャーナルは ErrJournalMismatch で拒否する。
+// ジャーナルが存在しない場合は空のエントリを返し、最初の Append でファイルを作成する。
+// 末尾の書き込み途中のレコードは無視し、次の Append で上書きする。
+func LoadJournal(path string, scope string, password string, kdf utils.KDFParams) ([]DirectoryEntry, *Journal, error) {
+	journal := &Journal{path: path, scope: scope, password: password, kdf: kdf}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) { return []DirectoryEntry{}, journal, nil }
+	if err != nil { return nil, nil, err }
+	
+	// ヘッダーが壊れている場合は作り直す
+	if len(content) < journalHeaderSize || string(content[0:3]) != "BKJ" || binary.BigEndian.Uint16(content[3:5]) != JournalVersion {
+		return []DirectoryEntry{}, journal, nil
+	}
+	headerKDF, err := decodeKDFHeader(content[5:journalHeaderSize])
+	if err != nil { return []DirectoryEntry{}, journal, nil }
+	key, err := utils.DeriveKey(password, headerKDF)
+	if err != nil { return nil, nil, err }
+	
+	// 読める範囲のレコードを読み込む
+	entries := []DirectoryEntry{}
+	offset := uint64(journalHeaderSize)
+	var count uint64 = 0
+	for uint64(len(content))-offset >= 4 {
+		recordLen := uint64(binary.BigEndian.Uint32(content[offset : offset+4]))
+		if recordLen > uint64(len(content))-offset-4 { break }
+		record := content[offset+4 : offset+4+recordLen]
+		plain, err := utils.DecryptBytesWithKey(record, key, associatedData(associatedJournal, scope, count, 0))
+		if err != nil {
+			if count == 0 { return nil, nil, ErrJournalMismatch } // パスワードの誤り、または他のディレクトリのジャーナル
+			break
+		}
+		recordEntries, err := ImportDirectoryEntries(plain)
+		if err != nil || len(recordEntries) != 1 { break }
+		entries = append(entries, recordEntries[0])
+		offset += 4 + recordLen
+		count++
+	}
+	
+	journal.key = key
+	journal.count = count
+	journal.validEnd = int64(offset)
+	return entries, journal, nil
+}
+
+// エントリをジャーナルに追記し、fsync する。ファイルが開かれていない場合は開く（または作成する）。
+// 先にジャーナルのあるディレクトリを fsync し、エントリが参照する .bks のリネームを記録より前に永続化する。
+func (j *Journal) Append(entry DirectoryEntry) error {
+	if j.file == nil {
+		if err := j.open(); err != nil { return err }
+	}
+	
+	plain, err := ExportDirectoryEntries([]DirectoryEntry{entry})
+	if err != nil { return err }
+	record, err := utils.EncryptBytesWithKey(plain, j.key, associatedData(associatedJournal, j.scope, j.count, 0))
+	if err != nil { return err }
+	
+	if err := utils.SyncDirectory(filepath.Dir(j.path)); err != nil { return err }
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(record)))
+	buf = append(buf, record...)
+	if _, err := j.file.Write(buf); err != nil { return err }
+	if err := j.file.Sync(); err != nil { return err }
+	j.count++
+	return nil
+}
+
+// 追記用にジャーナルを開く。既存の有効なレコードがない場合はヘッダーから作り直す。
+func (j *Journal) open() error {
+	if j.key != nil {
+		file, err := os.OpenFile(j.path, os.O_WRONLY, 0644)
+		if err != nil { return err }
+		if err := file.Truncate(j.validEnd); err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Seek(j.validEnd, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+		j.file = file
+		return nil
+	}
+	
+	kdf, err := utils.NewKDFParams(j.kdf)
+	if err != nil { return err }
+	key, err := utils.DeriveKey(j.password, kdf)
+	if err != nil { return err }
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil { return err }
+	header := append([]byte("BKJ"), binary.BigEndian.AppendUint16(nil, JournalVersion)...)
+	header = append(header, encodeKDFHeader(kdf)...)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return err
+	}
+	j.file = file
+	j.key = key
+	j.count = 0
+	return nil
+}
+
+// ジャーナルを閉じる。
+func (j *Journal) Close() error {
+	if j.file == nil { return nil }
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// ジャーナルを閉じて削除する。_directory_.bks の書き出しが完了した後に呼ぶ。
+func (j *Journal) Remove() error {
+	j.Close()
+	err := os.Remove(j.path)
+	if errors.Is(err, os.ErrNotExist) { return nil }
+	return err
+}
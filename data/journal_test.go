@@ -0,0 +1,75 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+
+// ジャーナルに記録したエントリを同じディレクトリでは読み込め、他のディレクトリにコピーしたジャーナルは拒否することを確認する。
+func TestJournalIsBoundToDirectory(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "_journal_.bks")
+	entries := []DirectoryEntry{
+		{Type: File, RealName: "a.txt", HideName: "hide-a", Size: 5, ModTime: time.Unix(1700000000, 0).UTC()},
+		{Type: File, RealName: "b.txt", HideName: "hide-b", Size: 7, ModTime: time.Unix(1700000001, 0).UTC()},
+	}
+	_, journal, err := LoadJournal(path, "dir-a", testPassword, testKDF)
+	if err != nil { t.Fatal(err) }
+	for _, entry := range entries {
+		if err := journal.Append(entry); err != nil { t.Fatal(err) }
+	}
+	if err := journal.Close(); err != nil { t.Fatal(err) }
+	
+	loaded, journal, err := LoadJournal(path, "dir-a", testPassword, testKDF)
+	if err != nil { t.Fatal(err) }
+	journal.Close()
+	if len(loaded) != len(entries) {
+		t.Fatalf("got %d entries, want %d", len(loaded), len(entries))
+	}
+	for i := range entries {
+		if loaded[i].RealName != entries[i].RealName || loaded[i].HideName != entries[i].HideName {
+			t.Errorf("entry %d: got %+v, want %+v", i, loaded[i], entries[i])
+		}
+	}
+	
+	for _, scope := range []string{"dir-b", "", "dir-a/sub"} {
+		if _, _, err := LoadJournal(path, scope, testPassword, testKDF); !errors.Is(err, ErrJournalMismatch) {
+			t.Errorf("scope %q: got %v, want %v", scope, err, ErrJournalMismatch)
+		}
+	}
+	if _, _, err := LoadJournal(path, "dir-a", "wrong password", testKDF); !errors.Is(err, ErrJournalMismatch) {
+		t.Errorf("wrong password: got %v, want %v", err, ErrJournalMismatch)
+	}
+}
+
+// ディレクトリに結び付かない v1 のジャーナルは読み込まず、次の追記で作り直すことを確認する。
+func TestJournalIgnoresVersion1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "_journal_.bks")
+	_, journal, err := LoadJournal(path, "dir-a", testPassword, testKDF)
+	if err != nil { t.Fatal(err) }
+	if err := journal.Append(DirectoryEntry{Type: File, RealName: "a.txt", HideName: "hide-a"}); err != nil { t.Fatal(err) }
+	if err := journal.Close(); err != nil { t.Fatal(err) }
+	content, err := os.ReadFile(path)
+	if err != nil { t.Fatal(err) }
+	binary.BigEndian.PutUint16(content[3:5], 1)
+	if err := os.WriteFile(path, content, 0644); err != nil { t.Fatal(err) }
+	
+	loaded, journal, err := LoadJournal(path, "dir-a", testPassword, testKDF)
+	if err != nil { t.Fatal(err) }
+	if len(loaded) != 0 {
+		t.Fatalf("got %d entries from a v1 journal", len(loaded))
+	}
+	if err := journal.Append(DirectoryEntry{Type: File, RealName: "b.txt", HideName: "hide-b"}); err != nil { t.Fatal(err) }
+	if err := journal.Close(); err != nil { t.Fatal(err) }
+	loaded, journal, err = LoadJournal(path, "dir-a", testPassword, testKDF)
+	if err != nil { t.Fatal(err) }
+	journal.Close()
+	if len(loaded) != 1 || loaded[0].RealName != "b.txt" {
+		t.Fatalf("got %+v, want only b.txt", loaded)
+	}
+}
@@ -0,0 +1,239 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	
+	"bakashier/utils"
+)
+
+
+// パックアーカイブのフォーマットバージョン。
+const PackArchiveVersion1 uint16 = 1
+
+// 1つのパックアーカイブの目安の上限。超えた場合は次のファイルから新しいパックアーカイブに書き出す。
+var PackSize uint64 = 64 * 1024 * 1024 // 64MB
+
+// パックアーカイブのヘッダー: "BKP" + version(2) + KDF(26)
+const packHeaderSize = 5 + kdfHeaderSize
+
+var ErrPackedFileMismatch = errors.New("packed file is missing, moved or tampered")
+
+// 複数の小さなファイルを1つの .bks にまとめて書き出す。
+// 形式: "BKP" + version(2) + KDF(26) + (dataLen(8) + data + CRC32(4)) * ファイル数
+// ファイルごとに圧縮・暗号化し、パックアーカイブの隠し名・ファイルの隠し名・位置を関連データとして認証する。
+// パックアーカイブ自体はファイルの一覧を持たず、各ファイルはエントリに記録した位置と長さで読み出す。
+// 一時ファイルに書き込み、Commit で destFile に置き換える。
+type PackWriter struct {
+	dest     *utils.AtomicFile
+	hideName string
+	key      []byte
+	size     uint64
+	err      error
+}
+
+// destFile にパックアーカイブを作成する。鍵は kdf のパラメータで1度だけ導出する。
+func CreatePackArchive(destFile string, hideName string, password string, kdf utils.KDFParams) (*PackWriter, error) {
+	kdf, err := utils.NewKDFParams(kdf)
+	if err != nil { return nil, err }
+	key, err := utils.DeriveKey(password, kdf)
+	if err != nil { return nil, err }
+	
+	dest, err := utils.CreateAtomicFile(destFile)
+	if err != nil { return nil, err }
+	if err := dest.Chmod(0644); err != nil {
+		dest.Abort()
+		return nil, err
+	}
+	
+	var header []byte
+	header = append(header, []byte("BKP")...)
+	header = binary.BigEndian.AppendUint16(header, PackArchiveVersion1)
+	header = append(header, encodeKDFHeader(kdf)...)
+	if _, err := dest.Write(header); err != nil {
+		dest.Abort()
+		return nil, err
+	}
+	return &PackWriter{dest: dest, hideName: hideName, key: key, size: uint64(len(header))}, nil
+}
+
+// srcFile を読み込んでパックアーカイブに追加し、データの位置・長さと平文の SHA-256 を返す。
+// entryHideName はファイルのエントリの隠し名。読み込み中にファイルが変更された場合は ErrSourceFileChanged を返し、追加しない。
+// 書き込みに失敗した場合は、以降の Add と Commit も同じエラーを返す。
+func (w *PackWriter) Add(srcFile string, entryHideName string) (uint64, uint64, []byte, error) {
+	if w.err != nil { return 0, 0, nil, w.err }
+	
+	// ファイル全体を読み込み、読み込み中に変更されていないかを確認する
+	src, err := os.Open(srcFile)
+	if err != nil { return 0, 0, nil, err }
+	defer src.Close()
+	fileInfo, err := src.Stat()
+	if err != nil { return 0, 0, nil, err }
+	content, err := io.ReadAll(src)
+	if err != nil { return 0, 0, nil, err }
+	if err := checkSourceUnchanged(src, fileInfo, uint64(len(content))); err != nil {
+		return 0, 0, nil, err
+	}
+	
+	// 圧縮 → 暗号化
+	offset := w.size
+	compressed, err := utils.CompressBytes(content)
+	if err != nil { return 0, 0, nil, err }
+	encrypted, err := utils.EncryptBytesWithKey(compressed, w.key, packAssociatedData(w.hideName, entryHideName, offset))
+	if err != nil { return 0, 0, nil, err }
+	
+	// データ長・データ・CRC32 を書き込む
+	record := make([]byte, 0, 8+len(encrypted)+4)
+	record = binary.BigEndian.AppendUint64(record, uint64(len(encrypted)))
+	record = append(record, encrypted...)
+	record = append(record, utils.CRC32HashBytes(content)...)
+	if _, err := w.dest.Write(record); err != nil {
+		w.err = err
+		return 0, 0, nil, err
+	}
+	w.size += uint64(len(record))
+	
+	checksum := sha256.Sum256(content)
+	return offset, uint64(len(encrypted)), checksum[:], nil
+}
+
+// 書き込んだバイト数を返す。
+func (w *PackWriter) Size() uint64 {
+	return w.size
+}
+
+// 書き込みを確定する。
+func (w *PackWriter) Commit() error {
+	if w.err != nil {
+		w.dest.Abort()
+		return w.err
+	}
+	return w.dest.Commit()
+}
+
+// 書き込みを中止し、一時ファイルを削除する。
+func (w *PackWriter) Abort() {
+	w.dest.Abort()
+}
+
+// パックアーカイブ内のファイルの関連データを生成する。
+// 形式: kind(1) + PackHideNameLen(4) + PackHideName + HideNameLen(4) + HideName + offset(8)
+func packAssociatedData(packHideName string, hideName string, offset uint64) []byte {
+	ad := make([]byte, 0, 1+4+len(packHideName)+4+len(hideName)+8)
+	ad = append(ad, associatedPacked)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(packHideName)))
+	ad = append(ad, packHideName...)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(hideName)))
+	ad = append(ad, hideName...)
+	ad = binary.BigEndian.AppendUint64(ad, offset)
+	return ad
+}
+
+// パックアーカイブのファイルを読み出す。1回の復元・検証・比較の間だけ作成し、パックアーカイブごとの鍵の導出を繰り返さない。
+// 鍵は KDF ヘッダー（ソルトを含む）ごとに保持し、パスワードはキャッシュのキーに含めない。使い終えた PackReader は鍵とともに破棄される。
+type PackReader struct {
+	password string
+	mu       sync.Mutex
+	keys     map[string][]byte // [KDF ヘッダー]鍵
+}
+
+func NewPackReader(password string) *PackReader {
+	return &PackReader{password: password, keys: make(map[string][]byte)}
+}
+
+// packFile の offset にある長さ length のファイルを復号・展開し、destFile に書き出す。
+// 書き出し先の検証と競合の解決は呼び出し側で行う。ストリームアーカイブ・チャンクストアからの復元と同じく os.Create で作成し、
+// 権限・所有者などの属性は呼び出し側で復元する。内容を検証してから書き出し先を開くため、復号に失敗した場合は既存のファイルを変更しない。
+func (r *PackReader) ImportFile(packFile string, packHideName string, hideName string, offset uint64, length uint64, destFile string) error {
+	content, err := r.readFile(packFile, packHideName, hideName, offset, length)
+	if err != nil { return err }
+	dest, err := os.Create(destFile)
+	if err != nil { return err }
+	if _, err := dest.Write(content); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
+
+// packFile の offset にある長さ length のファイルを復号・展開して CRC32 を検証する。ファイルは書き出さない。
+func (r *PackReader) VerifyFile(packFile string, packHideName string, hideName string, offset uint64, length uint64) error {
+	_, err := r.readFile(packFile, packHideName, hideName, offset, length)
+	return err
+}
+
+// packFile の offset にある長さ length のファイルの内容が liveFile の内容と一致するかを比較する。
+func (r *PackReader) CompareFile(packFile string, packHideName string, hideName string, offset uint64, length uint64, liveFile string) (bool, error) {
+	content, err := r.readFile(packFile, packHideName, hideName, offset, length)
+	if err != nil { return false, err }
+	live, err := os.ReadFile(liveFile)
+	if err != nil { return false, err }
+	return bytes.Equal(content, live), nil
+}
+
+// packFile の offset にある長さ length のファイルを読み込み、復号・展開する。
+// 位置と長さはパックアーカイブのサイズと照合し、不正な場合は ImportArchive* または ErrPackedFileMismatch を返す。
+func (r *PackReader) readFile(packFile string, packHideName string, hideName string, offset uint64, length uint64) ([]byte, error) {
+	pack, err := os.Open(packFile)
+	if err != nil { return nil, err }
+	defer pack.Close()
+	packInfo, err := pack.Stat()
+	if err != nil { return nil, err }
+	size := uint64(packInfo.Size())
+	
+	// ヘッダを読み込む
+	if size < packHeaderSize { return nil, ImportArchiveTooShort }
+	header := make([]byte, packHeaderSize)
+	if _, err := pack.ReadAt(header, 0); err != nil { return nil, err }
+	if header[0] != byte('B') || header[1] != byte('K') || header[2] != byte('P') {
+		return nil, ImportArchiveNotValid
+	}
+	if binary.BigEndian.Uint16(header[3:5]) != PackArchiveVersion1 {
+		return nil, ImportArchiveUnsupportedVersion
+	}
+	kdf, err := decodeKDFHeader(header[5:])
+	if err != nil { return nil, err }
+	
+	// データ長・データ・CRC32 を読み込む
+	if offset < packHeaderSize || offset > size || length > size-offset || size-offset-length < 8+4 {
+		return nil, ImportArchiveTooShort
+	}
+	record := make([]byte, 8+length+4)
+	if _, err := pack.ReadAt(record, int64(offset)); err != nil { return nil, err }
+	if binary.BigEndian.Uint64(record[0:8]) != length { return nil, ErrPackedFileMismatch }
+	encrypted := record[8 : 8+length]
+	contentCRC := record[8+length:]
+	
+	// 復号・展開して CRC32 ハッシュを検証する
+	key, err := r.deriveKey(kdf)
+	if err != nil { return nil, err }
+	decrypted, err := utils.DecryptBytesWithKey(encrypted, key, packAssociatedData(packHideName, hideName, offset))
+	if err != nil { return nil, ErrPackedFileMismatch }
+	content, err := utils.DecompressBytes(decrypted)
+	if err != nil { return nil, err }
+	if !bytes.Equal(contentCRC, utils.CRC32HashBytes(content)) {
+		return nil, errors.New("packed file CRC32 hash mismatch")
+	}
+	return content, nil
+}
+
+// KDF のパラメータから鍵を導出する。同じパラメータで導出済みの鍵は保持しているものを返す。
+func (r *PackReader) deriveKey(kdf utils.KDFParams) ([]byte, error) {
+	cacheKey := string(encodeKDFHeader(kdf))
+	r.mu.Lock()
+	key, ok := r.keys[cacheKey]
+	r.mu.Unlock()
+	if ok { return key, nil }
+	
+	key, err := utils.DeriveKey(r.password, kdf)
+	if err != nil { return nil, err }
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[cacheKey] = key
+	return key, nil
+}
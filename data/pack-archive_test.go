@@ -0,0 +1,136 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+// パックアーカイブに追加したファイルの位置。
+type testPackedFile struct {
+	pack     string
+	hideName string
+	offset   uint64
+	length   uint64
+	content  []byte
+}
+
+// contents の各ファイルを順にパックアーカイブに追加し、PackSize に達するごとに次のパックアーカイブに切り替える。
+func writeTestPacks(t *testing.T, dir string, contents [][]byte) []testPackedFile {
+	t.Helper()
+	var files []testPackedFile
+	var writer *PackWriter
+	pack := ""
+	commit := func() {
+		if writer == nil { return }
+		if err := writer.Commit(); err != nil { t.Fatal(err) }
+		writer = nil
+	}
+	for i, content := range contents {
+		if writer == nil {
+			pack = fmt.Sprintf("pack%d", len(files))
+			var err error
+			writer, err = CreatePackArchive(filepath.Join(dir, pack+".bks"), pack, testPassword, testKDF)
+			if err != nil { t.Fatal(err) }
+		}
+		srcFile := filepath.Join(dir, fmt.Sprintf("src%d", i))
+		if err := os.WriteFile(srcFile, content, 0644); err != nil { t.Fatal(err) }
+		hideName := fmt.Sprintf("file%d", i)
+		offset, length, checksum, err := writer.Add(srcFile, hideName)
+		if err != nil { t.Fatal(err) }
+		if sum := sha256.Sum256(content); !bytes.Equal(checksum, sum[:]) {
+			t.Fatalf("file %d: checksum mismatch", i)
+		}
+		files = append(files, testPackedFile{pack: pack, hideName: hideName, offset: offset, length: length, content: content})
+		if writer.Size() >= PackSize {
+			commit()
+		}
+	}
+	commit()
+	return files
+}
+
+// 複数のファイルをまとめ、上限で次のパックアーカイブに切り替えても、各ファイルを位置と長さで復元・検証・比較できることを確認する。
+func TestPackArchiveRoundTrip(t *testing.T) {
+	defer func(size uint64) { PackSize = size }(PackSize)
+	PackSize = 512
+	
+	dir := t.TempDir()
+	contents := [][]byte{
+		[]byte("first"),
+		nil,
+		bytes.Repeat([]byte("compressible "), 40),
+		randomBytes(300, 6),
+		[]byte("after the rollover"),
+		randomBytes(1000, 7),
+		[]byte("last"),
+	}
+	files := writeTestPacks(t, dir, contents)
+	packs := make(map[string]int)
+	for _, file := range files {
+		packs[file.pack]++
+	}
+	if len(packs) < 3 || len(packs) == len(files) {
+		t.Fatalf("got %d packs for %d files", len(packs), len(files))
+	}
+	
+	reader := NewPackReader(testPassword)
+	for i, file := range files {
+		packFile := filepath.Join(dir, file.pack+".bks")
+		destFile := filepath.Join(dir, fmt.Sprintf("restored%d", i))
+		if err := reader.ImportFile(packFile, file.pack, file.hideName, file.offset, file.length, destFile); err != nil {
+			t.Fatalf("file %d: %v", i, err)
+		}
+		if restored := mustReadFile(t, destFile); !bytes.Equal(restored, file.content) {
+			t.Fatalf("file %d: restored content mismatch", i)
+		}
+		if err := reader.VerifyFile(packFile, file.pack, file.hideName, file.offset, file.length); err != nil {
+			t.Fatalf("file %d: %v", i, err)
+		}
+		equal, err := reader.CompareFile(packFile, file.pack, file.hideName, file.offset, file.length, filepath.Join(dir, fmt.Sprintf("src%d", i)))
+		if err != nil || !equal {
+			t.Fatalf("file %d: compare: %v, %v", i, equal, err)
+		}
+	}
+}
+
+// エントリの位置・隠し名・パックアーカイブの隠し名を入れ替えた場合に ErrPackedFileMismatch を返し、既存のファイルを変更しないことを確認する。
+func TestPackArchiveRejectsMismatchedEntries(t *testing.T) {
+	dir := t.TempDir()
+	// 同じ長さの2つのファイル。位置を入れ替えても長さは一致し、関連データの認証でのみ検出できる
+	files := writeTestPacks(t, dir, [][]byte{[]byte("first file"), []byte("other file")})
+	first, second := files[0], files[1]
+	if first.pack != second.pack || first.length != second.length {
+		t.Fatalf("files are not in the same pack with the same length: %+v", files)
+	}
+	packFile := filepath.Join(dir, first.pack+".bks")
+	
+	tests := []struct {
+		name         string
+		packHideName string
+		hideName     string
+		offset       uint64
+		length       uint64
+	}{
+		{"swapped offset", first.pack, first.hideName, second.offset, second.length},
+		{"other hide name", first.pack, second.hideName, first.offset, first.length},
+		{"other pack", "pack1", first.hideName, first.offset, first.length},
+		{"other length", first.pack, first.hideName, first.offset, first.length - 1},
+	}
+	for _, tt := range tests {
+		destFile := filepath.Join(dir, "existing")
+		if err := os.WriteFile(destFile, []byte("existing"), 0644); err != nil { t.Fatal(err) }
+		err := NewPackReader(testPassword).ImportFile(packFile, tt.packHideName, tt.hideName, tt.offset, tt.length, destFile)
+		if !errors.Is(err, ErrPackedFileMismatch) {
+			t.Errorf("%s: got %v, want ErrPackedFileMismatch", tt.name, err)
+		}
+		if content := mustReadFile(t, destFile); string(content) != "existing" {
+			t.Errorf("%s: existing file was overwritten", tt.name)
+		}
+	}
+}
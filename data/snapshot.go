@@ -0,0 +1,60 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+
+// 1回のバックアップ実行を表すスナップショット。
+// Complete が false のスナップショットは中断されたバックアップで、復元の対象にはしない。
+type Snapshot struct {
+	ID       uint64
+	Time     time.Time
+	Complete bool
+}
+
+// 1スナップショットの固定長レコード: ID(8) + Time(8) + Complete(1) = 17
+const snapshotRecordSize = 8 + 8 + 1
+
+var ImportSnapshotsNotValid = errors.New("snapshot: invalid or truncated record")
+
+// バイナリ列をパースし、Snapshot のスライスに変換する。
+func ImportSnapshots(content []byte) ([]Snapshot, error) {
+	if len(content)%snapshotRecordSize != 0 {
+		return nil, ImportSnapshotsNotValid
+	}
+	snapshots := make([]Snapshot, 0, len(content)/snapshotRecordSize)
+	for len(content) > 0 {
+		snapshots = append(snapshots, Snapshot{
+			ID:       binary.BigEndian.Uint64(content[0:8]),
+			Time:     time.Unix(0, int64(binary.BigEndian.Uint64(content[8:16]))),
+			Complete: content[16] != 0,
+		})
+		content = content[snapshotRecordSize:]
+	}
+	return snapshots, nil
+}
+
+// Snapshot のスライスをバイナリ列にシリアライズする。
+func ExportSnapshots(snapshots []Snapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, s := range snapshots {
+		if err := binary.Write(&buf, binary.BigEndian, s.ID); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.BigEndian, s.Time.UnixNano()); err != nil {
+			return nil, err
+		}
+		complete := byte(0)
+		if s.Complete {
+			complete = 1
+		}
+		if err := buf.WriteByte(complete); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,169 @@
+package data
+
+import (
+	"io"
+	"os"
+	
+	"bakashier/utils"
+)
+
+
+// ホールの読み飛ばしやゼロの書き込みに使うバッファのサイズ。
+const zeroBlockSize = 1024 * 1024
+
+var zeroBlock = make([]byte, zeroBlockSize)
+
+// ホールの合計バイト数を返す。
+func holesSize(holes []utils.HoleRange) uint64 {
+	var total uint64 = 0
+	for _, hole := range holes {
+		total += hole.Length
+	}
+	return total
+}
+
+// ホールの一覧が位置の順に並び、重ならず、長さが 0 でなく、fileSize を超えないかを確認する。
+func validHoles(holes []utils.HoleRange, fileSize uint64) bool {
+	var end uint64 = 0
+	for _, hole := range holes {
+		if hole.Offset < end || hole.Length == 0 || hole.Offset > fileSize || hole.Length > fileSize-hole.Offset {
+			return false
+		}
+		end = hole.Offset + hole.Length
+	}
+	return true
+}
+
+// n バイトのゼロを w に書き込む。
+func writeZeros(w io.Writer, n uint64) error {
+	for n > 0 {
+		size := uint64(zeroBlockSize)
+		if n < size {
+			size = n
+		}
+		if _, err := w.Write(zeroBlock[:size]); err != nil { return err }
+		n -= size
+	}
+	return nil
+}
+
+// ソースのホールを読み飛ばし、データのある範囲のみを順に読み出す。
+// hash にはホールをゼロとして含めたファイル全体の内容を書き込み、平文の SHA-256 がホールの有無で変わらないようにする。
+type sparseReader struct {
+	src   *os.File
+	holes []utils.HoleRange
+	hash  io.Writer
+	pos   uint64 // ファイル内の読み込み位置
+}
+
+func newSparseReader(src *os.File, holes []utils.HoleRange, hash io.Writer) *sparseReader {
+	return &sparseReader{src: src, holes: holes, hash: hash}
+}
+
+func (r *sparseReader) Read(p []byte) (int, error) {
+	if err := r.skipHoles(); err != nil { return 0, err }
+	if len(r.holes) > 0 && uint64(len(p)) > r.holes[0].Offset-r.pos {
+		p = p[:r.holes[0].Offset-r.pos]
+	}
+	n, err := r.src.Read(p)
+	r.hash.Write(p[:n])
+	r.pos += uint64(n)
+	if err == io.EOF && len(r.holes) > 0 {
+		// ホールの手前で終わった場合は、読み込み中にファイルが切り詰められている
+		return n, ErrSourceFileChanged
+	}
+	return n, err
+}
+
+// 読み込み位置から始まるホールを読み飛ばす。
+func (r *sparseReader) skipHoles() error {
+	for len(r.holes) > 0 && r.holes[0].Offset == r.pos {
+		hole := r.holes[0]
+		if _, err := r.src.Seek(int64(hole.Length), io.SeekCurrent); err != nil { return err }
+		if err := writeZeros(r.hash, hole.Length); err != nil { return err }
+		r.pos += hole.Length
+		r.holes = r.holes[1:]
+	}
+	return nil
+}
+
+// 末尾のホールを読み飛ばす。データをすべて読み終えた後に呼び出す。
+// データの後ろがホールで終わるファイルや、全体がホールのファイルでも、ReadBytes がファイルサイズと一致するようにする。
+func (r *sparseReader) Finish() error {
+	return r.skipHoles()
+}
+
+// ホールを含めて読み込んだファイル内のバイト数を返す。
+func (r *sparseReader) ReadBytes() uint64 {
+	return r.pos
+}
+
+// 書き出し先がホールを読み飛ばせる場合に実装する。実装しない書き出し先にはゼロを書き込む。
+type holeSkipper interface {
+	SkipHole(n uint64) error
+}
+
+// ホールを除いたデータを、ホールの位置を読み飛ばしながら dest に書き出す Writer。
+type sparseWriter struct {
+	dest     io.Writer
+	holes    []utils.HoleRange
+	fileSize uint64
+	pos      uint64 // ファイル内の書き込み位置
+}
+
+func newSparseWriter(dest io.Writer, holes []utils.HoleRange, fileSize uint64) *sparseWriter {
+	return &sparseWriter{dest: dest, holes: holes, fileSize: fileSize}
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if err := w.skipHoles(); err != nil { return written, err }
+		n := uint64(len(p))
+		if len(w.holes) > 0 && n > w.holes[0].Offset-w.pos {
+			n = w.holes[0].Offset - w.pos
+		}
+		if n > w.fileSize-w.pos { return written, ImportArchiveChunkMismatch }
+		if _, err := w.dest.Write(p[:n]); err != nil { return written, err }
+		w.pos += n
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// 書き込み位置から始まるホールを読み飛ばす。
+func (w *sparseWriter) skipHoles() error {
+	for len(w.holes) > 0 && w.holes[0].Offset == w.pos {
+		hole := w.holes[0]
+		if skipper, ok := w.dest.(holeSkipper); ok {
+			if err := skipper.SkipHole(hole.Length); err != nil { return err }
+		} else if err := writeZeros(w.dest, hole.Length); err != nil {
+			return err
+		}
+		w.pos += hole.Length
+		w.holes = w.holes[1:]
+	}
+	return nil
+}
+
+// 末尾のホールを読み飛ばし、書き出した内容がファイルサイズと一致するかを確認する。
+func (w *sparseWriter) Finish() error {
+	if err := w.skipHoles(); err != nil { return err }
+	if w.pos != w.fileSize || len(w.holes) > 0 {
+		return ImportArchiveChunkMismatch
+	}
+	return nil
+}
+
+// ホールを書き込まずにシークで読み飛ばすファイル。
+// 末尾のホールも含めてファイルサイズが合うよう、読み飛ばすたびに読み飛ばした位置までファイルを伸ばす。
+type sparseFile struct {
+	*os.File
+}
+
+func (f sparseFile) SkipHole(n uint64) error {
+	end, err := f.Seek(int64(n), io.SeekCurrent)
+	if err != nil { return err }
+	return f.Truncate(end)
+}
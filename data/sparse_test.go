@@ -0,0 +1,70 @@
+//go:build linux || darwin || freebsd
+
+package data
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	
+	"bakashier/utils"
+)
+
+
+// ホールを含むファイルの書き出し・復元で、内容と割り当て済みのブロック数が保たれることを確認する。
+// 末尾のホール（チャンクの境界・チャンクの途中から始まるもの）と全体がホールのファイルも含める。
+func TestStreamArchiveSparseRoundTrip(t *testing.T) {
+	chunkData := func(seed int64) []byte { return randomBytes(int(2*testChunkSize), seed) }
+	tests := []struct {
+		name   string
+		size   int64
+		writes map[int64][]byte // [位置]書き込む内容
+	}{
+		{"fully sparse", 4 * 1024 * 1024, nil},
+		{"trailing hole on a chunk boundary", 1024 * 1024, map[int64][]byte{0: chunkData(1)}},
+		{"trailing hole in the middle of a chunk", 1024 * 1024, map[int64][]byte{0: chunkData(2)[:100*1024]}},
+		{"leading hole", 512*1024 + 2*int64(testChunkSize), map[int64][]byte{512 * 1024: chunkData(3)}},
+		{"empty", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			srcFile := filepath.Join(dir, "src")
+			src, err := os.Create(srcFile)
+			if err != nil { t.Fatal(err) }
+			for offset, content := range tt.writes {
+				if _, err := src.WriteAt(content, offset); err != nil { t.Fatal(err) }
+			}
+			if err := src.Truncate(tt.size); err != nil { t.Fatal(err) }
+			if err := src.Close(); err != nil { t.Fatal(err) }
+			
+			archiveFile := filepath.Join(dir, "archive.bks")
+			if _, err := ExportStreamArchive(srcFile, archiveFile, "src", "hide", testPassword, testKDF, testChunkSize); err != nil {
+				t.Fatal(err)
+			}
+			destFile := filepath.Join(dir, "dest")
+			if err := ImportStreamArchive(archiveFile, "hide", destFile, testPassword); err != nil { t.Fatal(err) }
+			if !bytes.Equal(mustReadFile(t, destFile), mustReadFile(t, srcFile)) {
+				t.Fatal("restored content mismatch")
+			}
+			
+			// ホールを検出できるファイルシステムでは、復元したファイルもホールを書き込まずに復元する
+			src, err = os.Open(srcFile)
+			if err != nil { t.Fatal(err) }
+			defer src.Close()
+			holes, err := utils.FileHoles(src, tt.size)
+			if err != nil { t.Fatal(err) }
+			if len(holes) == 0 { return }
+			srcInfo, err := os.Stat(srcFile)
+			if err != nil { t.Fatal(err) }
+			destInfo, err := os.Stat(destFile)
+			if err != nil { t.Fatal(err) }
+			srcBlocks, destBlocks := srcInfo.Sys().(*syscall.Stat_t).Blocks, destInfo.Sys().(*syscall.Stat_t).Blocks
+			if destBlocks > srcBlocks {
+				t.Fatalf("restored file allocates %d blocks, source allocates %d", destBlocks, srcBlocks)
+			}
+		})
+	}
+}
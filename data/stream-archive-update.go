@@ -0,0 +1,240 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	
+	"bakashier/utils"
+)
+
+
+var errStreamArchiveNotUpdatable = errors.New("archive cannot be used as a base for an incremental update")
+
+// 差分更新の基になるアーカイブが壊れている・改ざんされている・読み込めない場合に UpdateStreamArchive が返す。
+var ErrStreamArchiveBaseUnusable = errors.New("previous archive is corrupted or unreadable")
+
+// 差分更新の基になる v4・v5 のアーカイブ。チャンクごとの平文の SHA-256 と、暗号化済みのチャンクの位置を保持する。
+type streamArchiveBase struct {
+	file    *os.File
+	digests [][]byte
+	offsets []int64 // チャンク長フィールドの位置
+	sizes   []int64 // チャンク長(8) + チャンク + CRC32(4) のバイト数
+}
+
+// baseFile（以前のバックアップのアーカイブ）を基に srcFile を v5 形式の .bks として destFile に書き出す。
+// 平文の SHA-256 が baseFile の同じ番号のチャンクと一致するチャンクは、圧縮・暗号化せずに暗号化済みのバイト列を再利用する。
+// baseFile が存在しない・v4・v5 でない・チャンクサイズや KDF のパラメータが異なる場合は、ExportStreamArchive と同様にすべてのチャンクを書き出す。
+// baseFile が壊れている・改ざんされている・読み込めない場合は、書き出さずに ErrStreamArchiveBaseUnusable をラップしたエラーを返す。
+// baseFile と destFile は同じパスでもよい。書き出した平文の SHA-256 を返す。
+func UpdateStreamArchive(baseFile string, baseHideName string, srcFile string, destFile string, fileName string, hideName string, password string, kdf utils.KDFParams, chunkSize uint64) ([]byte, error) {
+	base, baseKDF, key, err := openStreamArchiveBase(baseFile, baseHideName, password, kdf, chunkSize)
+	if errors.Is(err, errStreamArchiveNotUpdatable) || errors.Is(err, os.ErrNotExist) {
+		return ExportStreamArchive(srcFile, destFile, fileName, hideName, password, kdf, chunkSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStreamArchiveBaseUnusable, err)
+	}
+	defer base.Close()
+	
+	return writeStreamArchive(srcFile, destFile, fileName, hideName, key, baseKDF, chunkSize, base)
+}
+
+// 基のアーカイブを閉じる。閉じた後の呼び出しは何もしない。
+func (b *streamArchiveBase) Close() error {
+	if b.file == nil { return nil }
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// index 番目のチャンクの平文の SHA-256 が digest と一致する場合、暗号化済みのチャンクをチャンク長・CRC32 を含めて返す。
+func (b *streamArchiveBase) rawChunk(index uint64, digest []byte) ([]byte, bool, error) {
+	if index >= uint64(len(b.digests)) || !bytes.Equal(b.digests[index], digest) {
+		return nil, false, nil
+	}
+	raw := make([]byte, b.sizes[index])
+	if _, err := b.file.ReadAt(raw, b.offsets[index]); err != nil {
+		return nil, false, err
+	}
+	return raw, true, nil
+}
+
+// baseFile を開き、ヘッダー・名前・SHA-256 の一覧を検証して、チャンクの位置を読み込む。
+// 鍵は baseFile の KDF で導出し、再利用するチャンクと同じ鍵で書き出せるよう KDF のパラメータとともに返す。
+func openStreamArchiveBase(baseFile string, hideName string, password string, kdf utils.KDFParams, chunkSize uint64) (*streamArchiveBase, utils.KDFParams, []byte, error) {
+	file, err := os.Open(baseFile)
+	if err != nil { return nil, utils.KDFParams{}, nil, err }
+	base, baseKDF, key, err := loadStreamArchiveBase(file, hideName, password, kdf, chunkSize)
+	if err != nil {
+		file.Close()
+		return nil, utils.KDFParams{}, nil, err
+	}
+	return base, baseKDF, key, nil
+}
+
+func loadStreamArchiveBase(file *os.File, hideName string, password string, kdf utils.KDFParams, chunkSize uint64) (*streamArchiveBase, utils.KDFParams, []byte, error) {
+	fileInfo, err := file.Stat()
+	if err != nil { return nil, utils.KDFParams{}, nil, err }
+	size := fileInfo.Size()
+	
+	// 位置 pos から n バイトを読み込む
+	var pos int64 = 0
+	readBytes := func(n uint64) ([]byte, error) {
+		if n > uint64(size-pos) { return nil, ImportArchiveTooShort }
+		buf := make([]byte, n)
+		if _, err := file.ReadAt(buf, pos); err != nil {
+			if err == io.EOF { return nil, ImportArchiveTooShort }
+			return nil, err
+		}
+		pos += int64(n)
+		return buf, nil
+	}
+	
+	// ヘッダを読み込む
+	header, err := readBytes(5 + kdfHeaderSize + 8)
+	if err != nil { return nil, utils.KDFParams{}, nil, err }
+	if header[0] != byte('B') || header[1] != byte('K') || header[2] != byte('S') {
+		return nil, utils.KDFParams{}, nil, ImportArchiveNotValid
+	}
+	version := binary.BigEndian.Uint16(header[3:5])
+	if version != ArchiveVersion4 && version != ArchiveVersion5 {
+		return nil, utils.KDFParams{}, nil, errStreamArchiveNotUpdatable
+	}
+	baseKDF, err := decodeKDFHeader(header[5:])
+	if err != nil { return nil, utils.KDFParams{}, nil, err }
+	chunkCount := binary.BigEndian.Uint64(header[5+kdfHeaderSize:])
+	
+	// KDF の種類・パラメータが変更された場合は、新しいパラメータで書き直す
+	if kdf.Type == 0 {
+		kdf = utils.DefaultKDFParams(utils.KDFPBKDF2SHA256)
+	}
+	if baseKDF.Type != kdf.Type || baseKDF.Time != kdf.Time || baseKDF.Memory != kdf.Memory || baseKDF.Threads != kdf.Threads {
+		return nil, utils.KDFParams{}, nil, errStreamArchiveNotUpdatable
+	}
+	key, err := utils.DeriveKey(password, baseKDF)
+	if err != nil { return nil, utils.KDFParams{}, nil, err }
+	
+	// 名前を復号し、鍵と hideName を確認する
+	nameLenBin, err := readBytes(4)
+	if err != nil { return nil, utils.KDFParams{}, nil, err }
+	nameBytes, err := readBytes(uint64(binary.BigEndian.Uint32(nameLenBin)))
+	if err != nil { return nil, utils.KDFParams{}, nil, err }
+	if _, err := readBytes(4); err != nil { return nil, utils.KDFParams{}, nil, err }
+	if _, err := utils.DecryptBytesWithKey(nameBytes, key, associatedData(associatedName, hideName, 0, chunkCount)); err != nil {
+		return nil, utils.KDFParams{}, nil, ImportArchiveNameMismatch
+	}
+	
+	// SHA-256 の一覧を読み込む
+	trailer, err := readDigestTrailer(file, size, key, hideName, chunkCount, version)
+	if err != nil { return nil, utils.KDFParams{}, nil, err }
+	if trailer.chunkSize != chunkSize {
+		return nil, utils.KDFParams{}, nil, errStreamArchiveNotUpdatable
+	}
+	
+	// チャンク長をたどり、各チャンクの位置を記録する
+	base := &streamArchiveBase{file: file, digests: trailer.digests}
+	chunksEnd := size - int64(trailer.size)
+	for index := uint64(0); index < chunkCount; index++ {
+		offset := pos
+		chunkLenBin, err := readBytes(8)
+		if err != nil { return nil, utils.KDFParams{}, nil, err }
+		chunkLen := binary.BigEndian.Uint64(chunkLenBin)
+		if chunkLen > uint64(chunksEnd-pos) || uint64(chunksEnd-pos)-chunkLen < 4 {
+			return nil, utils.KDFParams{}, nil, ImportArchiveTooShort
+		}
+		pos += int64(chunkLen) + 4
+		base.offsets = append(base.offsets, offset)
+		base.sizes = append(base.sizes, pos-offset)
+	}
+	if pos != chunksEnd {
+		return nil, utils.KDFParams{}, nil, ImportArchiveChunkMismatch
+	}
+	return base, baseKDF, key, nil
+}
+
+// v4 以降のアーカイブの末尾に付加する、チャンクごとの平文の SHA-256 の一覧とホールの範囲。
+type digestTrailer struct {
+	chunkSize uint64
+	digests   [][]byte
+	fileSize  uint64            // ホールを含めたファイルのサイズ（v5 以降）
+	holes     []utils.HoleRange // チャンクに含めなかったホールの範囲（v5 以降）
+	size      uint64            // 末尾の一覧のバイト数
+}
+
+// 末尾の一覧を v5 のアーカイブに付加する形式に変換する。
+// 形式: 暗号化した (chunkSize(8) + fileSize(8) + holeCount(8) + (offset(8) + length(8)) * ホール数 + SHA-256(32) * チャンク数) + CRC32(4) + 長さ(8)
+// hideName とチャンク数を関連データとして認証する。
+func encodeDigestTrailer(key []byte, hideName string, trailer digestTrailer) ([]byte, error) {
+	table := make([]byte, 0, 8*3+len(trailer.holes)*16+len(trailer.digests)*32)
+	table = binary.BigEndian.AppendUint64(table, trailer.chunkSize)
+	table = binary.BigEndian.AppendUint64(table, trailer.fileSize)
+	table = binary.BigEndian.AppendUint64(table, uint64(len(trailer.holes)))
+	for _, hole := range trailer.holes {
+		table = binary.BigEndian.AppendUint64(table, hole.Offset)
+		table = binary.BigEndian.AppendUint64(table, hole.Length)
+	}
+	for _, digest := range trailer.digests {
+		table = append(table, digest...)
+	}
+	encryptedTable, err := utils.EncryptBytesWithKey(table, key, associatedData(associatedDigest, hideName, 0, uint64(len(trailer.digests))))
+	if err != nil { return nil, err }
+	
+	encoded := append([]byte{}, encryptedTable...)
+	encoded = append(encoded, utils.CRC32HashBytes(encryptedTable)...)
+	encoded = binary.BigEndian.AppendUint64(encoded, uint64(len(encryptedTable)))
+	return encoded, nil
+}
+
+// アーカイブの末尾から一覧を読み込む。v4 の一覧はチャンクサイズと SHA-256 の一覧のみを持つ。
+// ホールの範囲は位置の順に並び、ファイルサイズを超えないことを確認する。読み込み位置は変更しない。
+func readDigestTrailer(archive *os.File, size int64, key []byte, hideName string, chunkCount uint64, version uint16) (digestTrailer, error) {
+	if size < 8+4 { return digestTrailer{}, ImportArchiveTooShort }
+	tableLenBin := make([]byte, 8)
+	if _, err := archive.ReadAt(tableLenBin, size-8); err != nil { return digestTrailer{}, err }
+	tableLen := binary.BigEndian.Uint64(tableLenBin)
+	if tableLen > uint64(size)-8-4 { return digestTrailer{}, ImportArchiveTooShort }
+	trailerSize := tableLen + 4 + 8
+	
+	encryptedTable := make([]byte, tableLen+4)
+	if _, err := archive.ReadAt(encryptedTable, size-int64(trailerSize)); err != nil { return digestTrailer{}, err }
+	tableCRC := encryptedTable[tableLen:]
+	encryptedTable = encryptedTable[:tableLen]
+	if !bytes.Equal(tableCRC, utils.CRC32HashBytes(encryptedTable)) {
+		return digestTrailer{}, errors.New("digest table hash mismatch")
+	}
+	table, err := utils.DecryptBytesWithKey(encryptedTable, key, associatedData(associatedDigest, hideName, 0, chunkCount))
+	if err != nil { return digestTrailer{}, ImportArchiveChunkMismatch }
+	if len(table) < 8 { return digestTrailer{}, ImportArchiveChunkMismatch }
+	trailer := digestTrailer{chunkSize: binary.BigEndian.Uint64(table[0:8]), size: trailerSize}
+	table = table[8:]
+	
+	// v5 はファイルサイズとホールの範囲を読み込む
+	if version >= ArchiveVersion5 {
+		if len(table) < 16 { return digestTrailer{}, ImportArchiveChunkMismatch }
+		trailer.fileSize = binary.BigEndian.Uint64(table[0:8])
+		holeCount := binary.BigEndian.Uint64(table[8:16])
+		table = table[16:]
+		if holeCount > uint64(len(table))/16 { return digestTrailer{}, ImportArchiveChunkMismatch }
+		for i := uint64(0); i < holeCount; i++ {
+			trailer.holes = append(trailer.holes, utils.HoleRange{
+				Offset: binary.BigEndian.Uint64(table[0:8]),
+				Length: binary.BigEndian.Uint64(table[8:16]),
+			})
+			table = table[16:]
+		}
+		if !validHoles(trailer.holes, trailer.fileSize) { return digestTrailer{}, ImportArchiveChunkMismatch }
+	}
+	
+	if uint64(len(table))/32 != chunkCount || len(table)%32 != 0 {
+		return digestTrailer{}, ImportArchiveChunkMismatch
+	}
+	trailer.digests = make([][]byte, 0, chunkCount)
+	for offset := 0; offset < len(table); offset += 32 {
+		trailer.digests = append(trailer.digests, table[offset:offset+32])
+	}
+	return trailer, nil
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+// path に乱数で size バイトのファイルを作成し、内容を返す。
+func writeRandomFile(t *testing.T, path string, size int, seed int64) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(content)
+	if err := os.WriteFile(path, content, 0644); err != nil { t.Fatal(err) }
+	return content
+}
+
+// archiveFile の暗号化済みのチャンクを、チャンク長・CRC32 を含めて順に返す。
+func rawStreamArchiveChunks(t *testing.T, archiveFile string, hideName string) [][]byte {
+	t.Helper()
+	base, _, _, err := openStreamArchiveBase(archiveFile, hideName, testPassword, testKDF, testChunkSize)
+	if err != nil { t.Fatal(err) }
+	defer base.Close()
+	chunks := make([][]byte, 0, len(base.offsets))
+	for index := range base.offsets {
+		raw := make([]byte, base.sizes[index])
+		if _, err := base.file.ReadAt(raw, base.offsets[index]); err != nil { t.Fatal(err) }
+		chunks = append(chunks, raw)
+	}
+	return chunks
+}
+
+// 内容が変わっていないチャンクは基のアーカイブからそのままコピーし、変わったチャンクのみを暗号化し直すことを確認する。
+func TestUpdateStreamArchiveReusesUnchangedChunks(t *testing.T) {
+	dir := t.TempDir()
+	srcFile := filepath.Join(dir, "src")
+	baseFile := filepath.Join(dir, "base.bks")
+	destFile := filepath.Join(dir, "updated.bks")
+	content := writeRandomFile(t, srcFile, int(3*testChunkSize+100), 1)
+	if _, err := ExportStreamArchive(srcFile, baseFile, "src", "base", testPassword, testKDF, testChunkSize); err != nil { t.Fatal(err) }
+	
+	// 2番目のチャンクのみを変更する
+	content[testChunkSize+10] ^= 0xFF
+	if err := os.WriteFile(srcFile, content, 0644); err != nil { t.Fatal(err) }
+	checksum, err := UpdateStreamArchive(baseFile, "base", srcFile, destFile, "src", "updated", testPassword, testKDF, testChunkSize)
+	if err != nil { t.Fatal(err) }
+	if want := sha256.Sum256(content); !bytes.Equal(checksum, want[:]) {
+		t.Fatal("checksum mismatch")
+	}
+	
+	baseChunks := rawStreamArchiveChunks(t, baseFile, "base")
+	updatedChunks := rawStreamArchiveChunks(t, destFile, "updated")
+	if len(baseChunks) != 4 || len(updatedChunks) != 4 {
+		t.Fatalf("got %d and %d chunks", len(baseChunks), len(updatedChunks))
+	}
+	for index := range baseChunks {
+		reused := bytes.Equal(baseChunks[index], updatedChunks[index])
+		if reused != (index != 1) {
+			t.Errorf("chunk %d: reused = %v", index, reused)
+		}
+	}
+	
+	got, err := readTestStreamArchive(t, mustReadFile(t, destFile), "updated")
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(got, content) {
+		t.Fatal("updated archive content mismatch")
+	}
+}
+
+// 基のアーカイブと同じパスに書き出す場合に、置き換える前に基のアーカイブを閉じ、更新後の内容を読み出せることを確認する。
+// Windows では開いているファイルに置き換えられないため、閉じていることは base.file で確認する。
+func TestUpdateStreamArchiveInPlace(t *testing.T) {
+	dir := t.TempDir()
+	srcFile := filepath.Join(dir, "src")
+	archiveFile := filepath.Join(dir, "archive.bks")
+	content := writeRandomFile(t, srcFile, int(3*testChunkSize+100), 5)
+	if _, err := ExportStreamArchive(srcFile, archiveFile, "src", "archive", testPassword, testKDF, testChunkSize); err != nil { t.Fatal(err) }
+	before := rawStreamArchiveChunks(t, archiveFile, "archive")
+	
+	content[2*testChunkSize+1] ^= 0xFF
+	if err := os.WriteFile(srcFile, content, 0644); err != nil { t.Fatal(err) }
+	base, baseKDF, key, err := openStreamArchiveBase(archiveFile, "archive", testPassword, testKDF, testChunkSize)
+	if err != nil { t.Fatal(err) }
+	defer base.Close()
+	if _, err := writeStreamArchive(srcFile, archiveFile, "src", "archive", key, baseKDF, testChunkSize, base); err != nil { t.Fatal(err) }
+	if base.file != nil {
+		t.Fatal("base archive is still open after the update was committed")
+	}
+	
+	after := rawStreamArchiveChunks(t, archiveFile, "archive")
+	if len(after) != len(before) || !bytes.Equal(after[0], before[0]) || bytes.Equal(after[2], before[2]) {
+		t.Fatal("unchanged chunks were not reused or the changed chunk was not rewritten")
+	}
+	
+	// 公開の関数でも同じパスに続けて更新できる
+	content[0] ^= 0xFF
+	if err := os.WriteFile(srcFile, content, 0644); err != nil { t.Fatal(err) }
+	if _, err := UpdateStreamArchive(archiveFile, "archive", srcFile, archiveFile, "src", "archive", testPassword, testKDF, testChunkSize); err != nil { t.Fatal(err) }
+	got, err := readTestStreamArchive(t, mustReadFile(t, archiveFile), "archive")
+	if err != nil { t.Fatal(err) }
+	if !bytes.Equal(got, content) {
+		t.Fatal("archive updated in place has different content")
+	}
+}
+
+// 基のアーカイブが存在しない・以前のバージョン・チャンクサイズが異なる場合は、エラーにせずすべてのチャンクを書き出すことを確認する。
+func TestUpdateStreamArchiveFallsBackToFullExport(t *testing.T) {
+	dir := t.TempDir()
+	srcFile := filepath.Join(dir, "src")
+	content := writeRandomFile(t, srcFile, int(2*testChunkSize), 2)
+	
+	otherChunkSize := filepath.Join(dir, "other-chunk-size.bks")
+	if _, err := ExportStreamArchive(srcFile, otherChunkSize, "src", "base", testPassword, testKDF, testChunkSize/2); err != nil { t.Fatal(err) }
+	olderVersion := filepath.Join(dir, "v3.bks")
+	if err := os.WriteFile(olderVersion, testStreamArchive(t, ArchiveVersion3, "src", "base", [][]byte{content}), 0644); err != nil { t.Fatal(err) }
+	
+	for _, baseFile := range []string{filepath.Join(dir, "missing.bks"), otherChunkSize, olderVersion} {
+		destFile := filepath.Join(dir, "updated.bks")
+		if _, err := UpdateStreamArchive(baseFile, "base", srcFile, destFile, "src", "updated", testPassword, testKDF, testChunkSize); err != nil {
+			t.Fatalf("%s: %v", filepath.Base(baseFile), err)
+		}
+		got, err := readTestStreamArchive(t, mustReadFile(t, destFile), "updated")
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("%s: content mismatch (%v)", filepath.Base(baseFile), err)
+		}
+	}
+}
+
+// 基のアーカイブが壊れている・改ざんされている場合は、書き出さずに ErrStreamArchiveBaseUnusable を返すことを確認する。
+func TestUpdateStreamArchiveReportsUnusableBase(t *testing.T) {
+	dir := t.TempDir()
+	srcFile := filepath.Join(dir, "src")
+	writeRandomFile(t, srcFile, int(2*testChunkSize), 3)
+	baseFile := filepath.Join(dir, "base.bks")
+	if _, err := ExportStreamArchive(srcFile, baseFile, "src", "base", testPassword, testKDF, testChunkSize); err != nil { t.Fatal(err) }
+	base := mustReadFile(t, baseFile)
+	
+	corruptTable := append([]byte{}, base...)
+	corruptTable[len(corruptTable)-20] ^= 0xFF
+	truncated := base[:len(base)-100]
+	tests := []struct {
+		name     string
+		content  []byte
+		hideName string
+	}{
+		{"corrupted digest table", corruptTable, "base"},
+		{"truncated", truncated, "base"},
+		{"other hide name", base, "other"},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(baseFile, tt.content, 0644); err != nil { t.Fatal(err) }
+		destFile := filepath.Join(dir, "updated.bks")
+		_, err := UpdateStreamArchive(baseFile, tt.hideName, srcFile, destFile, "src", "updated", testPassword, testKDF, testChunkSize)
+		if !errors.Is(err, ErrStreamArchiveBaseUnusable) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if _, err := os.Stat(destFile); !os.IsNotExist(err) {
+			t.Errorf("%s: archive was written", tt.name)
+		}
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil { t.Fatal(err) }
+	return content
+}
@@ -2,11 +2,11 @@ package data
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"io"
 	"os"
-	"path/filepath"
 	
 	"bakashier/utils"
 )
@@ -14,146 +14,353 @@ import (
 
 var ChunkSize uint64 = 16 * 1024 * 1024 // 16MB
 
-func ExportStreamArchive(srcFile string, destFile string, fileName string, password string, chunkSize uint64) error {
-	// ソースファイルのサイズを取得
-	fileInfo, err := os.Stat(srcFile)
-	if err != nil { return err }
-	srcFileSize := uint64(fileInfo.Size())
+// srcFile をチャンクごとに圧縮・暗号化し、v5 形式の .bks として destFile に書き出す。
+// 鍵は kdf のパラメータで1度だけ導出し、各チャンクの番号を関連データとして認証する。
+// スパースファイルのホールは読み込まずにチャンクから除き、範囲のみを記録する。
+// 末尾にはチャンクごとの平文の SHA-256 の一覧とホールの範囲を、hideName とチャンク数を関連データとして暗号化して付加する。
+// 一時ファイルに書き込み、fsync してから destFile に置き換える。失敗した場合は既存の destFile を残す。
+// 書き出した平文の SHA-256 を返す。
+func ExportStreamArchive(srcFile string, destFile string, fileName string, hideName string, password string, kdf utils.KDFParams, chunkSize uint64) ([]byte, error) {
+	// 鍵を1度だけ導出する
+	kdf, err := utils.NewKDFParams(kdf)
+	if err != nil { return nil, err }
+	key, err := utils.DeriveKey(password, kdf)
+	if err != nil { return nil, err }
 	
-	// ソースファイルを開く
+	return writeStreamArchive(srcFile, destFile, fileName, hideName, key, kdf, chunkSize, nil)
+}
+
+// srcFile を v5 形式の .bks として destFile に書き出す。
+// base が nil でない場合は、平文の SHA-256 が base の同じ番号のチャンクと一致するチャンクを、
+// 圧縮・暗号化せずに base の暗号化済みのバイト列をそのまま書き込む。key と kdf は base と同じでなければならない。
+func writeStreamArchive(srcFile string, destFile string, fileName string, hideName string, key []byte, kdf utils.KDFParams, chunkSize uint64, base *streamArchiveBase) ([]byte, error) {
+	// ソースファイルを開き、サイズを取得
 	src, err := os.Open(srcFile)
-	if err != nil { return err }
+	if err != nil { return nil, err }
 	defer src.Close()
+	fileInfo, err := src.Stat()
+	if err != nil { return nil, err }
 	
-	// 書き出し先ファイルを開く
-	dest, err := os.Create(destFile)
-	if err != nil { return err }
-	defer dest.Close()
+	// ホールを検出し、ホールを除いたデータのサイズからチャンク数を求める
+	holes, err := utils.FileHoles(src, fileInfo.Size())
+	if err != nil { return nil, err }
+	dataSize := uint64(fileInfo.Size()) - holesSize(holes)
+	chunkCount := (dataSize + chunkSize - 1) / chunkSize
+	
+	// 書き出し先の一時ファイルを開く
+	dest, err := utils.CreateAtomicFile(destFile)
+	if err != nil { return nil, err }
+	defer dest.Abort()
+	if err := dest.Chmod(0644); err != nil { return nil, err }
 	
 	// ファイル名を圧縮・暗号化
 	nameBytes := []byte(fileName)
 	compressedName, err := utils.CompressBytes(nameBytes)
-	if err != nil { return err }
-	encryptedName, err := utils.EncryptBytesWithPassword(compressedName, password)
-	if err != nil { return err }
+	if err != nil { return nil, err }
+	encryptedName, err := utils.EncryptBytesWithKey(compressedName, key, associatedData(associatedName, hideName, 0, chunkCount))
+	if err != nil { return nil, err }
 	
 	// ヘッダを書き込む
-	var versionBin = make([]byte, 2)
-	var nameLenBin = make([]byte, 4)
-	binary.BigEndian.PutUint16(versionBin, 1)
-	binary.BigEndian.PutUint32(nameLenBin, uint32(len(encryptedName)))
-	dest.Write([]byte("BKS"))
-	dest.Write(versionBin)
-	dest.Write(nameLenBin)
-	dest.Write(encryptedName)
-	dest.Write(utils.CRC32HashBytes(encryptedName))
-	
-	var remainSize = srcFileSize
-	for {
-		if remainSize < chunkSize {
-			chunkSize = remainSize
-		}
-		chunk := make([]byte, chunkSize)
-		n, err := src.Read(chunk)
-		if err == io.EOF || n == 0 { break }
-		if err != nil { return err }
-		remainSize -= uint64(n)
+	var header []byte
+	header = append(header, []byte("BKS")...)
+	header = binary.BigEndian.AppendUint16(header, ArchiveVersion5)
+	header = append(header, encodeKDFHeader(kdf)...)
+	header = binary.BigEndian.AppendUint64(header, chunkCount)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(encryptedName)))
+	header = append(header, encryptedName...)
+	header = append(header, utils.CRC32HashBytes(encryptedName)...)
+	if _, err := dest.Write(header); err != nil { return nil, err }
+	
+	checksum := sha256.New()
+	sparse := newSparseReader(src, holes, checksum)
+	reader := newChunkReader(sparse, chunkSize)
+	digests := make([][]byte, 0, chunkCount)
+	var index uint64 = 0
+	for ; index < chunkCount; index++ {
+		chunk, err := reader.Next()
+		if err == io.EOF { break }
+		if err != nil { return nil, err }
 		
-		// CRC32 ハッシュを計算
+		// SHA-256 と CRC32 ハッシュを計算
+		digest := sha256.Sum256(chunk)
+		digests = append(digests, digest[:])
 		chunkCRC := utils.CRC32HashBytes(chunk)
 		
+		// 内容が変わっていないチャンクは、基になるアーカイブの暗号化済みのバイト列を再利用する
+		if base != nil {
+			raw, ok, err := base.rawChunk(index, digest[:])
+			if err != nil { return nil, err }
+			if ok {
+				if _, err := dest.Write(raw); err != nil { return nil, err }
+				continue
+			}
+		}
+		
 		// 圧縮 → 暗号化
 		chunkCompressed, err := utils.CompressBytes(chunk)
-		if err != nil { return err }
-		chunkEncrypted, err := utils.EncryptBytesWithPassword(chunkCompressed, password)
-		if err != nil { return err }
+		if err != nil { return nil, err }
+		chunkEncrypted, err := utils.EncryptBytesWithKey(chunkCompressed, key, blockAssociatedData(index))
+		if err != nil { return nil, err }
 		
 		// チャンク長を書き込む
 		chunkLenBin := make([]byte, 8)
 		binary.BigEndian.PutUint64(chunkLenBin, uint64(len(chunkEncrypted)))
 		
 		// チャンクを書き込む
-		dest.Write(chunkLenBin)
-		dest.Write(chunkEncrypted)
-		dest.Write(chunkCRC)
+		if _, err := dest.Write(chunkLenBin); err != nil { return nil, err }
+		if _, err := dest.Write(chunkEncrypted); err != nil { return nil, err }
+		if _, err := dest.Write(chunkCRC); err != nil { return nil, err }
 	}
 	
-	return nil
+	// 末尾のホールを読み飛ばし、読み込み中にファイルが変更されていないかを確認する
+	if err := sparse.Finish(); err != nil { return nil, err }
+	if err := checkSourceUnchanged(src, fileInfo, sparse.ReadBytes()); err != nil {
+		return nil, err
+	}
+	
+	// チャンクの SHA-256 の一覧とホールの範囲を書き込む
+	trailer, err := encodeDigestTrailer(key, hideName, digestTrailer{
+		chunkSize: chunkSize,
+		digests:   digests,
+		fileSize:  uint64(fileInfo.Size()),
+		holes:     holes,
+	})
+	if err != nil { return nil, err }
+	if _, err := dest.Write(trailer); err != nil { return nil, err }
+	
+	// 書き込みを確定する。base と destFile は同じパスの場合があり、Windows では開いているファイルを置き換えられないため、先に base を閉じる
+	if base != nil {
+		if err := base.Close(); err != nil { return nil, err }
+	}
+	if err := dest.Commit(); err != nil { return nil, err }
+	return checksum.Sum(nil), nil
 }
 
-func ImportStreamArchive(archiveFile string, destDirectory string, password string) (error, string) {
+// archiveFile（v1〜v5）を復号・展開し、destFile に書き出す。v5 のホールは書き込まずに読み飛ばし、スパースファイルとして復元する。
+// アーカイブに記録された名前は書き出し先に使用しない。書き出し先の検証は呼び出し側で行う。
+func ImportStreamArchive(archiveFile string, hideName string, destFile string, password string) error {
+	return readStreamArchive(archiveFile, hideName, password, func() (io.WriteCloser, error) {
+		dest, err := os.Create(destFile)
+		if err != nil { return nil, err }
+		return sparseFile{dest}, nil
+	})
+}
+
+// archiveFile（v1〜v5）のすべてのチャンクを復号・展開して CRC32 を検証する。ファイルは書き出さない。
+func VerifyStreamArchive(archiveFile string, hideName string, password string) error {
+	return readStreamArchive(archiveFile, hideName, password, func() (io.WriteCloser, error) {
+		return nopWriteCloser{io.Discard}, nil
+	})
+}
+
+// archiveFile を復号・展開した内容が liveFile の内容と一致するかを比較する。ファイルは書き出さない。
+func CompareStreamArchive(archiveFile string, hideName string, password string, liveFile string) (bool, error) {
+	live, err := os.Open(liveFile)
+	if err != nil { return false, err }
+	defer live.Close()
+	
+	comparer := &compareWriter{src: live, equal: true}
+	err = readStreamArchive(archiveFile, hideName, password, func() (io.WriteCloser, error) {
+		return nopWriteCloser{comparer}, nil
+	})
+	if err != nil { return false, err }
+	
+	// アーカイブより実ファイルが長い場合は不一致
+	if comparer.equal {
+		if n, _ := live.Read(make([]byte, 1)); n > 0 {
+			comparer.equal = false
+		}
+	}
+	return comparer.equal, nil
+}
+
+// 書き込まれたデータを src から読んだデータと比較する Writer。
+type compareWriter struct {
+	src   io.Reader
+	buf   []byte
+	equal bool
+}
+
+func (w *compareWriter) Write(p []byte) (int, error) {
+	if !w.equal {
+		return len(p), nil
+	}
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	buf := w.buf[:len(p)]
+	n, _ := io.ReadFull(w.src, buf)
+	if n != len(p) || !bytes.Equal(buf, p) {
+		w.equal = false
+	}
+	return len(p), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// archiveFile を読み込み、復号・展開したデータを openDest で開いた書き出し先に書き込む。
+// 書き出し先はヘッダーと名前の検証が済んでから開く。
+// KDF はヘッダーに記録されたものを自動的に使用する。v3 以降は hideName とチャンクの順序・欠落を検証する。
+// v4 以降は末尾のチャンクの SHA-256 の一覧を先に読み込み、各チャンクの平文と照合する。
+// v5 はチャンクをホールの範囲を除いた位置に書き出し、ホールは書き出し先が対応していれば読み飛ばす。
+// 長さフィールドはすべてアーカイブの残りサイズと照合し、不正な場合は ImportArchive* のエラーを返す。
+func readStreamArchive(archiveFile string, hideName string, password string, openDest func() (io.WriteCloser, error)) error {
 	// アーカイブファイルを開く
 	archive, err := os.Open(archiveFile)
-	if err != nil { return err, "" }
+	if err != nil { return err }
 	defer archive.Close()
+	archiveInfo, err := archive.Stat()
+	if err != nil { return err }
+	
+	// 残りサイズを超えない範囲で n バイトを読み込む
+	remaining := uint64(archiveInfo.Size())
+	readBytes := func(n uint64) ([]byte, error) {
+		if n > remaining { return nil, ImportArchiveTooShort }
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(archive, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF { return nil, ImportArchiveTooShort }
+			return nil, err
+		}
+		remaining -= n
+		return buf, nil
+	}
 	
 	// ヘッダを読み込む
-	header := make([]byte, 9)
-	_, err = archive.Read(header)
-	if err != nil { return err, "" }
+	header, err := readBytes(5)
+	if err != nil { return err }
 	if header[0] != byte('B') || header[1] != byte('K') || header[2] != byte('S') {
-		return errors.New("file is not a valid archived file"), ""
+		return ImportArchiveNotValid
 	}
-	if binary.BigEndian.Uint16(header[3:5]) != 1 {
-		return errors.New("unsupported version number"), ""
+	
+	// バージョンに応じた復号関数を用意する（v2 以降は鍵を1度だけ導出する）
+	version := binary.BigEndian.Uint16(header[3:5])
+	decrypt := func(cipherData []byte, additionalData []byte) ([]byte, error) {
+		return utils.DecryptBytesWithPassword(cipherData, password)
+	}
+	var chunkCount uint64 = 0
+	var key []byte
+	switch version {
+	case ArchiveVersion1:
+	case ArchiveVersion2, ArchiveVersion3, ArchiveVersion4, ArchiveVersion5:
+		kdfHeader, err := readBytes(kdfHeaderSize)
+		if err != nil { return err }
+		kdf, err := decodeKDFHeader(kdfHeader)
+		if err != nil { return err }
+		if version >= ArchiveVersion3 {
+			chunkCountBin, err := readBytes(8)
+			if err != nil { return err }
+			chunkCount = binary.BigEndian.Uint64(chunkCountBin)
+		}
+		key, err = utils.DeriveKey(password, kdf)
+		if err != nil { return err }
+		decrypt = func(cipherData []byte, additionalData []byte) ([]byte, error) {
+			if version < ArchiveVersion3 {
+				additionalData = nil
+			}
+			return utils.DecryptBytesWithKey(cipherData, key, additionalData)
+		}
+	default:
+		return ImportArchiveUnsupportedVersion
 	}
 	
 	// 名前情報の取得
-	nameLen := binary.BigEndian.Uint32(header[5:9])
-	nameBytes := make([]byte, nameLen)
-	nameHash := make([]byte, 4)
-	_, err = archive.Read(nameBytes)
-	if err != nil { return err, "" }
-	decryptedName, err := utils.DecryptBytesWithPassword(nameBytes, password)
-	if err != nil { return err, "" }
-	decompressedName, err := utils.DecompressBytes(decryptedName)
-	if err != nil { return err, "" }
-	name := string(decompressedName)
-	_, err = archive.Read(nameHash)
-	if err != nil { return err, "" }
+	nameLenBin, err := readBytes(4)
+	if err != nil { return err }
+	nameLen := binary.BigEndian.Uint32(nameLenBin)
+	nameBytes, err := readBytes(uint64(nameLen))
+	if err != nil { return err }
+	nameHash, err := readBytes(4)
+	if err != nil { return err }
 	if !bytes.Equal(nameHash, utils.CRC32HashBytes(nameBytes)) {
-		return errors.New("name hash mismatch"), ""
+		return errors.New("name hash mismatch")
 	}
+	decryptedName, err := decrypt(nameBytes, associatedData(associatedName, hideName, 0, chunkCount))
+	if err != nil {
+		if version >= ArchiveVersion3 { return ImportArchiveNameMismatch }
+		return err
+	}
+	if _, err := utils.DecompressBytes(decryptedName); err != nil { return err }
 	
-	// 書き出し先ファイルを開く
-	destFile := filepath.Join(destDirectory, name)
-	dest, err := os.Create(destFile)
-	if err != nil { return err, "" }
-	defer dest.Close()
+	// v4 以降はチャンクの SHA-256 の一覧を読み込み、一覧の手前までをチャンクとして扱う
+	var trailer digestTrailer
+	if version >= ArchiveVersion4 {
+		trailer, err = readDigestTrailer(archive, archiveInfo.Size(), key, hideName, chunkCount, version)
+		if err != nil { return err }
+		if trailer.size > remaining { return ImportArchiveTooShort }
+		remaining -= trailer.size
+	}
+	
+	// 書き出し先を開く
+	destFile, err := openDest()
+	if err != nil { return err }
+	defer destFile.Close()
+	var dest io.Writer = destFile
+	var sparse *sparseWriter
+	if version >= ArchiveVersion5 {
+		sparse = newSparseWriter(destFile, trailer.holes, trailer.fileSize)
+		dest = sparse
+	}
 	
 	// チャンクを読み込む
-	for {
+	var index uint64 = 0
+	for ; remaining > 0; index++ {
+		if version >= ArchiveVersion3 && index >= chunkCount {
+			return ImportArchiveChunkMismatch
+		}
+		
 		// チャンク長を読み込む
-		chunkLenBin := make([]byte, 8)
-		_, err = archive.Read(chunkLenBin)
-		if err == io.EOF { break }
-		if err != nil { return err, "" }
+		chunkLenBin, err := readBytes(8)
+		if err != nil { return err }
 		chunkLen := binary.BigEndian.Uint64(chunkLenBin)
 		
 		// チャンクを読み込む
-		chunk := make([]byte, chunkLen)
-		_, err = archive.Read(chunk)
-		if err != nil { return err, "" }
+		chunk, err := readBytes(chunkLen)
+		if err != nil { return err }
 		
 		// CRC32 ハッシュを読み込む
-		chunkCRC := make([]byte, 4)
-		_, err = archive.Read(chunkCRC)
-		if err != nil { return err, "" }
+		chunkCRC, err := readBytes(4)
+		if err != nil { return err }
 		
 		// チャンクを復号・展開
-		chunkDecrypted, err := utils.DecryptBytesWithPassword(chunk, password)
-		if err != nil { return err, "" }
+		chunkAD := associatedData(associatedChunk, hideName, index, chunkCount)
+		if version >= ArchiveVersion4 {
+			chunkAD = blockAssociatedData(index)
+		}
+		chunkDecrypted, err := decrypt(chunk, chunkAD)
+		if err != nil {
+			if version >= ArchiveVersion3 { return ImportArchiveChunkMismatch }
+			return err
+		}
 		chunkDecompressed, err := utils.DecompressBytes(chunkDecrypted)
-		if err != nil { return err, "" }
-		
-		// チャンクを書き出す
-		dest.Write(chunkDecompressed)
+		if err != nil { return err }
 		
 		// CRC32 ハッシュを検証
 		if !bytes.Equal(chunkCRC, utils.CRC32HashBytes(chunkDecompressed)) {
-			return errors.New("chunk CRC32 hash mismatch"), ""
+			return errors.New("chunk CRC32 hash mismatch")
+		}
+		
+		// SHA-256 を一覧と照合する（他のアーカイブのチャンクとの入れ替えを検出する）
+		if version >= ArchiveVersion4 {
+			digest := sha256.Sum256(chunkDecompressed)
+			if !bytes.Equal(digest[:], trailer.digests[index]) { return ImportArchiveChunkMismatch }
 		}
+		
+		// チャンクを書き出す
+		if _, err := dest.Write(chunkDecompressed); err != nil { return err }
+	}
+	if version >= ArchiveVersion3 && index != chunkCount {
+		return ImportArchiveChunkMismatch
+	}
+	
+	// 末尾のホールを読み飛ばし、ホールを含めたサイズを確認する
+	if sparse != nil {
+		if err := sparse.Finish(); err != nil { return err }
 	}
 	
-	return nil, destFile
+	// 書き出し先を閉じる際のエラーも返し、最後の書き込みの失敗を見逃さないようにする
+	return destFile.Close()
 }
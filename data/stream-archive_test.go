@@ -0,0 +1,125 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+
+// content を一時ファイルに書き出し、readStreamArchive で読み込んだ内容を返す。
+func readTestStreamArchive(t testing.TB, content []byte, hideName string) ([]byte, error) {
+	archiveFile := filepath.Join(t.TempDir(), "archive.bks")
+	if err := os.WriteFile(archiveFile, content, 0644); err != nil { t.Fatal(err) }
+	var out bytes.Buffer
+	err := readStreamArchive(archiveFile, hideName, testPassword, func() (io.WriteCloser, error) {
+		return nopWriteCloser{&out}, nil
+	})
+	return out.Bytes(), err
+}
+
+// v1〜v5 のストリームアーカイブを読み込み、内容が元に戻ることを確認する。
+func TestReadStreamArchiveAllVersions(t *testing.T) {
+	chunks := [][]byte{[]byte("first chunk"), bytes.Repeat([]byte{0xCD}, 1000), []byte("last")}
+	for version := ArchiveVersion1; version <= ArchiveVersion5; version++ {
+		got, err := readTestStreamArchive(t, testStreamArchive(t, version, "name", "hide-name", chunks), "hide-name")
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if !bytes.Equal(got, bytes.Join(chunks, nil)) {
+			t.Fatalf("v%d: content mismatch", version)
+		}
+	}
+}
+
+// チャンク数を持つ v3 以降で、途中で切れたアーカイブと別の隠し名のアーカイブを拒否することを確認する。
+func TestReadStreamArchiveRejectsTruncated(t *testing.T) {
+	chunks := [][]byte{[]byte("first"), []byte("second")}
+	for version := ArchiveVersion3; version <= ArchiveVersion5; version++ {
+		content := testStreamArchive(t, version, "name", "hide-name", chunks)
+		for n := 0; n < len(content); n++ {
+			if _, err := readTestStreamArchive(t, content[:n], "hide-name"); err == nil {
+				t.Fatalf("v%d: accepted a prefix of %d bytes", version, n)
+			}
+		}
+		if _, err := readTestStreamArchive(t, content, "other-name"); err == nil {
+			t.Fatalf("v%d: accepted another hide name", version)
+		}
+	}
+}
+
+// 任意の入力に対して readStreamArchive が panic しないことを確認する。
+func FuzzReadStreamArchive(f *testing.F) {
+	chunks := [][]byte{[]byte("first"), []byte("second")}
+	for version := ArchiveVersion1; version <= ArchiveVersion5; version++ {
+		f.Add(testStreamArchive(f, version, "name", "hide-name", chunks))
+	}
+	f.Add(testStreamArchive(f, ArchiveVersion5, "name", "hide-name", nil))
+	f.Add([]byte("BKS"))
+	
+	f.Fuzz(func(t *testing.T, content []byte) {
+		readTestStreamArchive(t, content, "hide-name")
+	})
+}
+
+// archiveFile をヘッダー・暗号化済みのチャンク（チャンク長・CRC32 を含む）・末尾の一覧に分けて返す。
+func splitTestStreamArchive(t *testing.T, archiveFile string, hideName string) (header []byte, chunks [][]byte, trailer []byte) {
+	t.Helper()
+	content := mustReadFile(t, archiveFile)
+	base, _, _, err := openStreamArchiveBase(archiveFile, hideName, testPassword, testKDF, testChunkSize)
+	if err != nil { t.Fatal(err) }
+	defer base.Close()
+	last := len(base.offsets) - 1
+	for index := range base.offsets {
+		chunks = append(chunks, content[base.offsets[index]:base.offsets[index]+base.sizes[index]])
+	}
+	return content[:base.offsets[0]], chunks, content[base.offsets[last]+base.sizes[last]:]
+}
+
+// ImportStreamArchive が、チャンクの入れ替え・末尾のチャンクの欠落・他のアーカイブのチャンクへの差し替えを拒否することを確認する。
+func TestImportStreamArchiveRejectsRearrangedChunks(t *testing.T) {
+	dir := t.TempDir()
+	srcFile := filepath.Join(dir, "src")
+	otherFile := filepath.Join(dir, "other")
+	archiveFile := filepath.Join(dir, "archive.bks")
+	otherArchiveFile := filepath.Join(dir, "other.bks")
+	writeRandomFile(t, srcFile, int(3*testChunkSize+100), 1)
+	writeRandomFile(t, otherFile, int(3*testChunkSize+100), 2)
+	if _, err := ExportStreamArchive(srcFile, archiveFile, "src", "hide-name", testPassword, testKDF, testChunkSize); err != nil { t.Fatal(err) }
+	if _, err := ExportStreamArchive(otherFile, otherArchiveFile, "src", "hide-name", testPassword, testKDF, testChunkSize); err != nil { t.Fatal(err) }
+	header, chunks, trailer := splitTestStreamArchive(t, archiveFile, "hide-name")
+	_, otherChunks, _ := splitTestStreamArchive(t, otherArchiveFile, "hide-name")
+	if len(chunks) != 4 || len(otherChunks) != 4 {
+		t.Fatalf("got %d and %d chunks, want 4", len(chunks), len(otherChunks))
+	}
+	
+	tests := []struct {
+		name   string
+		chunks [][]byte
+	}{
+		{"swapped", [][]byte{chunks[0], chunks[2], chunks[1], chunks[3]}},
+		{"last chunk dropped", chunks[:3]},
+		{"chunk from another archive", [][]byte{chunks[0], otherChunks[1], chunks[2], chunks[3]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := filepath.Join(t.TempDir(), "tampered.bks")
+			content := append(append(append([]byte{}, header...), bytes.Join(tt.chunks, nil)...), trailer...)
+			if err := os.WriteFile(tampered, content, 0644); err != nil { t.Fatal(err) }
+			err := ImportStreamArchive(tampered, "hide-name", filepath.Join(t.TempDir(), "restored"), testPassword)
+			if !errors.Is(err, ImportArchiveChunkMismatch) {
+				t.Fatalf("got %v, want %v", err, ImportArchiveChunkMismatch)
+			}
+		})
+	}
+	
+	// 改ざんしていないアーカイブは復元できる
+	restored := filepath.Join(dir, "restored")
+	if err := ImportStreamArchive(archiveFile, "hide-name", restored, testPassword); err != nil { t.Fatal(err) }
+	if !bytes.Equal(mustReadFile(t, restored), mustReadFile(t, srcFile)) {
+		t.Fatal("content mismatch")
+	}
+}
@@ -28,8 +28,27 @@ func main() {
 		Workers: args.Workers,
 		ChunkSize: args.ChunkSize,
 		Limit: core.SettingsLimit{Size: args.LimitSize, Wait: args.LimitWait},
+		KDF: args.KDF,
+		RestoreUnsafeNames: args.RestoreUnsafeNames,
+		DiffContent: args.DiffContent,
+		DryRun: args.DryRun,
+		Filters: args.Filters,
+		PruneExcluded: args.PruneExcluded,
+		FollowSymlinks: args.FollowSymlinks,
+		Xattrs: args.Xattrs,
+		Checksum: args.Checksum,
+		ChecksumInterval: args.ChecksumInterval,
+		Dedup: args.Dedup,
+		PackThreshold: args.PackThreshold,
+		SnapshotID: args.SnapshotID,
+		SnapshotTime: args.SnapshotTime,
+		Retention: core.SettingsRetention{Last: args.KeepLast, Daily: args.KeepDaily, Weekly: args.KeepWeekly, Monthly: args.KeepMonthly, Within: args.KeepWithin},
+		Paths: args.Paths,
+		OnConflict: core.ConflictPolicy(args.OnConflict),
+		NoOwner: args.NoOwner,
+		SkipXattrNamespaces: args.SkipXattrNamespaces,
 	}
-	run := func() {
+	inputPassword := func() {
 		if settings.Password == "" {
 			input, err := cli.InputPassword()
 			if err != nil {
@@ -38,6 +57,9 @@ func main() {
 			}
 			settings.Password = input
 		}
+	}
+	run := func() (failed bool) {
+		inputPassword()
 		
 		wg := sync.WaitGroup{}
 		toViewQueue := make(chan view.MessageToView, 64)
@@ -49,31 +71,110 @@ func main() {
 			model, err := view.Run(args.Mode, toViewQueue, toManagerQueue)
 			if err != nil {
 				fmt.Println(err.Error())
+				failed = true
 				return
 			}
 			
+			// 警告はエラーとせずに表示する
+			for _, w := range model.WarningLog {
+				fmt.Println(w)
+			}
+			
+			// 検証の場合はファイルごとの結果と集計を表示する
+			if args.Mode == cli.ModeVerify {
+				for _, r := range model.ResultLog {
+					fmt.Println(r)
+				}
+				fmt.Printf("%d passed, %d failed\n", model.Passed, model.Failed)
+				// 検証を開始できなかった場合は、その理由を表示する
+				if model.Failed == 0 {
+					for _, e := range model.ErrorLog {
+						fmt.Println(e)
+					}
+				}
+				failed = model.Failed > 0 || len(model.ErrorLog) > 0
+				return
+			}
+			
+			// 差分の場合は差分の一覧を表示する
+			if args.Mode == cli.ModeDiff {
+				for _, d := range model.DiffLog {
+					fmt.Println(d)
+				}
+				failed = len(model.DiffLog) > 0 || len(model.ErrorLog) > 0
+			}
+			
+			// DryRun と整理の場合は実行予定（実行内容）の一覧を表示する
+			if args.DryRun || args.Mode == cli.ModePrune {
+				for _, p := range model.PlanLog {
+					fmt.Println(p)
+				}
+			}
+			
+			// 復元の場合は既存のファイルとの競合と判断の一覧を表示する
+			if args.Mode == cli.ModeRestore {
+				for _, c := range model.ConflictLog {
+					fmt.Println(c)
+				}
+			}
+			
 			if len(model.ErrorLog) > 0 {
 				for _, e := range model.ErrorLog {
 					fmt.Println(e)
 				}
+				failed = args.Mode == cli.ModePrune || args.Mode == cli.ModeRestore
 			}
 		}()
-		if args.Mode == cli.ModeBackup {
+		switch args.Mode {
+		case cli.ModeBackup:
 			core.Backup(settings, toViewQueue, toManagerQueue)
-		} else {
+		case cli.ModeRestore:
 			core.Restore(settings, toViewQueue, toManagerQueue)
+		case cli.ModeVerify:
+			core.Verify(settings, toViewQueue, toManagerQueue)
+		case cli.ModeDiff:
+			core.Diff(settings, toViewQueue, toManagerQueue)
+		case cli.ModePrune:
+			core.Prune(settings, toViewQueue, toManagerQueue)
 		}
 		wg.Wait()
+		return failed
 	}
 	
 	switch args.Mode {
-	case cli.ModeBackup:
-		run()
-	case cli.ModeRestore:
-		run()
+	case cli.ModeBackup, cli.ModeRestore, cli.ModePrune, cli.ModeVerify, cli.ModeDiff:
+		if code := exitCode(args.Mode, settings.OnConflict, run()); code != 0 {
+			os.Exit(code)
+		}
+	case cli.ModeSnapshots:
+		inputPassword()
+		snapshots, err := core.ListSnapshots(settings.SrcDir, settings.Password)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		for _, s := range snapshots {
+			status := "complete"
+			if !s.Complete {
+				status = "incomplete"
+			}
+			fmt.Printf("%-6d %s  %s\n", s.ID, s.Time.Format("2006-01-02 15:04:05"), status)
+		}
 	case cli.ModeVersion:
 		fmt.Println(constants.APP_VERSION)
 	case cli.ModeHelp:
 		cli.Usage()
 	}
 }
+
+// 実行結果から終了コードを決定する。failed は run が失敗（エラー・差分・検証の失敗）を報告したかどうか。
+// バックアップは常に 0 を返す。リストアは fail を指定した場合のみ、競合による中止を含むエラーがあれば 1 を返す。
+func exitCode(mode cli.ModeType, onConflict core.ConflictPolicy, failed bool) int {
+	switch mode {
+	case cli.ModeRestore:
+		if failed && onConflict == core.ConflictFail { return 1 }
+	case cli.ModePrune, cli.ModeVerify, cli.ModeDiff:
+		if failed { return 1 }
+	}
+	return 0
+}
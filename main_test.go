@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	
+	"bakashier/cli"
+	"bakashier/core"
+)
+
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       cli.ModeType
+		onConflict core.ConflictPolicy
+		failed     bool
+		want       int
+	}{
+		{"backup never fails", cli.ModeBackup, "", true, 0},
+		{"restore succeeded", cli.ModeRestore, core.ConflictFail, false, 0},
+		{"restore aborted on conflict", cli.ModeRestore, core.ConflictFail, true, 1},
+		{"restore errors with overwrite", cli.ModeRestore, core.ConflictOverwrite, true, 0},
+		{"restore errors with the default policy", cli.ModeRestore, "", true, 0},
+		{"restore errors with skip", cli.ModeRestore, core.ConflictSkip, true, 0},
+		{"prune failed", cli.ModePrune, "", true, 1},
+		{"prune succeeded", cli.ModePrune, "", false, 0},
+		{"verify failed", cli.ModeVerify, "", true, 1},
+		{"verify passed", cli.ModeVerify, "", false, 0},
+		{"diff found differences", cli.ModeDiff, "", true, 1},
+		{"diff found no differences", cli.ModeDiff, "", false, 0},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.mode, tt.onConflict, tt.failed); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+
+// 書き込み途中の一時ファイルの拡張子。
+const TempFileSuffix = ".tmp"
+
+// 同じディレクトリ内の一時ファイルに書き込み、Commit で本来のパスに置き換えるファイル。
+// 書き込み中に電源断などが起きても、既存のファイルは壊れない。
+type AtomicFile struct {
+	*os.File
+	path      string
+	committed bool
+}
+
+// path と同じディレクトリに一時ファイルを作成する。
+func CreateAtomicFile(path string) (*AtomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+TempFileSuffix)
+	if err != nil { return nil, err }
+	return &AtomicFile{File: file, path: path}, nil
+}
+
+// 一時ファイルを fsync して閉じ、本来のパスにリネームする。
+func (f *AtomicFile) Commit() error {
+	if err := f.File.Sync(); err != nil {
+		f.Abort()
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	if err := os.Rename(f.File.Name(), f.path); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	f.committed = true
+	return nil
+}
+
+// Commit されていない場合は一時ファイルを閉じて削除する。Commit 後に呼んでも何もしない。
+func (f *AtomicFile) Abort() {
+	if f.committed {
+		return
+	}
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+// data を一時ファイルに書き込んでから path に置き換え、ディレクトリも fsync する。
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	file, err := CreateAtomicFile(path)
+	if err != nil { return err }
+	defer file.Abort()
+	if err := file.Chmod(perm); err != nil { return err }
+	if _, err := file.Write(data); err != nil { return err }
+	if err := file.Commit(); err != nil { return err }
+	return SyncDirectory(filepath.Dir(path))
+}
+
+// ディレクトリを fsync し、リネームを永続化する。Windows ではディレクトリの fsync ができないため何もしない。
+func SyncDirectory(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil { return err }
+	defer d.Close()
+	return d.Sync()
+}
+
+// name が CreateAtomicFile で作成された一時ファイルの名前かを判定する。
+func IsTempFileName(name string) bool {
+	return strings.HasSuffix(name, TempFileSuffix)
+}
@@ -8,19 +8,88 @@ import (
 	"errors"
 	"io"
 	
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
 )
 
 
-// パスワードから PBKDF2 で鍵を導出し、AES-GCM でバイト列を暗号化する。
-// 戻り値は salt(16) + nonce + ciphertext の形式。
-func EncryptBytesWithPassword(plainData []byte, password string) ([]byte, error) {
-	salt := make([]byte, 16)
+// 鍵導出関数の種類。
+type KDFType byte
+const (
+	KDFPBKDF2SHA256 KDFType = 1
+	KDFArgon2id     KDFType = 2
+)
+
+const SaltSize = 16           // ソルト長（バイト）
+const KeySize = 32            // AES-256 の鍵長（バイト）
+const PBKDF2Iterations = 4096 // PBKDF2 の反復回数
+
+// Argon2id の既定パラメータ。
+const Argon2Time = 3           // 反復回数
+const Argon2Memory = 64 * 1024 // メモリ量（KiB）
+const Argon2Threads = 4        // 並列度
+
+// 受け付ける KDF パラメータの上限。
+const MaxPBKDF2Iterations = 10000000    // PBKDF2 の反復回数
+const MaxArgon2Time = 1024              // Argon2id の反復回数
+const MaxArgon2Memory = 4 * 1024 * 1024 // Argon2id のメモリ量（KiB）
+
+// 鍵導出に使用するソルトとパラメータ。アーカイブのヘッダーに記録される。
+type KDFParams struct {
+	Type    KDFType
+	Salt    []byte
+	Time    uint32 // PBKDF2 の反復回数、または Argon2id の反復回数
+	Memory  uint32 // Argon2id のメモリ量（KiB）
+	Threads uint8  // Argon2id の並列度
+}
+
+var ErrUnsupportedKDF = errors.New("unsupported key derivation function")
+
+// kdfType の既定パラメータを返す。ソルトは含まない。
+func DefaultKDFParams(kdfType KDFType) KDFParams {
+	switch kdfType {
+	case KDFArgon2id:
+		return KDFParams{Type: KDFArgon2id, Time: Argon2Time, Memory: Argon2Memory, Threads: Argon2Threads}
+	default:
+		return KDFParams{Type: KDFPBKDF2SHA256, Time: PBKDF2Iterations}
+	}
+}
+
+// 新しいソルトを生成し、base のパラメータと組み合わせて返す。
+// base.Type が未指定の場合は PBKDF2 の既定パラメータを使用する。
+func NewKDFParams(base KDFParams) (KDFParams, error) {
+	if base.Type == 0 {
+		base = DefaultKDFParams(KDFPBKDF2SHA256)
+	}
+	salt := make([]byte, SaltSize)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return nil, err
+		return KDFParams{}, err
 	}
-	key := pbkdf2.Key([]byte(password), salt, 4096, 32, sha256.New)
-	
+	base.Salt = salt
+	return base, nil
+}
+
+// パスワードと params から AES-256 の鍵を導出する。
+func DeriveKey(password string, params KDFParams) ([]byte, error) {
+	switch params.Type {
+	case KDFPBKDF2SHA256:
+		if params.Time == 0 {
+			return nil, errors.New("invalid PBKDF2 iterations")
+		}
+		return pbkdf2.Key([]byte(password), params.Salt, int(params.Time), KeySize, sha256.New), nil
+	case KDFArgon2id:
+		if params.Time == 0 || params.Threads == 0 || params.Memory < 8*uint32(params.Threads) {
+			return nil, errors.New("invalid Argon2id parameters")
+		}
+		return argon2.IDKey([]byte(password), params.Salt, params.Time, params.Memory, params.Threads, KeySize), nil
+	default:
+		return nil, ErrUnsupportedKDF
+	}
+}
+
+// 導出済みの鍵で AES-GCM によりバイト列を暗号化する。additionalData は暗号化せずに認証する。
+// 戻り値は nonce + ciphertext の形式。nonce はチャンクごとに乱数で生成する。
+func EncryptBytesWithKey(plainData []byte, key []byte, additionalData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -36,23 +105,12 @@ func EncryptBytesWithPassword(plainData []byte, password string) ([]byte, error)
 		return nil, err
 	}
 	
-	cipherText := gcm.Seal(nil, nonce, plainData, nil)
-	
-	// salt | nonce | ciphertext
-	result := append(salt, nonce...)
-	result = append(result, cipherText...)
-	
-	return result, nil
+	// nonce | ciphertext
+	return gcm.Seal(nonce, nonce, plainData, additionalData), nil
 }
 
-// EncryptBytesWithPassword で暗号化したデータを、同じパスワードで復号する。
-func DecryptBytesWithPassword(cipherData []byte, password string) ([]byte, error) {
-	if len(cipherData) < 16 {
-		return nil, errors.New("ciphertext too short (no salt)")
-	}
-	salt := cipherData[:16]
-	key := pbkdf2.Key([]byte(password), salt, 4096, 32, sha256.New)
-	
+// EncryptBytesWithKey で暗号化したデータを、同じ鍵と additionalData で復号する。
+func DecryptBytesWithKey(cipherData []byte, key []byte, additionalData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -64,16 +122,49 @@ func DecryptBytesWithPassword(cipherData []byte, password string) ([]byte, error
 	}
 	
 	nonceSize := gcm.NonceSize()
-	if len(cipherData) < 16+nonceSize {
+	if len(cipherData) < nonceSize {
 		return nil, errors.New("ciphertext too short (no nonce)")
 	}
-	nonce := cipherData[16 : 16+nonceSize]
-	cipherText := cipherData[16+nonceSize:]
+	nonce := cipherData[:nonceSize]
+	cipherText := cipherData[nonceSize:]
 	
-	plainData, err := gcm.Open(nil, nonce, cipherText, nil)
+	return gcm.Open(nil, nonce, cipherText, additionalData)
+}
+
+// パスワードから PBKDF2 で鍵を導出し、AES-GCM でバイト列を暗号化する。
+// 戻り値は salt(16) + nonce + ciphertext の形式。
+func EncryptBytesWithPassword(plainData []byte, password string) ([]byte, error) {
+	params, err := NewKDFParams(DefaultKDFParams(KDFPBKDF2SHA256))
+	if err != nil {
+		return nil, err
+	}
+	key, err := DeriveKey(password, params)
 	if err != nil {
 		return nil, err
 	}
 	
-	return plainData, nil
-}
\ No newline at end of file
+	cipherText, err := EncryptBytesWithKey(plainData, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	
+	// salt | nonce | ciphertext
+	return append(params.Salt, cipherText...), nil
+}
+
+// EncryptBytesWithPassword で暗号化したデータを、同じパスワードで復号する。
+func DecryptBytesWithPassword(cipherData []byte, password string) ([]byte, error) {
+	if len(cipherData) < SaltSize {
+		return nil, errors.New("ciphertext too short (no salt)")
+	}
+	key, err := DeriveKey(password, KDFParams{
+		Type: KDFPBKDF2SHA256,
+		Salt: cipherData[:SaltSize],
+		Time: PBKDF2Iterations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	
+	return DecryptBytesWithKey(cipherData[SaltSize:], key, nil)
+}
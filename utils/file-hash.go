@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
 	"hash/crc32"
+	"io"
+	"os"
 )
 
 
@@ -13,3 +16,13 @@ func CRC32HashBytes(data []byte) []byte {
 	binary.BigEndian.PutUint32(buf, hash)
 	return buf
 }
+
+// ファイルの内容の SHA-256 を計算する。
+func SHA256File(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil { return nil, err }
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,44 @@
+//go:build linux || darwin || freebsd
+
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	
+	"golang.org/x/sys/unix"
+)
+
+
+// ファイル内のホール（データを持たない範囲）。
+type HoleRange struct {
+	Offset uint64
+	Length uint64
+}
+
+// f の先頭 size バイトにあるホールの一覧を、SEEK_DATA/SEEK_HOLE で検出して位置の順に返す。
+// ファイルシステムがホールの検出に対応していない場合は空を返す。読み込み位置は先頭に戻す。
+func FileHoles(f *os.File, size int64) ([]HoleRange, error) {
+	holes := []HoleRange{}
+	var offset int64 = 0
+	for offset < size {
+		hole, err := f.Seek(offset, unix.SEEK_HOLE)
+		if errors.Is(err, unix.ENXIO) { break }
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTSUP) {
+			holes = []HoleRange{}
+			break
+		}
+		if err != nil { return nil, err }
+		if hole >= size { break }
+		data, err := f.Seek(hole, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) || (err == nil && data > size) {
+			data, err = size, nil
+		}
+		if err != nil { return nil, err }
+		holes = append(holes, HoleRange{Offset: uint64(hole), Length: uint64(data - hole)})
+		offset = data
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil { return nil, err }
+	return holes, nil
+}
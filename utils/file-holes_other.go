@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !freebsd
+
+package utils
+
+import (
+	"os"
+)
+
+
+// ファイル内のホール（データを持たない範囲）。
+type HoleRange struct {
+	Offset uint64
+	Length uint64
+}
+
+// ホールを検出できない環境では、常に空を返す。
+func FileHoles(f *os.File, size int64) ([]HoleRange, error) {
+	return []HoleRange{}, nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+
+// info のデバイス番号・inode 番号・ハードリンク数を返す。取得できない場合は ok に false を返す。
+func FileInode(info os.FileInfo) (dev uint64, ino uint64, nlink uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), uint64(stat.Nlink), true
+}
@@ -0,0 +1,11 @@
+package utils
+
+import (
+	"os"
+)
+
+
+// Windows では os.FileInfo から inode 番号を取得できないため、常に ok に false を返す。
+func FileInode(info os.FileInfo) (dev uint64, ino uint64, nlink uint64, ok bool) {
+	return 0, 0, 0, false
+}
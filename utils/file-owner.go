@@ -0,0 +1,18 @@
+//go:build !windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+
+// info の所有者の uid/gid を返す。取得できない場合は ok に false を返す。
+func FileOwner(info os.FileInfo) (uid uint32, gid uint32, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint32(stat.Uid), uint32(stat.Gid), true
+}
@@ -0,0 +1,11 @@
+package utils
+
+import (
+	"os"
+)
+
+
+// Windows では uid/gid による所有者を持たないため、常に ok に false を返す。
+func FileOwner(info os.FileInfo) (uid uint32, gid uint32, ok bool) {
+	return 0, 0, false
+}
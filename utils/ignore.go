@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"path"
+	"strings"
+)
+
+
+// gitignore 形式の除外ルール。
+type IgnoreRule struct {
+	base     string   // ルールを定義したディレクトリ（ルートからの '/' 区切りの相対パス、ルートは ""）
+	segments []string // '/' で分割したパターン
+	negate   bool     // 先頭の '!' による再包含
+	dirOnly  bool     // 末尾の '/' によるディレクトリ限定
+	anchored bool     // 途中または先頭に '/' を含む場合は base からの相対パスに一致させる
+}
+
+// gitignore 形式の行 lines を解析して除外ルールを返す。
+// base はルールを定義したディレクトリのルートからの相対パス（'/' 区切り）で、ルートは "" を指定する。
+// 空行と '#' で始まる行は無視し、先頭の '\' は '#' や '!' のエスケープとして扱う。
+func ParseIgnoreRules(base string, lines []string) []IgnoreRule {
+	rules := make([]IgnoreRule, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		
+		rule := IgnoreRule{base: strings.Trim(base, "/")}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.segments = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ルートからの相対パス relPath（'/' 区切り）が rules によって除外されるかを判定する。
+// gitignore と同様に、後に定義されたルールほど優先される。
+func MatchIgnoreRules(rules []IgnoreRule, relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.match(relPath, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (rule IgnoreRule) match(relPath string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	
+	// ルールを定義したディレクトリからの相対パスに変換する
+	if rule.base != "" {
+		if !strings.HasPrefix(relPath, rule.base+"/") {
+			return false
+		}
+		relPath = relPath[len(rule.base)+1:]
+	}
+	
+	if !rule.anchored {
+		return matchSegments(rule.segments, []string{path.Base(relPath)})
+	}
+	return matchSegments(rule.segments, strings.Split(relPath, "/"))
+}
+
+// パターンの各要素をパスの各要素に一致させる。"**" は 0 個以上の要素に一致する。
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	matched, err := path.Match(pattern[0], name[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"testing"
+)
+
+
+func TestMatchIgnoreRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  string
+		lines []string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"name pattern at root", "", []string{"*.log"}, "a.log", false, true},
+		{"name pattern in subdirectory", "", []string{"*.log"}, "dir/sub/b.log", false, true},
+		{"name pattern does not match other names", "", []string{"*.log"}, "a.txt", false, false},
+		{"directory-only pattern matches directory", "", []string{"build/"}, "src/build", true, true},
+		{"directory-only pattern skips file", "", []string{"build/"}, "build", false, false},
+		{"leading slash anchors to base", "", []string{"/tmp"}, "tmp", true, true},
+		{"leading slash does not match deeper", "", []string{"/tmp"}, "src/tmp", true, false},
+		{"inner slash anchors to base", "", []string{"docs/*.md"}, "docs/a.md", false, true},
+		{"inner slash does not match deeper", "", []string{"docs/*.md"}, "x/docs/a.md", false, false},
+		{"star does not cross slash", "", []string{"docs/*.md"}, "docs/sub/a.md", false, false},
+		{"leading double star matches root", "", []string{"**/cache"}, "cache", true, true},
+		{"leading double star matches deeper", "", []string{"**/cache"}, "a/b/cache", true, true},
+		{"trailing double star matches contents", "", []string{"logs/**"}, "logs/a/b.txt", false, true},
+		{"inner double star matches zero segments", "", []string{"a/**/b"}, "a/b", false, true},
+		{"inner double star matches many segments", "", []string{"a/**/b"}, "a/x/y/b", false, true},
+		{"character class", "", []string{"file[0-9].txt"}, "file7.txt", false, true},
+		{"question mark", "", []string{"?.txt"}, "ab.txt", false, false},
+		{"negation re-includes", "", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"negation leaves others excluded", "", []string{"*.log", "!keep.log"}, "drop.log", false, true},
+		{"later rule wins", "", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"comment line is ignored", "", []string{"# *.log"}, "# *.log", false, false},
+		{"escaped hash", "", []string{"\\#notes"}, "#notes", false, true},
+		{"escaped exclamation", "", []string{"\\!important"}, "!important", false, true},
+		{"trailing spaces are trimmed", "", []string{"*.bak  \t"}, "a.bak", false, true},
+		{"empty lines are ignored", "", []string{"", "   "}, "a", false, false},
+		{"rule in subdirectory matches below it", "sub", []string{"*.tmp"}, "sub/x/a.tmp", false, true},
+		{"rule in subdirectory does not match outside", "sub", []string{"*.tmp"}, "a.tmp", false, false},
+		{"rule in subdirectory does not match sibling prefix", "sub", []string{"*.tmp"}, "subdir/a.tmp", false, false},
+		{"anchored rule in subdirectory", "sub", []string{"/only"}, "sub/only", false, true},
+		{"anchored rule in subdirectory does not match deeper", "sub", []string{"/only"}, "sub/x/only", false, false},
+	}
+	for _, tt := range tests {
+		rules := ParseIgnoreRules(tt.base, tt.lines)
+		if got := MatchIgnoreRules(rules, tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%s: MatchIgnoreRules(%q, %q) = %v, want %v", tt.name, tt.lines, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseIgnoreRulesSkipsEmptyPatterns(t *testing.T) {
+	rules := ParseIgnoreRules("", []string{"", "# comment", "/", "!", "*.log"})
+	if len(rules) != 1 {
+		t.Fatalf("got %d rules, want 1", len(rules))
+	}
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"path"
+	"strings"
+)
+
+
+// '/' 区切りのパターン pattern が相対パス name 全体に一致するかを判定する。
+// 各要素は path.Match で比較し、"**" は 0 個以上の要素に一致する。
+func MatchPathPattern(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// 相対パス dir の子孫に pattern に一致するパスがありうるかを判定する。
+func MatchPathPatternPrefix(pattern string, dir string) bool {
+	return matchSegmentsPrefix(strings.Split(pattern, "/"), strings.Split(dir, "/"))
+}
+
+// pattern が不正な場合はエラーを返す。
+func ValidatePathPattern(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// パターンの先頭の要素が name のすべての要素に一致するかを判定する。
+func matchSegmentsPrefix(pattern []string, name []string) bool {
+	if len(name) == 0 {
+		return true
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" {
+		return true
+	}
+	matched, err := path.Match(pattern[0], name[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchSegmentsPrefix(pattern[1:], name[1:])
+}
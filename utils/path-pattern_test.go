@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"testing"
+)
+
+
+func TestMatchPathPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"docs/report.txt", "docs/report.txt", true},
+		{"docs/report.txt", "docs/report.txt.bak", false},
+		{"docs", "docs/report.txt", false},
+		{"docs/*.txt", "docs/report.txt", true},
+		{"docs/*.txt", "docs/sub/report.txt", false},
+		{"*/report.txt", "docs/report.txt", true},
+		{"docs/**", "docs/a/b/c.txt", true},
+		{"**/*.jpg", "photo.jpg", true},
+		{"**/*.jpg", "a/b/photo.jpg", true},
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+		{"a/**/z", "a/b/c/y", false},
+		{"photos/202[0-4]/*", "photos/2023/img.png", true},
+		{"photos/202[0-4]/*", "photos/2025/img.png", false},
+		{"[", "[", false},
+	}
+	for _, tt := range tests {
+		if got := MatchPathPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchPathPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPathPatternPrefix(t *testing.T) {
+	tests := []struct {
+		pattern string
+		dir     string
+		want    bool
+	}{
+		{"docs/report.txt", "docs", true},
+		{"docs/report.txt", "photos", false},
+		{"docs/sub/report.txt", "docs/sub", true},
+		{"docs/sub/report.txt", "docs/other", false},
+		{"*/report.txt", "anything", true},
+		{"**/*.jpg", "a/b/c", true},
+		{"docs/**", "docs/a/b", true},
+		{"docs", "docs/sub", false},
+		{"a/*/c", "a/b", true},
+		{"a/*/c", "x/b", false},
+	}
+	for _, tt := range tests {
+		if got := MatchPathPatternPrefix(tt.pattern, tt.dir); got != tt.want {
+			t.Errorf("MatchPathPatternPrefix(%q, %q) = %v, want %v", tt.pattern, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePathPattern(t *testing.T) {
+	for _, pattern := range []string{"docs/report.txt", "**/*.jpg", "photos/202[0-4]/*", "a\\*b"} {
+		if err := ValidatePathPattern(pattern); err != nil {
+			t.Errorf("ValidatePathPattern(%q) = %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"[", "docs/[a-", "a/b\\"} {
+		if err := ValidatePathPattern(pattern); err == nil {
+			t.Errorf("ValidatePathPattern(%q) accepted an invalid pattern", pattern)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+
+var ErrUnsafePath = errors.New("path leaves the restore directory through a symlink or a non-directory")
+
+// name がディレクトリを跨がない単一のファイル名として安全かを判定する。
+// 空文字・"."・".."・区切り文字・NUL 文字・ボリューム名を含む名前は安全でないとみなす。
+func IsSafeFileName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	if strings.ContainsAny(name, "/\\\x00") {
+		return false
+	}
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return false
+	}
+	return true
+}
+
+// 安全でない name を単一のファイル名として安全な名前に置き換える。
+// 区切り文字・NUL 文字・ボリューム名の ':' は '_' に置き換え、"." や ".." には '_' を前置する。
+func ToSafeFileName(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', 0:
+			return '_'
+		}
+		return r
+	}, name)
+	if volume := filepath.VolumeName(safe); volume != "" {
+		safe = strings.ReplaceAll(volume, ":", "_") + safe[len(volume):]
+	}
+	if safe == "" || safe == "." || safe == ".." {
+		safe = "_" + safe
+	}
+	return safe
+}
+
+// path が root の内側（root 自身を含む）にあるかを判定する。
+// path の親ディレクトリが既に存在する場合は、シンボリックリンクを解決した実体でも判定する。
+func IsWithinDirectory(root string, path string) bool {
+	absRoot, err := filepath.Abs(root)
+	if err != nil { return false }
+	absPath, err := filepath.Abs(path)
+	if err != nil { return false }
+	if !isLexicallyWithin(absRoot, absPath) {
+		return false
+	}
+	
+	realParent, err := filepath.EvalSymlinks(filepath.Dir(absPath))
+	if err != nil {
+		return true // 親ディレクトリがまだ存在しない
+	}
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil { return false }
+	return isLexicallyWithin(realRoot, filepath.Join(realParent, filepath.Base(absPath)))
+}
+
+// 絶対パス path が絶対パス root の内側にあるかを文字列上で判定する。
+func isLexicallyWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil { return false }
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// root から dir までのディレクトリを、シンボリックリンクをたどらずに1階層ずつ作成する。
+// root 自身は MkdirAll で作成し、シンボリックリンクでもよい。途中に既存のシンボリックリンクやディレクトリ以外のファイルがある場合、
+// または dir が root の外を指す場合は ErrUnsafePath を返す。MkdirAll と異なり、復元中に作られたリンクを経由して root の外に書き込まない。
+func MkdirWithin(root string, dir string) error {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil { return err }
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, dir)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil { return err }
+	if rel == "." { return nil }
+	
+	current := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, name)
+		info, err := os.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) {
+			// 他のワーカーが同時に作成した場合は、作成後の状態を確認し直す
+			if err := os.Mkdir(current, 0755); err != nil && !errors.Is(err, os.ErrExist) { return err }
+			info, err = os.Lstat(current)
+		}
+		if err != nil { return err }
+		if !info.IsDir() {
+			return fmt.Errorf("%w: %s", ErrUnsafePath, current)
+		}
+	}
+	return nil
+}
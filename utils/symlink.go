@@ -0,0 +1,16 @@
+//go:build !windows
+
+package utils
+
+import (
+	"time"
+	
+	"golang.org/x/sys/unix"
+)
+
+
+// シンボリックリンク自体の更新日時を設定する。os.Chtimes はリンク先に作用するため使えない。
+func SetSymlinkModTime(path string, modTime time.Time) error {
+	now := time.Now()
+	return unix.Lutimes(path, []unix.Timeval{unix.NsecToTimeval(now.UnixNano()), unix.NsecToTimeval(modTime.UnixNano())})
+}
@@ -0,0 +1,11 @@
+package utils
+
+import (
+	"time"
+)
+
+
+// Windows ではシンボリックリンク自体の更新日時を設定しない。
+func SetSymlinkModTime(path string, modTime time.Time) error {
+	return nil
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package utils
+
+import (
+	"bytes"
+	"errors"
+	
+	"golang.org/x/sys/unix"
+)
+
+
+// path の拡張属性を名前と値の組で返す。シンボリックリンクは辿らない。
+// ファイルシステムが拡張属性に対応していない場合は空を返す。
+func ReadXattrs(path string) (map[string][]byte, error) {
+	names, err := listXattrNames(path)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte, len(names))
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		// 一覧の取得後に削除された属性は記録しない
+		if errors.Is(err, unix.ENODATA) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = value
+	}
+	return xattrs, nil
+}
+
+// path に拡張属性 name を設定する。シンボリックリンクは辿らない。
+func WriteXattr(path string, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+// 拡張属性の名前の一覧を返す。取得中に属性が増えてバッファが不足した場合は取り直す。
+func listXattrNames(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// 拡張属性の値を返す。取得中に値が大きくなりバッファが不足した場合は取り直す。
+func getXattr(path string, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package utils
+
+import (
+	"errors"
+)
+
+
+// 拡張属性に対応していないプラットフォームで設定しようとした場合のエラー。
+var ErrXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// Linux 以外では拡張属性を取得せず、常に空を返す。
+func ReadXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// Linux 以外では拡張属性を設定できないため、常に ErrXattrUnsupported を返す。
+func WriteXattr(path string, name string, value []byte) error {
+	return ErrXattrUnsupported
+}
@@ -15,6 +15,11 @@ const (
 	FINISH_FILE MessageToViewType = "FINISH_FILE" // ファイル処理完了
 	FINISH_DIR MessageToViewType = "FINISH_DIR"   // ディレクトリ処理完了
 	ERROR MessageToViewType = "ERROR"             // エラー報告
+	RESULT MessageToViewType = "RESULT"           // ファイルごとの結果報告（Detail が空なら成功）
+	DIFF MessageToViewType = "DIFF"               // 差分の報告（Detail に差分の種類）
+	PLAN MessageToViewType = "PLAN"               // DryRun 時の実行予定の報告（Detail に操作の種類）
+	CONFLICT MessageToViewType = "CONFLICT"       // 復元先の既存ファイルとの競合の報告（Detail に判断）
+	WARNING MessageToViewType = "WARNING"         // 警告（Detail に内容）。エラーとしては扱わない
 	FINISHED MessageToViewType = "FINISHED"       // 処理完了
 )
 
@@ -26,6 +26,13 @@ type model struct {
 	quit         bool
 	workers      map[uint]workerStatus // 各ワーカーの状態
 	ErrorLog     []string              // エラーログ
+	ResultLog    []string              // ファイルごとの結果
+	Passed       uint64                // 成功したファイル数
+	Failed       uint64                // 失敗したファイル数
+	DiffLog      []string              // 差分の一覧
+	PlanLog      []string              // DryRun 時の実行予定の一覧
+	ConflictLog  []string              // 復元先の既存ファイルとの競合と判断の一覧
+	WarningLog   []string              // 警告の一覧
 	receiveQueue <-chan MessageToView
 	sendQueue    chan<- MessageToManager
 }
@@ -85,6 +92,31 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		case ERROR:
 			m.ErrorLog = append(m.ErrorLog, msg.Detail)
+		case RESULT:
+			if msg.Detail == "" {
+				m.Passed++
+				m.ResultLog = append(m.ResultLog, fmt.Sprintf("OK  %s", msg.DistPath))
+			} else {
+				m.Failed++
+				m.ResultLog = append(m.ResultLog, fmt.Sprintf("NG  %s: %s", msg.DistPath, msg.Detail))
+				m.ErrorLog = append(m.ErrorLog, fmt.Sprintf("%s: %s", msg.DistPath, msg.Detail))
+			}
+		case DIFF:
+			m.DiffLog = append(m.DiffLog, fmt.Sprintf("%-12s %s", msg.Detail, msg.DistPath))
+		case PLAN:
+			if msg.SrcPath != "" && msg.DistPath != "" {
+				m.PlanLog = append(m.PlanLog, fmt.Sprintf("%-10s %s -> %s", msg.Detail, msg.SrcPath, msg.DistPath))
+			} else {
+				m.PlanLog = append(m.PlanLog, fmt.Sprintf("%-10s %s%s", msg.Detail, msg.SrcPath, msg.DistPath))
+			}
+		case CONFLICT:
+			if msg.SrcPath != "" && msg.SrcPath != msg.DistPath {
+				m.ConflictLog = append(m.ConflictLog, fmt.Sprintf("%-10s %s -> %s", msg.Detail, msg.SrcPath, msg.DistPath))
+			} else {
+				m.ConflictLog = append(m.ConflictLog, fmt.Sprintf("%-10s %s", msg.Detail, msg.DistPath))
+			}
+		case WARNING:
+			m.WarningLog = append(m.WarningLog, msg.Detail)
 		case FINISHED:
 			return m, tea.Quit
 		}
@@ -119,6 +151,12 @@ func (m model) View() string {
 		modeLabel = "Backup"
 	case cli.ModeRestore:
 		modeLabel = "Restore"
+	case cli.ModeVerify:
+		modeLabel = "Verify"
+	case cli.ModeDiff:
+		modeLabel = "Diff"
+	case cli.ModePrune:
+		modeLabel = "Prune"
 	}
 	
 	red := lipgloss.NewStyle().Foreground(lipgloss.Color("1"))